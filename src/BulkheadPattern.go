@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"net/http"
-	"sync"
+	"os"
+	"time"
+
+	"github.com/saidatta/MyGoLangExperiments/src/resilience"
 )
 
 //The bulkhead pattern is a design pattern that is used to isolate failures in a microservice architecture. It works by
@@ -20,75 +26,90 @@ import (
 //allowing a limited number of requests to pass through until the service has recovered. The bulkhead pattern, on the
 //other hand, does not block requests, but instead routes them to a different bulkhead if one fails.
 
-// Bulkhead is a type that represents a single bulkhead
-type Bulkhead struct {
-	// mu is a mutex used to synchronize access to the bulkhead
-	mu sync.Mutex
-
-	// requests is a slice that holds the requests currently being processed by the bulkhead
-	requests []*http.Request
-
-	// capacity is the maximum number of requests that the bulkhead can handle at a time
-	capacity int
-}
+// defaultPolicy sizes the bulkheads when no policy file is given with -policy. Every partition, the overflow pool and
+// the bulkhead in front of each upstream in proxy mode is a dependency in the policy file's terms.
+const defaultPolicy = `{
+  "dependencies": {
+    "admin":    {"bulkhead": {"max_concurrent": 2}},
+    "tenants":  {"bulkhead": {"max_concurrent": 5, "queue_size": 5, "max_wait": "200ms"}},
+    "overflow": {"bulkhead": {"max_concurrent": 5}},
+    "upstream": {"bulkhead": {"max_concurrent": 5, "queue_size": 5, "max_wait": "200ms"}}
+  }
+}`
 
-// NewBulkhead creates a new bulkhead with the given capacity
-func NewBulkhead(capacity int) *Bulkhead {
-	return &Bulkhead{
-		capacity: capacity,
+func main() {
+	policyPath := flag.String("policy", "", "JSON policy file with the bulkhead sizes (see resilience.PolicyFile)")
+	flag.Parse()
+
+	// Read the bulkhead sizes from the policy file
+	data := []byte(defaultPolicy)
+	if *policyPath != "" {
+		var err error
+		if data, err = os.ReadFile(*policyPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
-}
-
-// HandleRequest handles a single request by adding it to the bulkhead's request slice and processing it
-func (b *Bulkhead) HandleRequest(r *http.Request) {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
-	// Add the request to the bulkhead's request slice
-	b.requests = append(b.requests, r)
-
-	// Process the request
-	// (actual request processing code goes here)
-}
-
-// LoadBalancer is a type that distributes requests to different bulkheads
-type LoadBalancer struct {
-	// bulkheads is a slice of all the bulkheads managed by the load balancer
-	bulkheads []*Bulkhead
-}
-
-// NewLoadBalancer creates a new load balancer with the given bulkheads
-func NewLoadBalancer(bulkheads []*Bulkhead) *LoadBalancer {
-	return &LoadBalancer{
-		bulkheads: bulkheads,
+	policy, err := resilience.ParsePolicyFile(data)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-}
-
-// ServeHTTP implements the http.Handler interface, allowing the load balancer to act as an HTTP server
-func (l *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Find the bulkhead with the lowest number of requests
-	var leastLoaded *Bulkhead
-	for _, b := range l.bulkheads {
-		b.mu.Lock()
-		if leastLoaded == nil || len(b.requests) < len(leastLoaded.requests) {
-			leastLoaded = b
+	settings := func(name string) resilience.BulkheadSettings {
+		if d, ok := policy.Dependencies[name]; ok && d.Bulkhead != nil {
+			return d.Bulkhead.Settings()
 		}
-		b.mu.Unlock()
+		return resilience.BulkheadSettings{}
 	}
 
-	// Pass the request to the least loaded bulkhead
-	leastLoaded.HandleRequest(r)
-}
-
-func main() {
-	// Create a load balancer with three bulkheads
-	bulkheads := []*Bulkhead{
-		NewBulkhead(5),
-		NewBulkhead(5),
-		NewBulkhead(5),
+	// The work every bulkhead protects
+	work := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintln(w, "done")
+	})
+
+	// Create a router with a partition for admin traffic and three partitions that tenants are hashed onto, so a
+	// noisy tenant can only fill its own partition and the shared overflow pool. Each tenant partition runs its requests
+	// on its own workers.
+	tenants := settings("tenants")
+	tenants.Pooled = true
+	router, err := resilience.NewPartitionRouter(resilience.Partitioning{
+		Partitions: map[string]*resilience.Bulkhead{
+			"admin":    resilience.NewBulkhead(settings("admin"), work),
+			"tenants1": resilience.NewBulkhead(tenants, work),
+			"tenants2": resilience.NewBulkhead(tenants, work),
+			"tenants3": resilience.NewBulkhead(tenants, work),
+		},
+		Routes: []resilience.Route{
+			resilience.PathPrefix("/admin/", "admin"),
+			resilience.ConsistentHash(resilience.HeaderKey("X-Tenant-ID"),
+				[]string{"tenants1", "tenants2", "tenants3"}, 0),
+		},
+		Default:  "tenants1",
+		Overflow: resilience.NewBulkhead(settings("overflow"), work),
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	lb := NewLoadBalancer(bulkheads)
 
 	// Start the HTTP server
-	http.ListenAndServe(":8080", lb)
+	if flag.NArg() == 0 {
+		http.ListenAndServe(":8080", router)
+		return
+	}
+
+	// With upstream URLs as arguments, act as a reverse proxy over them instead
+	proxy, err := resilience.NewProxy(resilience.ProxySettings{
+		Upstreams:       flag.Args(),
+		Bulkhead:        settings("upstream"),
+		Picker:          resilience.NewPowerOfTwoChoices(),
+		HealthCheckPath: "/healthz",
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer proxy.Close(context.Background())
+	http.ListenAndServe(":8080", proxy)
 }
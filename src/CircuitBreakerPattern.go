@@ -1,86 +1,87 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"sync"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/saidatta/MyGoLangExperiments/src/resilience"
 )
 
 // The CircuitBreaker pattern is used to protect a service from being overwhelmed by requests, by temporarily
-// suspending requests to the service that is experiencing problems
+// suspending requests to the service that is experiencing problems. The breaker itself lives in package resilience.
 
-// CircuitBreaker monitors the status of the service and decides when open/close a circuit, based on consecuitve
-// error rate.
-type CircuitBreaker struct {
-	threshold int
-	failures  int
-	lock      sync.Mutex
-	state     bool
-}
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
 
-func (cb *CircuitBreaker) AllowRequest() bool {
-	cb.lock.Lock()
-	defer cb.lock.Unlock()
-	if cb.state {
-		// Circuit is open, do not allow requests
-		return false
-	}
-	// Circuit is closed, allow requests
-	return true
-}
-
-func (cb *CircuitBreaker) RecordFailure() {
-	cb.lock.Lock()
-	defer cb.lock.Unlock()
-	cb.failures++
-	if cb.failures >= cb.threshold {
-		// Open the circuit
-		cb.state = true
-		cb.failures = 0
-	}
-}
-
-func (cb *CircuitBreaker) RecordSuccess() {
-	cb.lock.Lock()
-	defer cb.lock.Unlock()
-	cb.failures = 0
-	if cb.state {
-		// Close the circuit
-		cb.state = false
-	}
-}
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
 
 func callService() error {
 	return errors.New("Zero cannot be used")
 }
 func main() {
-	cb := &CircuitBreaker{
-		threshold: 3,
-		state:     false,
-	}
+	cb := resilience.NewCircuitBreaker(resilience.Settings{
+		Threshold:   3,
+		OpenTimeout: 100 * time.Millisecond,
+	})
 
 	for i := 0; i < 10; i++ {
-		if cb.AllowRequest() {
-			// Call the service
-			err := callService()
-			if err != nil {
-				// Record the failure
-				cb.RecordFailure()
-			} else {
-				// Record the success
-				cb.RecordSuccess()
-			}
-		} else {
+		// Call the service; the breaker records the outcome
+		err := cb.Do(context.Background(), func(ctx context.Context) error {
+			return callService()
+		})
+		if errors.Is(err, resilience.ErrCircuitOpen) {
 			fmt.Println("Circuit is open, skipping request")
 		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Replay an outage against a breaker-guarded client and watch the breaker open, half-open and close again
+	injector, err := resilience.NewFaultInjector(resilience.Scenario{Seed: 1, Phases: []resilience.Phase{
+		{Name: "healthy", Requests: 5},
+		{
+			Name:     "outage",
+			Duration: resilience.Duration(150 * time.Millisecond),
+			Fault:    resilience.Fault{ErrorRate: 0.7, ResetRate: 0.3},
+		},
+		{Name: "recovered"},
+	}}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	newBreaker := func(host string) *resilience.CircuitBreaker {
+		return resilience.NewCircuitBreaker(resilience.Settings{
+			Threshold:   3,
+			OpenTimeout: 100 * time.Millisecond,
+			OnStateChange: func(from, to resilience.State) {
+				fmt.Printf("%s: %s -> %s\n", host, from, to)
+			},
+		})
+	}
+	client := &http.Client{Transport: resilience.NewTransport(injector.RoundTripper(service), newBreaker)}
+	for i := 0; i < 30; i++ {
+		if resp, err := client.Get("http://dependency/"); err == nil {
+			resp.Body.Close()
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
+	fmt.Println("scenario ended in phase", injector.Phase())
 }
 
 //In this example, the circuit breaker is initialized with a threshold of 3 failures before the circuit is opened. The
 //main loop makes 10 requests to the service, checking the circuit breaker's state before each request. If the circuit
 //is open, the request is skipped. If the circuit is closed, the request is made, and the circuit breaker is updated
-//based on the result of the request.
+//based on the result of the request. Once the circuit has been open for 100ms it becomes half-open and lets a single
+//trial request through; its outcome decides whether the circuit closes again or goes back to open.
+//
+//The second part of main replays a scripted outage with a FaultInjector in front of a breaker-guarded http.Client and
+//prints every state change of the breaker as the outage starts and ends.
 //
 //This is just a basic example of how you could use a circuit breaker in Go. You may want to customize the behavior of
-//your circuit breaker based on your specific needs. For example, you might want to add a timer to close the circuit
-//after a certain period of time, or add additional criteria for opening or closing the circuit.
+//your circuit breaker based on your specific needs, for example by adding additional criteria for opening or closing
+//the circuit.
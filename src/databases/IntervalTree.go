@@ -0,0 +1,138 @@
+package databases
+
+import "fmt"
+
+// IntervalTree stores values under closed intervals [Lo, Hi] and answers overlap queries. It is a Tree keyed by
+// interval, ordered by Lo and then Hi, in which every node also tracks the greatest Hi in its subtree. An overlap query
+// skips any subtree whose greatest Hi is below the query's start, and stops descending right once intervals start past
+// the query's end, so it costs O(min(n, m·log n)) for m results.
+type IntervalTree[T, V any] struct {
+	t   *Tree[Interval[T], intervalValue[T, V]]
+	cmp func(a, b T) int
+}
+
+// intervalValue is what an IntervalTree stores in each node: the caller's value and the greatest end point in the
+// node's subtree, which the tree keeps up to date through its augment hook.
+type intervalValue[T, V any] struct {
+	value V
+	high  T
+}
+
+// Interval is the closed interval [Lo, Hi].
+type Interval[T any] struct {
+	Lo, Hi T
+}
+
+// IntervalEntry is an interval and the value stored under it.
+type IntervalEntry[T, V any] struct {
+	Interval[T]
+	Value V
+}
+
+// NewIntervalTree creates an empty interval tree whose end points are ordered by cmp.
+func NewIntervalTree[T, V any](cmp func(a, b T) int) *IntervalTree[T, V] {
+	it := &IntervalTree[T, V]{cmp: cmp}
+	it.t = New[Interval[T], intervalValue[T, V]](func(a, b Interval[T]) int {
+		if c := cmp(a.Lo, b.Lo); c != 0 {
+			return c
+		}
+		return cmp(a.Hi, b.Hi)
+	})
+	it.t.augment = it.augment
+	return it
+}
+
+// augment recomputes the greatest end point in the subtree rooted at h.
+func (it *IntervalTree[T, V]) augment(h *node[Interval[T], intervalValue[T, V]]) {
+	h.value.high = it.high(h)
+}
+
+func (it *IntervalTree[T, V]) high(h *node[Interval[T], intervalValue[T, V]]) T {
+	high := h.key.Hi
+	if h.left != nil && it.cmp(h.left.value.high, high) > 0 {
+		high = h.left.value.high
+	}
+	if h.right != nil && it.cmp(h.right.value.high, high) > 0 {
+		high = h.right.value.high
+	}
+	return high
+}
+
+// Len returns the number of intervals in the tree.
+func (it *IntervalTree[T, V]) Len() int {
+	return it.t.Len()
+}
+
+// Insert stores value under [lo, hi], replacing the value of an identical interval. It panics if lo > hi.
+func (it *IntervalTree[T, V]) Insert(lo, hi T, value V) {
+	if it.cmp(lo, hi) > 0 {
+		panic("databases: interval with lo > hi")
+	}
+	it.t.Put(Interval[T]{lo, hi}, intervalValue[T, V]{value: value, high: hi})
+}
+
+// Delete removes the interval [lo, hi] and reports whether it was present.
+func (it *IntervalTree[T, V]) Delete(lo, hi T) bool {
+	return it.t.Delete(Interval[T]{lo, hi})
+}
+
+// Get returns the value stored under exactly [lo, hi].
+func (it *IntervalTree[T, V]) Get(lo, hi T) (V, bool) {
+	v, ok := it.t.Get(Interval[T]{lo, hi})
+	return v.value, ok
+}
+
+// Overlapping returns every stored interval that shares at least one point with [lo, hi], ordered by start.
+func (it *IntervalTree[T, V]) Overlapping(lo, hi T) []IntervalEntry[T, V] {
+	var out []IntervalEntry[T, V]
+	it.overlapping(it.t.root, lo, hi, &out)
+	return out
+}
+
+// Stab returns every stored interval that contains point, ordered by start.
+func (it *IntervalTree[T, V]) Stab(point T) []IntervalEntry[T, V] {
+	return it.Overlapping(point, point)
+}
+
+func (it *IntervalTree[T, V]) overlapping(h *node[Interval[T], intervalValue[T, V]], lo, hi T,
+	out *[]IntervalEntry[T, V]) {
+	// Nothing in this subtree ends at or after lo.
+	if h == nil || it.cmp(h.value.high, lo) < 0 {
+		return
+	}
+	it.overlapping(h.left, lo, hi, out)
+	// This interval and everything to its right start after hi.
+	if it.cmp(h.key.Lo, hi) > 0 {
+		return
+	}
+	if it.cmp(h.key.Hi, lo) >= 0 {
+		*out = append(*out, IntervalEntry[T, V]{Interval: h.key, Value: h.value.value})
+	}
+	it.overlapping(h.right, lo, hi, out)
+}
+
+// Ascend calls fn for every interval ordered by start until fn returns false.
+func (it *IntervalTree[T, V]) Ascend(fn func(iv Interval[T], value V) bool) {
+	it.t.Ascend(func(iv Interval[T], v intervalValue[T, V]) bool { return fn(iv, v.value) })
+}
+
+// Validate checks the red-black invariants and the max end point of every subtree. See Tree.Validate.
+func (it *IntervalTree[T, V]) Validate() error {
+	if err := it.t.Validate(); err != nil {
+		return err
+	}
+	return it.validate(it.t.root)
+}
+
+func (it *IntervalTree[T, V]) validate(h *node[Interval[T], intervalValue[T, V]]) error {
+	if h == nil {
+		return nil
+	}
+	if want := it.high(h); it.cmp(h.value.high, want) != 0 {
+		return fmt.Errorf("llrb: max end point %v at interval %v, want %v", h.value.high, h.key, want)
+	}
+	if err := it.validate(h.left); err != nil {
+		return err
+	}
+	return it.validate(h.right)
+}
@@ -1,72 +1,165 @@
 package databases
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
-type Node struct {
-	key   int
-	value int
-	left  *Node
-	right *Node
+const (
+	red   = true
+	black = false
+)
+
+// Ordered is the set of types that can be compared with the built-in < and > operators.
+type Ordered interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64 | ~string
+}
+
+// Compare is the natural ordering of an Ordered type. It returns -1, 0 or +1 depending on whether a is less than,
+// equal to, or greater than b.
+func Compare[K Ordered](a, b K) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+type node[K, V any] struct {
+	key   K
+	value V
+	left  *node[K, V]
+	right *node[K, V]
 	color bool
+	n     int    // number of nodes in the subtree rooted here
+	gen   uint64 // generation of the tree that owns this node and may modify it in place
 }
 
-type Tree struct {
-	root *Node
+// Tree is a left-leaning red-black tree mapping keys of type K to values of type V. Keys are ordered by the comparator
+// the tree was created with. The zero value is not usable; create trees with New or NewOrdered.
+type Tree[K, V any] struct {
+	root *node[K, V]
+	cmp  func(a, b K) int
+	gen  uint64
+
+	// augment, when set, recomputes whatever summary of its subtree a node's value carries from the node and its
+	// children. It is called bottom-up wherever subtree sizes are, which is how IntervalTree keeps the greatest end
+	// point of every subtree.
+	augment func(h *node[K, V])
 }
 
-func (t *Tree) Insert(key, value int) {
-	t.root = insert(t.root, key, value)
+// New creates an empty tree ordered by cmp, which must return a negative number when a < b, zero when a == b and a
+// positive number when a > b.
+func New[K, V any](cmp func(a, b K) int) *Tree[K, V] {
+	return &Tree[K, V]{cmp: cmp}
+}
+
+// NewOrdered creates an empty tree ordered by the natural ordering of K.
+func NewOrdered[K Ordered, V any]() *Tree[K, V] {
+	return New[K, V](Compare[K])
+}
+
+// Len returns the number of keys stored in the tree.
+func (t *Tree[K, V]) Len() int {
+	return size(t.root)
+}
+
+// Put associates value with key, replacing any previous value.
+func (t *Tree[K, V]) Put(key K, value V) {
+	t.root = t.insert(t.root, key, value)
 	t.root.color = black
 }
 
-func insert(h *Node, key, value int) *Node {
+// Insert is an alias of Put.
+func (t *Tree[K, V]) Insert(key K, value V) {
+	t.Put(key, value)
+}
+
+func (t *Tree[K, V]) insert(h *node[K, V], key K, value V) *node[K, V] {
 	if h == nil {
-		return &Node{key: key, value: value, color: red}
+		return &node[K, V]{key: key, value: value, color: red, n: 1, gen: t.gen}
 	}
+	h = t.mutable(h)
 
-	if key < h.key {
-		h.left = insert(h.left, key, value)
-	} else if key > h.key {
-		h.right = insert(h.right, key, value)
+	if c := t.cmp(key, h.key); c < 0 {
+		h.left = t.insert(h.left, key, value)
+	} else if c > 0 {
+		h.right = t.insert(h.right, key, value)
 	} else {
 		h.value = value
 	}
 
 	if isRed(h.right) && !isRed(h.left) {
-		h = rotateLeft(h)
+		h = t.rotateLeft(h)
 	}
 	if isRed(h.left) && isRed(h.left.left) {
-		h = rotateRight(h)
+		h = t.rotateRight(h)
 	}
 	if isRed(h.left) && isRed(h.right) {
-		flipColors(h)
+		t.flipColors(h)
 	}
+	t.update(h)
 
 	return h
 }
 
-func isRed(node *Node) bool {
+func isRed[K, V any](node *node[K, V]) bool {
 	if node == nil {
 		return false
 	}
 	return node.color == red
 }
 
-func rotateLeft(h *Node) *Node {
-	x := h.right
+// mutable returns a node that t may modify in place: h itself if t owns it, or a copy owned by t if h is shared with a
+// snapshot. Every function that writes to a node must go through mutable first, which is what makes Snapshot cheap.
+func (t *Tree[K, V]) mutable(h *node[K, V]) *node[K, V] {
+	if h == nil || h.gen == t.gen {
+		return h
+	}
+	c := *h
+	c.gen = t.gen
+	return &c
+}
+
+func size[K, V any](node *node[K, V]) int {
+	if node == nil {
+		return 0
+	}
+	return node.n
+}
+
+// update recomputes the augmented fields of h from its children.
+func (t *Tree[K, V]) update(h *node[K, V]) {
+	h.n = size(h.left) + size(h.right) + 1
+	if t.augment != nil {
+		t.augment(h)
+	}
+}
+
+func (t *Tree[K, V]) rotateLeft(h *node[K, V]) *node[K, V] {
+	x := t.mutable(h.right)
 	h.right = x.left
 	x.left = h
 	x.color = h.color
 	h.color = red
+	// h is now x's child, so it has to be brought up to date first.
+	t.update(h)
+	t.update(x)
 	return x
 }
 
-func rotateRight(h *Node) *Node {
-	x := h.left
+func (t *Tree[K, V]) rotateRight(h *node[K, V]) *node[K, V] {
+	x := t.mutable(h.left)
 	h.left = x.right
 	x.right = h
 	x.color = h.color
 	h.color = red
+	t.update(h)
+	t.update(x)
 	return x
 }
 
@@ -93,20 +186,40 @@ func rotateRight(h *Node) *Node {
 // / \ / \
 // R  R R  R
 // The root node is now red, and its two children are black, which restores the balance of the tree.
-func flipColors(h *Node) {
+//
+// Only colors change, never which nodes are in which subtree, so the subtree sizes and any augmentation stay valid
+// without recomputation.
+func (t *Tree[K, V]) flipColors(h *node[K, V]) {
+	h.left = t.mutable(h.left)
+	h.right = t.mutable(h.right)
 	h.color = !h.color
 	h.left.color = !h.left.color
 	h.right.color = !h.right.color
 }
 
-func (t *Tree) Search(key int) *Node {
-	return search(t.root, key)
+// Get returns the value stored under key and whether the key was present.
+func (t *Tree[K, V]) Get(key K) (V, bool) {
+	if n := t.search(t.root, key); n != nil {
+		return n.value, true
+	}
+	var zero V
+	return zero, false
 }
 
-//This method uses a recursive approach to search for the specified key in the tree. It starts at the root node and
+// Has reports whether key is present in the tree.
+func (t *Tree[K, V]) Has(key K) bool {
+	return t.search(t.root, key) != nil
+}
+
+// Search is an alias of Get.
+func (t *Tree[K, V]) Search(key K) (V, bool) {
+	return t.Get(key)
+}
+
+//This method uses an iterative approach to search for the specified key in the tree. It starts at the root node and
 //compares the key to the key of the current node. If the key is less than the current node's key, it searches the left
-//subtree; if the key is greater, it searches the right subtree. If the key is found, the method returns a pointer to
-//the node; if the key is not found, it returns nil.
+//subtree; if the key is greater, it searches the right subtree. If the key is found, Search returns the value stored
+//under it and true; if the key is not found, it returns the zero value and false.
 
 //For example, to search for the key 7 in the following Red-Black tree:
 //
@@ -116,130 +229,341 @@ func (t *Tree) Search(key int) *Node {
 /// \   / \
 //2   4 6   8
 //The Search method would start at the root node (5), and then follow the right child (7) because 7 is greater than 5.
-//It would then return a pointer to the node with key 7.
+//It would then return the value stored under key 7 and true.
 
-func search(node *Node, key int) *Node {
-	if node == nil {
-		return nil
+func (t *Tree[K, V]) search(h *node[K, V], key K) *node[K, V] {
+	for h != nil {
+		if c := t.cmp(key, h.key); c < 0 {
+			h = h.left
+		} else if c > 0 {
+			h = h.right
+		} else {
+			return h
+		}
 	}
+	return nil
+}
 
-	if key < node.key {
-		return search(node.left, key)
-	} else if key > node.key {
-		return search(node.right, key)
-	} else {
-		return node
+// Min returns the smallest key in the tree and its value. ok is false if the tree is empty.
+func (t *Tree[K, V]) Min() (key K, value V, ok bool) {
+	if t.root == nil {
+		return key, value, false
+	}
+	n := minNode(t.root)
+	return n.key, n.value, true
+}
+
+// Max returns the largest key in the tree and its value. ok is false if the tree is empty.
+func (t *Tree[K, V]) Max() (key K, value V, ok bool) {
+	if t.root == nil {
+		return key, value, false
 	}
+	n := maxNode(t.root)
+	return n.key, n.value, true
 }
 
-func (t *Tree) Delete(key int) {
+// Ascend calls fn for every key in ascending order until fn returns false.
+func (t *Tree[K, V]) Ascend(fn func(key K, value V) bool) {
+	ascend(t.root, fn)
+}
+
+func ascend[K, V any](h *node[K, V], fn func(key K, value V) bool) bool {
+	if h == nil {
+		return true
+	}
+	return ascend(h.left, fn) && fn(h.key, h.value) && ascend(h.right, fn)
+}
+
+// Descend calls fn for every key in descending order until fn returns false.
+func (t *Tree[K, V]) Descend(fn func(key K, value V) bool) {
+	descend(t.root, fn)
+}
+
+func descend[K, V any](h *node[K, V], fn func(key K, value V) bool) bool {
+	if h == nil {
+		return true
+	}
+	return descend(h.right, fn) && fn(h.key, h.value) && descend(h.left, fn)
+}
+
+// AscendRange calls fn in ascending order for every key in the half-open range [lo, hi) until fn returns false.
+// Subtrees that lie entirely outside the range are skipped, so a scan costs O(log n + m) for m visited keys.
+func (t *Tree[K, V]) AscendRange(lo, hi K, fn func(key K, value V) bool) {
+	t.ascendRange(t.root, lo, hi, fn)
+}
+
+func (t *Tree[K, V]) ascendRange(h *node[K, V], lo, hi K, fn func(key K, value V) bool) bool {
+	if h == nil {
+		return true
+	}
+	aboveLo := t.cmp(h.key, lo) >= 0
+	belowHi := t.cmp(h.key, hi) < 0
+	if aboveLo && !t.ascendRange(h.left, lo, hi, fn) {
+		return false
+	}
+	if aboveLo && belowHi && !fn(h.key, h.value) {
+		return false
+	}
+	if belowHi {
+		return t.ascendRange(h.right, lo, hi, fn)
+	}
+	return true
+}
+
+// Floor returns the largest key less than or equal to key. ok is false if there is no such key.
+func (t *Tree[K, V]) Floor(key K) (k K, v V, ok bool) {
+	var best *node[K, V]
+	for h := t.root; h != nil; {
+		if c := t.cmp(key, h.key); c < 0 {
+			h = h.left
+		} else if c > 0 {
+			best, h = h, h.right
+		} else {
+			return h.key, h.value, true
+		}
+	}
+	if best == nil {
+		return k, v, false
+	}
+	return best.key, best.value, true
+}
+
+// Ceiling returns the smallest key greater than or equal to key. ok is false if there is no such key.
+func (t *Tree[K, V]) Ceiling(key K) (k K, v V, ok bool) {
+	var best *node[K, V]
+	for h := t.root; h != nil; {
+		if c := t.cmp(key, h.key); c < 0 {
+			best, h = h, h.left
+		} else if c > 0 {
+			h = h.right
+		} else {
+			return h.key, h.value, true
+		}
+	}
+	if best == nil {
+		return k, v, false
+	}
+	return best.key, best.value, true
+}
+
+// Rank returns the number of keys in the tree that are strictly less than key. key does not have to be present.
+func (t *Tree[K, V]) Rank(key K) int {
+	rank := 0
+	for h := t.root; h != nil; {
+		if c := t.cmp(key, h.key); c < 0 {
+			h = h.left
+		} else if c > 0 {
+			rank += size(h.left) + 1
+			h = h.right
+		} else {
+			return rank + size(h.left)
+		}
+	}
+	return rank
+}
+
+// Select returns the key of rank i, i.e. the i-th smallest key counting from zero. ok is false if i is out of range.
+func (t *Tree[K, V]) Select(i int) (k K, v V, ok bool) {
+	if i < 0 || i >= t.Len() {
+		return k, v, false
+	}
+	h := t.root
+	for {
+		if l := size(h.left); i < l {
+			h = h.left
+		} else if i > l {
+			i -= l + 1
+			h = h.right
+		} else {
+			return h.key, h.value, true
+		}
+	}
+}
+
+// Delete removes key from the tree and reports whether it was present. Deleting from an empty tree or deleting a
+// missing key leaves the tree unchanged.
+func (t *Tree[K, V]) Delete(key K) bool {
+	// The top-down delete below pushes red links down the search path on the assumption that the key will be found, so
+	// it must not run for a missing key.
+	if !t.Has(key) {
+		return false
+	}
+	t.root = t.mutable(t.root)
 	if !isRed(t.root.left) && !isRed(t.root.right) {
 		t.root.color = red
 	}
-	t.root = delete(t.root, key)
+	t.root = t.delete(t.root, key)
 	if t.root != nil {
 		t.root.color = black
 	}
+	return true
 }
 
-func delete(h *Node, key int) *Node {
-	if key < h.key {
+// delete assumes key is present in the subtree rooted at h.
+func (t *Tree[K, V]) delete(h *node[K, V], key K) *node[K, V] {
+	h = t.mutable(h)
+	if t.cmp(key, h.key) < 0 {
 		if !isRed(h.left) && !isRed(h.left.left) {
-			h = moveRedLeft(h)
+			h = t.moveRedLeft(h)
 		}
-		h.left = delete(h.left, key)
+		h.left = t.delete(h.left, key)
 	} else {
 		if isRed(h.left) {
-			h = rotateRight(h)
+			h = t.rotateRight(h)
 		}
-		if key == h.key && h.right == nil {
+		if t.cmp(key, h.key) == 0 && h.right == nil {
 			return nil
 		}
 		if !isRed(h.right) && !isRed(h.right.left) {
-			h = moveRedRight(h)
+			h = t.moveRedRight(h)
 		}
-		if key == h.key {
+		if t.cmp(key, h.key) == 0 {
 			min := minNode(h.right)
 			h.key, h.value = min.key, min.value
-			h.right = deleteMin(h.right)
+			h.right = t.deleteMin(h.right)
 		} else {
-			h.right = delete(h.right, key)
+			h.right = t.delete(h.right, key)
 		}
 	}
-	return balance(h)
+	return t.balance(h)
 }
 
-func minNode(h *Node) *Node {
-	if h.left == nil {
-		return h
+func minNode[K, V any](h *node[K, V]) *node[K, V] {
+	for h.left != nil {
+		h = h.left
 	}
-	return minNode(h.left)
+	return h
 }
 
-func deleteMin(h *Node) *Node {
+func maxNode[K, V any](h *node[K, V]) *node[K, V] {
+	for h.right != nil {
+		h = h.right
+	}
+	return h
+}
+
+func (t *Tree[K, V]) deleteMin(h *node[K, V]) *node[K, V] {
 	if h.left == nil {
 		return nil
 	}
+	h = t.mutable(h)
 	if !isRed(h.left) && !isRed(h.left.left) {
-		h = moveRedLeft(h)
+		h = t.moveRedLeft(h)
 	}
-	h.left = deleteMin(h.left)
-	return balance(h)
+	h.left = t.deleteMin(h.left)
+	return t.balance(h)
 }
 
-func moveRedLeft(h *Node) *Node {
-	flipColors(h)
+func (t *Tree[K, V]) moveRedLeft(h *node[K, V]) *node[K, V] {
+	t.flipColors(h)
 	if isRed(h.right.left) {
-		h.right = rotateRight(h.right)
-		h = rotateLeft(h)
-		flipColors(h)
+		h.right = t.rotateRight(h.right)
+		h = t.rotateLeft(h)
+		t.flipColors(h)
 	}
 	return h
 }
 
-func moveRedRight(h *Node) *Node {
-	flipColors(h)
+func (t *Tree[K, V]) moveRedRight(h *node[K, V]) *node[K, V] {
+	t.flipColors(h)
 	if isRed(h.left.left) {
-		h = rotateRight(h)
-		flipColors(h)
+		h = t.rotateRight(h)
+		t.flipColors(h)
 	}
 	return h
 }
 
-func balance(h *Node) *Node {
+func (t *Tree[K, V]) balance(h *node[K, V]) *node[K, V] {
 	if isRed(h.right) {
-		h = rotateLeft(h)
+		h = t.rotateLeft(h)
 	}
 	if isRed(h.left) && isRed(h.left.left) {
-		h = rotateRight(h)
+		h = t.rotateRight(h)
 	}
 	if isRed(h.left) && isRed(h.right) {
-		flipColors(h)
+		t.flipColors(h)
+	}
+	t.update(h)
+	return h
+}
 
+// Validate checks the left-leaning red-black invariants and returns an error describing the first violation found:
+// keys are in strictly increasing order, no red link leans right, no red node has a red left child, every path from the
+// root to a leaf has the same number of black links, the root is black and every subtree size is correct. It runs in
+// O(n) and is meant for tests and debugging.
+func (t *Tree[K, V]) Validate() error {
+	if isRed(t.root) {
+		return errors.New("llrb: root is red")
+	}
+	_, err := t.validate(t.root, nil, nil)
+	return err
+}
 
+// validate checks the subtree rooted at h, whose keys must lie strictly between lo and hi when those are non-nil, and
+// returns its black height.
+func (t *Tree[K, V]) validate(h *node[K, V], lo, hi *K) (int, error) {
+	if h == nil {
+		return 0, nil
+	}
+	if lo != nil && t.cmp(h.key, *lo) <= 0 {
+		return 0, fmt.Errorf("llrb: key %v is not greater than %v", h.key, *lo)
+	}
+	if hi != nil && t.cmp(h.key, *hi) >= 0 {
+		return 0, fmt.Errorf("llrb: key %v is not less than %v", h.key, *hi)
+	}
+	if isRed(h.right) {
+		return 0, fmt.Errorf("llrb: right-leaning red link below key %v", h.key)
+	}
+	if isRed(h) && isRed(h.left) {
+		return 0, fmt.Errorf("llrb: consecutive red links at key %v", h.key)
+	}
+	if h.n != size(h.left)+size(h.right)+1 {
+		return 0, fmt.Errorf("llrb: subtree size %d at key %v, want %d", h.n, h.key, size(h.left)+size(h.right)+1)
+	}
+	left, err := t.validate(h.left, lo, &h.key)
+	if err != nil {
+		return 0, err
+	}
+	right, err := t.validate(h.right, &h.key, hi)
+	if err != nil {
+		return 0, err
+	}
+	if left != right {
+		return 0, fmt.Errorf("llrb: black height %d on the left of key %v but %d on the right", left, h.key, right)
+	}
+	if !isRed(h) {
+		left++
+	}
+	return left, nil
+}
 
 func main() {
-	tree := &Tree{}
+	tree := NewOrdered[int, int]()
 
 	// Insert some key-value pairs into the tree
-	tree.Insert(5, 100)
-	tree.Insert(3, 200)
-	tree.Insert(7, 300)
-	tree.Insert(2, 400)
-	tree.Insert(4, 500)
-	tree.Insert(6, 600)
-	tree.Insert(8, 700)
+	tree.Put(5, 100)
+	tree.Put(3, 200)
+	tree.Put(7, 300)
+	tree.Put(2, 400)
+	tree.Put(4, 500)
+	tree.Put(6, 600)
+	tree.Put(8, 700)
 
 	// Search for a specific key in the tree
-	node := tree.Search(7)
-	if node != nil {
-		fmt.Println(node.value) // Output: 300
+	if value, ok := tree.Get(7); ok {
+		fmt.Println(value) // Output: 300
 	}
 
+	// Walk the keys in [3, 6) in order
+	tree.AscendRange(3, 6, func(key, value int) bool {
+		fmt.Println(key, value) // Output: 3 200, 4 500, 5 100
+		return true
+	})
+	fmt.Println(tree.Rank(6)) // Output: 4
+
 	// Delete a specific key from the tree
 	tree.Delete(7)
-	node = tree.Search(7)
-	if node == nil {
+	if _, ok := tree.Get(7); !ok {
 		fmt.Println("Key not found") // Output: Key not found
 	}
 }
@@ -0,0 +1,613 @@
+package databases
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LSM is a log-structured merge storage engine with a Tree as its memtable. Writes go to the write-ahead log and the
+// memtable; deletes are recorded as tombstones rather than removing anything. When the memtable grows past its size
+// budget it is frozen and a background goroutine flushes it to an SSTable in level 0. Reads consult the memtable, the
+// frozen memtables and then the tables from newest to oldest, and stop at the first value or tombstone they find.
+//
+// Level 0 holds whole flushed memtables, so its tables may overlap. Every deeper level is a single sorted run. When
+// level 0 collects LSMOptions.L0Tables tables they are merged into level 1, and when level i outgrows its size limit it
+// is merged into level i+1. Tombstones are dropped once they are merged into a level below which there is no data.
+//
+// The set of live tables is recorded in a MANIFEST file that is rewritten atomically on every flush and compaction.
+type LSM[K, V any] struct {
+	dir  string
+	cmp  func(a, b K) int
+	opts LSMOptions
+
+	mu       sync.RWMutex
+	cond     *sync.Cond // signalled when a frozen memtable has been flushed
+	mem      *Tree[K, lsmEntry[V]]
+	memBytes int
+	frozen   []*frozenMemtable[K, V] // oldest first
+	current  *version[K, V]
+	log      *wal
+	seq      uint64
+	nextFile uint64
+	closed   bool
+	bgErr    error // a failed flush or compaction stops further writes
+
+	kick chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// LSMOptions configures an LSM engine. The zero value is usable.
+type LSMOptions struct {
+	// MemtableSize is the approximate number of bytes of writes after which the memtable is frozen and flushed.
+	// Defaults to 4 MiB.
+	MemtableSize int
+	// MaxFrozen is the number of frozen memtables waiting to be flushed after which writes block. Defaults to 2.
+	MaxFrozen int
+	// L0Tables is the number of level-0 tables that triggers a compaction into level 1. Defaults to 4.
+	L0Tables int
+	// LevelSize is the size limit of level 1 in bytes; every further level may be ten times larger than the one above
+	// it. Defaults to 10 MiB.
+	LevelSize int64
+	// MaxLevels is the number of levels, including level 0. Defaults to 7.
+	MaxLevels int
+	// Sync decides when the write-ahead log is fsynced. Defaults to SyncAlways.
+	Sync SyncPolicy
+	// SegmentSize is the size of a write-ahead log segment. Defaults to 64 MiB.
+	SegmentSize int64
+}
+
+type frozenMemtable[K, V any] struct {
+	t      *Tree[K, lsmEntry[V]]
+	logEnd uint64 // the memtable's writes are all in log segments before this one
+}
+
+// version is an immutable list of the live tables. Readers hold a reference to the version they started with, so a
+// compaction can replace tables without pulling them out from under a read.
+type version[K, V any] struct {
+	levels [][]*sstable[K, V] // levels[0] newest first; deeper levels hold at most one table
+	refs   int32
+}
+
+func (v *version[K, V]) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+func (v *version[K, V]) unref() {
+	if atomic.AddInt32(&v.refs, -1) == 0 {
+		for _, level := range v.levels {
+			for _, t := range level {
+				t.unref()
+			}
+		}
+	}
+}
+
+func (v *version[K, V]) levelSize(i int) int64 {
+	var n int64
+	for _, t := range v.levels[i] {
+		n += t.size
+	}
+	return n
+}
+
+const manifestName = "MANIFEST"
+
+// OpenLSM opens the engine in dir, creating it if needed. It loads the tables listed in the manifest and replays the
+// write-ahead log into the memtable. opts may be nil.
+//
+// The bloom filters are built from the encoded keys and persist across runs, so K must have an encoding that does not
+// depend on the process: an integer, float, bool, string or []byte type, or a type implementing
+// encoding.BinaryMarshaler. Other key types are rejected.
+func OpenLSM[K, V any](dir string, cmp func(a, b K) int, opts *LSMOptions) (*LSM[K, V], error) {
+	if !hasStableEncoding[K]() {
+		return nil, fmt.Errorf("llrb: LSM key type %v must be a basic type or implement encoding.BinaryMarshaler",
+			reflect.TypeOf((*K)(nil)).Elem())
+	}
+	s := &LSM[K, V]{
+		dir:      dir,
+		cmp:      cmp,
+		mem:      New[K, lsmEntry[V]](cmp),
+		nextFile: 1,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MemtableSize <= 0 {
+		s.opts.MemtableSize = 4 << 20
+	}
+	if s.opts.MaxFrozen <= 0 {
+		s.opts.MaxFrozen = 2
+	}
+	if s.opts.L0Tables <= 0 {
+		s.opts.L0Tables = 4
+	}
+	if s.opts.LevelSize <= 0 {
+		s.opts.LevelSize = 10 << 20
+	}
+	if s.opts.MaxLevels < 2 {
+		s.opts.MaxLevels = 7
+	}
+	if s.opts.SegmentSize <= 0 {
+		s.opts.SegmentSize = 64 << 20
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.loadManifest(); err != nil {
+		return nil, err
+	}
+	last, err := replayWAL(dir, func(rec walRecord) error {
+		var key K
+		var e lsmEntry[V]
+		if err := decodeValue(rec.key, &key); err != nil {
+			return fmt.Errorf("%w: log record %d: %v", ErrCorrupt, rec.seq, err)
+		}
+		if rec.op == opDelete {
+			e.deleted = true
+		} else if err := decodeValue(rec.value, &e.value); err != nil {
+			return fmt.Errorf("%w: log record %d: %v", ErrCorrupt, rec.seq, err)
+		}
+		s.mem.Put(key, e)
+		s.memBytes += len(rec.key) + len(rec.value)
+		s.seq = rec.seq
+		return nil
+	})
+	if err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	if last == 0 {
+		last = 1
+	}
+	s.log = &wal{dir: dir, segmentSize: s.opts.SegmentSize, policy: s.opts.Sync}
+	if err := s.log.openSegment(last); err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	if s.memBytes >= s.opts.MemtableSize {
+		if err := s.freeze(); err != nil {
+			s.closeTables()
+			return nil, err
+		}
+	}
+	s.wg.Add(1)
+	go s.background()
+	return s, nil
+}
+
+func (s *LSM[K, V]) tablePath(num uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.sst", num))
+}
+
+// loadManifest opens the tables listed in the manifest and deletes table files it does not list, which are left over
+// from a flush or compaction that crashed before it was recorded.
+func (s *LSM[K, V]) loadManifest() error {
+	s.current = &version[K, V]{levels: make([][]*sstable[K, V], s.opts.MaxLevels), refs: 1}
+	live := map[string]bool{}
+	data, err := os.ReadFile(filepath.Join(s.dir, manifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var level int
+		var num uint64
+		if _, err := fmt.Sscanf(line, "next %d", &num); err == nil {
+			s.nextFile = num
+			continue
+		}
+		if _, err := fmt.Sscanf(line, "table %d %d", &level, &num); err != nil || level < 0 || level >= s.opts.MaxLevels {
+			s.closeTables()
+			return fmt.Errorf("%w: bad manifest line %q", ErrCorrupt, line)
+		}
+		t, err := openSSTable[K, V](s.tablePath(num), num, s.cmp)
+		if err != nil {
+			s.closeTables()
+			return err
+		}
+		t.ref()
+		s.current.levels[level] = append(s.current.levels[level], t)
+		live[filepath.Base(t.path)] = true
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		s.closeTables()
+		return err
+	}
+	for _, e := range entries {
+		if (strings.HasSuffix(e.Name(), ".sst") && !live[e.Name()]) || strings.HasSuffix(e.Name(), tmpSuffix) {
+			os.Remove(filepath.Join(s.dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// installVersion records v in the manifest and makes it current. s.mu must be held.
+func (s *LSM[K, V]) installVersion(v *version[K, V]) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "next %d\n", s.nextFile)
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&b, "table %d %d\n", level, t.num)
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, manifestName), func(f *os.File) error {
+		_, err := io.WriteString(f, b.String())
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, level := range v.levels {
+		for _, t := range level {
+			t.ref()
+		}
+	}
+	v.refs = 1
+	old := s.current
+	s.current = v
+	old.unref()
+	return nil
+}
+
+// Get returns the newest value of key. ok is false if the key was never written or its newest entry is a tombstone.
+func (s *LSM[K, V]) Get(key K) (value V, ok bool, err error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return value, false, ErrClosed
+	}
+	if e, found := s.mem.Get(key); found {
+		s.mu.RUnlock()
+		return e.value, !e.deleted, nil
+	}
+	for i := len(s.frozen) - 1; i >= 0; i-- {
+		if e, found := s.frozen[i].t.Get(key); found {
+			s.mu.RUnlock()
+			return e.value, !e.deleted, nil
+		}
+	}
+	v := s.current
+	v.ref()
+	s.mu.RUnlock()
+	defer v.unref()
+
+	kb, err := encodeValue(key)
+	if err != nil {
+		return value, false, err
+	}
+	for _, level := range v.levels {
+		for _, t := range level {
+			e, found, err := t.get(key, kb)
+			if err != nil {
+				return value, false, err
+			}
+			if found {
+				return e.value, !e.deleted, nil
+			}
+		}
+	}
+	return value, false, nil
+}
+
+// AscendRange calls fn in ascending order for every live key in [lo, hi) until fn returns false. It reads a consistent
+// view of the engine as of the start of the call; later writes are not visible to it.
+func (s *LSM[K, V]) AscendRange(lo, hi K, fn func(key K, value V) bool) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	sources := []lsmIterator[K, V]{newTreeIterator[K, V](s.mem.Snapshot().t.root)}
+	for i := len(s.frozen) - 1; i >= 0; i-- {
+		sources = append(sources, newTreeIterator[K, V](s.frozen[i].t.root))
+	}
+	v := s.current
+	v.ref()
+	s.mu.Unlock()
+	defer v.unref()
+
+	for _, level := range v.levels {
+		for _, t := range level {
+			sources = append(sources, t.iteratorFrom(lo))
+		}
+	}
+	m := newMergeIterator(s.cmp, sources)
+	for m.next() {
+		key, e := m.current()
+		if s.cmp(key, lo) < 0 || e.deleted {
+			continue
+		}
+		if s.cmp(key, hi) >= 0 || !fn(key, e.value) {
+			break
+		}
+	}
+	return m.error()
+}
+
+// Put writes value under key.
+func (s *LSM[K, V]) Put(key K, value V) error {
+	body, err := appendRecord([]byte{opPut}, key)
+	if err != nil {
+		return err
+	}
+	if body, err = appendRecord(body, value); err != nil {
+		return err
+	}
+	return s.write(body, key, lsmEntry[V]{value: value})
+}
+
+// Delete writes a tombstone for key. It does not check whether the key exists.
+func (s *LSM[K, V]) Delete(key K) error {
+	body, err := appendRecord([]byte{opDelete}, key)
+	if err != nil {
+		return err
+	}
+	return s.write(body, key, lsmEntry[V]{deleted: true})
+}
+
+func (s *LSM[K, V]) write(body []byte, key K, e lsmEntry[V]) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Stall writers while the flusher is behind rather than letting frozen memtables pile up in memory.
+	for !s.closed && s.bgErr == nil && len(s.frozen) >= s.opts.MaxFrozen {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return ErrClosed
+	}
+	if s.bgErr != nil {
+		return s.bgErr
+	}
+	payload := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(body)), s.seq+1)
+	if err := s.log.append(append(payload, body...)); err != nil {
+		return err
+	}
+	s.seq++
+	s.mem.Put(key, e)
+	s.memBytes += len(body)
+	if s.memBytes >= s.opts.MemtableSize {
+		return s.freeze()
+	}
+	return nil
+}
+
+// freeze moves the memtable to the frozen list and starts a new log segment for the next one. s.mu must be held.
+func (s *LSM[K, V]) freeze() error {
+	next := s.log.segID + 1
+	if err := s.log.openSegment(next); err != nil {
+		return err
+	}
+	s.frozen = append(s.frozen, &frozenMemtable[K, V]{t: s.mem, logEnd: next})
+	s.mem = New[K, lsmEntry[V]](s.cmp)
+	s.memBytes = 0
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// background flushes frozen memtables and runs compactions until the engine is closed.
+func (s *LSM[K, V]) background() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.kick:
+		}
+		err := s.flush()
+		for err == nil {
+			var did bool
+			if did, err = s.compact(); !did {
+				break
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.bgErr = fmt.Errorf("llrb: background flush or compaction failed: %w", err)
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// flush writes every frozen memtable to a level-0 table, oldest first.
+func (s *LSM[K, V]) flush() error {
+	for {
+		s.mu.Lock()
+		if len(s.frozen) == 0 || s.closed {
+			s.mu.Unlock()
+			return nil
+		}
+		fm := s.frozen[0]
+		num := s.nextFile
+		s.nextFile++
+		s.mu.Unlock()
+
+		// The frozen tree is never modified again, so it can be read without the lock.
+		it := newTreeIterator[K, V](fm.t.root)
+		t, err := s.writeTable(num, it, false)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		v := s.current.clone()
+		if t != nil {
+			v.levels[0] = append([]*sstable[K, V]{t}, v.levels[0]...)
+		}
+		err = s.installVersion(v)
+		if err == nil {
+			s.frozen = s.frozen[1:]
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := s.log.removeBefore(fm.logEnd); err != nil {
+			return err
+		}
+	}
+}
+
+// compact runs at most one compaction and reports whether it did.
+func (s *LSM[K, V]) compact() (bool, error) {
+	s.mu.Lock()
+	v := s.current
+	in := -1
+	if len(v.levels[0]) >= s.opts.L0Tables {
+		in = 0
+	} else {
+		limit := s.opts.LevelSize
+		for i := 1; i < len(v.levels)-1; i++ {
+			if v.levelSize(i) > limit {
+				in = i
+				break
+			}
+			limit *= 10
+		}
+	}
+	if in < 0 || s.closed {
+		s.mu.Unlock()
+		return false, nil
+	}
+	out := in + 1
+	num := s.nextFile
+	s.nextFile++
+	v.ref()
+	s.mu.Unlock()
+	defer v.unref()
+
+	// Newest first: level 0 is already ordered that way and a shallower level is always newer than a deeper one.
+	inputs := append(append([]*sstable[K, V](nil), v.levels[in]...), v.levels[out]...)
+	var sources []lsmIterator[K, V]
+	for _, t := range inputs {
+		sources = append(sources, t.iterator())
+	}
+	bottom := true
+	for i := out + 1; i < len(v.levels); i++ {
+		if len(v.levels[i]) > 0 {
+			bottom = false
+		}
+	}
+	t, err := s.writeTable(num, newMergeIterator(s.cmp, sources), bottom)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nv := s.current.clone()
+	nv.levels[in] = removeTables(nv.levels[in], inputs)
+	nv.levels[out] = nil
+	if t != nil {
+		nv.levels[out] = []*sstable[K, V]{t}
+	}
+	// Mark the inputs before the old version lets go of them, so the last reference to drop deletes the files.
+	for _, old := range inputs {
+		atomic.StoreInt32(&old.obsolete, 1)
+	}
+	if err := s.installVersion(nv); err != nil {
+		for _, old := range inputs {
+			atomic.StoreInt32(&old.obsolete, 0)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// writeTable writes the entries of it to table num and opens it. With dropTombstones, deleted keys are left out. It
+// returns a nil table if nothing was written.
+func (s *LSM[K, V]) writeTable(num uint64, it lsmIterator[K, V], dropTombstones bool) (*sstable[K, V], error) {
+	path := s.tablePath(num)
+	var count int
+	err := writeSSTable(path, func() (key K, e lsmEntry[V], ok bool, err error) {
+		for it.next() {
+			key, e = it.current()
+			if dropTombstones && e.deleted {
+				continue
+			}
+			count++
+			return key, e, true, nil
+		}
+		return key, e, false, it.error()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, os.Remove(path)
+	}
+	return openSSTable[K, V](path, num, s.cmp)
+}
+
+func (v *version[K, V]) clone() *version[K, V] {
+	nv := &version[K, V]{levels: make([][]*sstable[K, V], len(v.levels))}
+	for i, level := range v.levels {
+		nv.levels[i] = append([]*sstable[K, V](nil), level...)
+	}
+	return nv
+}
+
+func removeTables[K, V any](level, remove []*sstable[K, V]) []*sstable[K, V] {
+	var kept []*sstable[K, V]
+	for _, t := range level {
+		found := false
+		for _, r := range remove {
+			if t == r {
+				found = true
+			}
+		}
+		if !found {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Close stops background work, flushes the log and closes all tables. Frozen memtables that were not flushed yet are
+// recovered from the log on the next open.
+func (s *LSM[K, V]) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.log.closeSegment()
+	s.closeTables()
+	return err
+}
+
+func (s *LSM[K, V]) closeTables() {
+	for _, level := range s.current.levels {
+		for _, t := range level {
+			t.f.Close()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package databases
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// MVCC adds snapshot-isolated transactions on top of a Tree. Every committed write is stored as a new version under
+// (key, commit timestamp) instead of overwriting the old value, so a transaction can keep reading the database as of
+// the moment it began while others commit. Versions of one key sort newest first, which makes "the newest version no
+// later than ts" a single Ceiling lookup.
+//
+// Writes are buffered in the transaction and applied at Commit under one lock, so other transactions see all or none
+// of them. Two transactions that overlap in time and write the same key conflict; the one that commits second fails
+// with ErrConflict (first committer wins).
+type MVCC[K, V any] struct {
+	mu       sync.RWMutex
+	cmp      func(a, b K) int
+	versions *Tree[versionKey[K], mvccValue[V]]
+	clock    uint64         // timestamp of the last commit
+	active   map[uint64]int // start timestamp -> number of open transactions that started then
+}
+
+type versionKey[K any] struct {
+	key K
+	ts  uint64
+}
+
+type mvccValue[V any] struct {
+	value   V
+	deleted bool
+}
+
+var (
+	// ErrConflict is returned by Commit when another transaction committed a write to the same key after this
+	// transaction began.
+	ErrConflict = errors.New("mvcc: write-write conflict")
+	// ErrTxnDone is returned by operations on a transaction that has already committed or rolled back.
+	ErrTxnDone = errors.New("mvcc: transaction already finished")
+)
+
+// NewMVCC creates an empty transactional store ordered by cmp.
+func NewMVCC[K, V any](cmp func(a, b K) int) *MVCC[K, V] {
+	return &MVCC[K, V]{
+		cmp: cmp,
+		versions: New[versionKey[K], mvccValue[V]](func(a, b versionKey[K]) int {
+			if c := cmp(a.key, b.key); c != 0 {
+				return c
+			}
+			// Newer versions first.
+			return Compare(b.ts, a.ts)
+		}),
+		active: map[uint64]int{},
+	}
+}
+
+// Txn is a transaction. It reads the store as of the time Begin was called, plus its own writes. A Txn is not safe for
+// concurrent use.
+type Txn[K, V any] struct {
+	db      *MVCC[K, V]
+	startTS uint64
+	writes  *Tree[K, mvccValue[V]]
+	done    bool
+}
+
+// Begin starts a transaction.
+func (db *MVCC[K, V]) Begin() *Txn[K, V] {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.active[db.clock]++
+	return &Txn[K, V]{db: db, startTS: db.clock, writes: New[K, mvccValue[V]](db.cmp)}
+}
+
+// Get returns the value of key as seen by the transaction.
+func (tx *Txn[K, V]) Get(key K) (V, bool, error) {
+	var zero V
+	if tx.done {
+		return zero, false, ErrTxnDone
+	}
+	if w, ok := tx.writes.Get(key); ok {
+		return w.value, !w.deleted, nil
+	}
+	tx.db.mu.RLock()
+	defer tx.db.mu.RUnlock()
+	v, ok := tx.db.visible(key, tx.startTS)
+	if !ok || v.deleted {
+		return zero, false, nil
+	}
+	return v.value, true, nil
+}
+
+// visible returns the newest version of key committed at or before ts. db.mu must be held.
+func (db *MVCC[K, V]) visible(key K, ts uint64) (mvccValue[V], bool) {
+	vk, v, ok := db.versions.Ceiling(versionKey[K]{key: key, ts: ts})
+	if !ok || db.cmp(vk.key, key) != 0 {
+		return v, false
+	}
+	return v, true
+}
+
+// Put buffers a write of key until Commit.
+func (tx *Txn[K, V]) Put(key K, value V) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes.Put(key, mvccValue[V]{value: value})
+	return nil
+}
+
+// Delete buffers a delete of key until Commit.
+func (tx *Txn[K, V]) Delete(key K) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes.Put(key, mvccValue[V]{deleted: true})
+	return nil
+}
+
+// Commit atomically applies the transaction's writes and returns their commit timestamp. If another transaction
+// committed a write to one of the same keys after this one began, nothing is applied and ErrConflict is returned. The
+// transaction is finished either way.
+func (tx *Txn[K, V]) Commit() (uint64, error) {
+	if tx.done {
+		return 0, ErrTxnDone
+	}
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	tx.finish()
+
+	if tx.writes.Len() == 0 {
+		return tx.startTS, nil
+	}
+	conflict := false
+	tx.writes.Ascend(func(key K, _ mvccValue[V]) bool {
+		vk, _, ok := db.versions.Ceiling(versionKey[K]{key: key, ts: math.MaxUint64})
+		conflict = ok && db.cmp(vk.key, key) == 0 && vk.ts > tx.startTS
+		return !conflict
+	})
+	if conflict {
+		return 0, ErrConflict
+	}
+	db.clock++
+	ts := db.clock
+	tx.writes.Ascend(func(key K, v mvccValue[V]) bool {
+		db.versions.Put(versionKey[K]{key: key, ts: ts}, v)
+		return true
+	})
+	return ts, nil
+}
+
+// Rollback discards the transaction's writes. Rolling back a finished transaction is a no-op.
+func (tx *Txn[K, V]) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.finish()
+}
+
+// finish removes the transaction from the active set. db.mu must be held.
+func (tx *Txn[K, V]) finish() {
+	tx.done = true
+	if tx.db.active[tx.startTS]--; tx.db.active[tx.startTS] == 0 {
+		delete(tx.db.active, tx.startTS)
+	}
+}
+
+// GC removes versions that no current or future transaction can read and returns how many it removed. For each key it
+// keeps every version newer than the oldest active transaction's start timestamp plus the newest version at or before
+// it; if that version is a tombstone and nothing newer exists, the key is removed entirely.
+func (db *MVCC[K, V]) GC() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	watermark := db.clock
+	for ts := range db.active {
+		if ts < watermark {
+			watermark = ts
+		}
+	}
+
+	var garbage []versionKey[K]
+	var prev versionKey[K]
+	havePrev, keptBelow, newer := false, false, false
+	db.versions.Ascend(func(vk versionKey[K], v mvccValue[V]) bool {
+		if !havePrev || db.cmp(vk.key, prev.key) != 0 {
+			keptBelow, newer = false, false
+		}
+		prev, havePrev = vk, true
+		switch {
+		case vk.ts > watermark:
+			newer = true
+		case !keptBelow:
+			keptBelow = true
+			if v.deleted && !newer {
+				garbage = append(garbage, vk)
+			}
+		default:
+			garbage = append(garbage, vk)
+		}
+		return true
+	})
+	for _, vk := range garbage {
+		db.versions.Delete(vk)
+	}
+	return len(garbage)
+}
+
+// Len returns the number of stored versions across all keys.
+func (db *MVCC[K, V]) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.versions.Len()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package databases
+
+import "os"
+
+// LoadFile replaces the contents of the tree with a file written by WriteTo. Memory mapping is only used on Unix; on
+// other platforms the file is read into memory.
+func (t *Tree[K, V]) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return t.UnmarshalBinary(data)
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package databases
+
+import (
+	"os"
+	"syscall"
+)
+
+// LoadFile replaces the contents of the tree with a file written by WriteTo. The file is memory-mapped and decoded in
+// place rather than read into a buffer first.
+func (t *Tree[K, V]) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return t.UnmarshalBinary(nil)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	defer syscall.Munmap(data)
+	return t.UnmarshalBinary(data)
+}
@@ -0,0 +1,543 @@
+package databases
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// An SSTable is an immutable file of key/value records in ascending key order, written once when a memtable is
+// flushed or levels are compacted.
+//
+//   data    records: uvarint key length, key, kind byte (0 value, 1 tombstone), then uvarint value length and value
+//           for kind 0
+//   index   uvarint entry count, then per entry: uvarint key length, key, uvarint record offset
+//   bloom   uvarint hash count, filter bits
+//   footer  uint64 index offset, uint64 bloom offset, uint64 record count, uint32 CRC-32C of index and bloom,
+//           magic "SST1"
+//
+// The index is sparse: it holds every sstIndexInterval-th key, so a lookup binary-searches the index in memory and
+// then reads and scans a single block of at most sstIndexInterval records. The bloom filter lets lookups skip tables
+// that certainly do not contain the key without any I/O.
+
+const (
+	sstIndexInterval = 16
+	sstBloomBits     = 10 // bits per key, for about a 1% false positive rate
+	sstFooterLen     = 32
+
+	kindValue     byte = 0
+	kindTombstone byte = 1
+)
+
+var sstMagic = [4]byte{'S', 'S', 'T', '1'}
+
+// lsmEntry is what the engine stores per key: a value or a tombstone recording that the key was deleted.
+type lsmEntry[V any] struct {
+	value   V
+	deleted bool
+}
+
+type sstIndexEntry[K any] struct {
+	key K
+	off int64
+}
+
+type sstable[K, V any] struct {
+	num   uint64
+	path  string
+	f     *os.File
+	cmp   func(a, b K) int
+	size  int64
+	count uint64
+
+	dataEnd int64 // where the index starts
+	index   []sstIndexEntry[K]
+	bloom   bloomFilter
+
+	refs     int32 // one per version that lists the table
+	obsolete int32 // set once a compaction has replaced the table
+}
+
+// writeSSTable writes the records produced by next to path. next returns ok=false when it is exhausted.
+func writeSSTable[K, V any](path string, next func() (key K, e lsmEntry[V], ok bool, err error)) error {
+	type pending struct {
+		key []byte
+		off int64
+	}
+	var (
+		index  []pending
+		hashes []uint64
+		off    int64
+		count  uint64
+	)
+	return writeFileAtomic(path, func(f *os.File) error {
+		w := bufio.NewWriterSize(f, 64<<10)
+		var rec []byte
+		for {
+			key, e, ok, err := next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			kb, err := encodeValue(key)
+			if err != nil {
+				return err
+			}
+			if count%sstIndexInterval == 0 {
+				index = append(index, pending{key: append([]byte(nil), kb...), off: off})
+			}
+			hashes = append(hashes, bloomHash(kb))
+			rec = binary.AppendUvarint(rec[:0], uint64(len(kb)))
+			rec = append(rec, kb...)
+			if e.deleted {
+				rec = append(rec, kindTombstone)
+			} else {
+				rec = append(rec, kindValue)
+				if rec, err = appendRecord(rec, e.value); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(rec); err != nil {
+				return err
+			}
+			off += int64(len(rec))
+			count++
+		}
+
+		var meta []byte
+		meta = binary.AppendUvarint(meta, uint64(len(index)))
+		for _, ie := range index {
+			meta = binary.AppendUvarint(meta, uint64(len(ie.key)))
+			meta = append(meta, ie.key...)
+			meta = binary.AppendUvarint(meta, uint64(ie.off))
+		}
+		bloomOff := off + int64(len(meta))
+		meta = newBloomFilter(hashes).appendTo(meta)
+
+		var footer [sstFooterLen]byte
+		binary.BigEndian.PutUint64(footer[0:], uint64(off))
+		binary.BigEndian.PutUint64(footer[8:], uint64(bloomOff))
+		binary.BigEndian.PutUint64(footer[16:], count)
+		binary.BigEndian.PutUint32(footer[24:], crc32.Checksum(meta, crcTable))
+		copy(footer[28:], sstMagic[:])
+		if _, err := w.Write(meta); err != nil {
+			return err
+		}
+		if _, err := w.Write(footer[:]); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+// openSSTable opens a table and loads its index and bloom filter into memory.
+func openSSTable[K, V any](path string, num uint64, cmp func(a, b K) int) (*sstable[K, V], error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable[K, V](f, cmp)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("sstable %s: %w", path, err)
+	}
+	t.num, t.path = num, path
+	return t, nil
+}
+
+func loadSSTable[K, V any](f *os.File, cmp func(a, b K) int) (*sstable[K, V], error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < sstFooterLen {
+		return nil, fmt.Errorf("%w: file too short", ErrCorrupt)
+	}
+	var footer [sstFooterLen]byte
+	if _, err := f.ReadAt(footer[:], size-sstFooterLen); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[28:], sstMagic[:]) {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	indexOff := int64(binary.BigEndian.Uint64(footer[0:]))
+	bloomOff := int64(binary.BigEndian.Uint64(footer[8:]))
+	if indexOff < 0 || bloomOff < indexOff || bloomOff > size-sstFooterLen {
+		return nil, fmt.Errorf("%w: bad footer offsets", ErrCorrupt)
+	}
+	meta := make([]byte, size-sstFooterLen-indexOff)
+	if _, err := f.ReadAt(meta, indexOff); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(meta, crcTable) != binary.BigEndian.Uint32(footer[24:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	t := &sstable[K, V]{
+		f:       f,
+		cmp:     cmp,
+		size:    size,
+		count:   binary.BigEndian.Uint64(footer[16:]),
+		dataEnd: indexOff,
+	}
+	rest := meta[:bloomOff-indexOff]
+	n, l := binary.Uvarint(rest)
+	if l <= 0 || n > uint64(len(rest)) {
+		return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+	}
+	rest = rest[l:]
+	t.index = make([]sstIndexEntry[K], 0, n)
+	for i := uint64(0); i < n; i++ {
+		var ie sstIndexEntry[K]
+		var kb []byte
+		var ok bool
+		if kb, rest, ok = splitRecord(rest); !ok {
+			return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+		}
+		if err := decodeValue(kb, &ie.key); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		off, l := binary.Uvarint(rest)
+		if l <= 0 || int64(off) > indexOff {
+			return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+		}
+		ie.off, rest = int64(off), rest[l:]
+		t.index = append(t.index, ie)
+	}
+	if t.bloom, err = decodeBloomFilter(meta[bloomOff-indexOff:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// get looks key up in the table. found is false if the table holds neither a value nor a tombstone for key.
+func (t *sstable[K, V]) get(key K, keyBytes []byte) (e lsmEntry[V], found bool, err error) {
+	if !t.bloom.mayContain(bloomHash(keyBytes)) {
+		return e, false, nil
+	}
+	// Find the last index entry whose key is <= key; the record, if any, is in the block that entry starts.
+	i := sort.Search(len(t.index), func(i int) bool { return t.cmp(t.index[i].key, key) > 0 }) - 1
+	if i < 0 {
+		return e, false, nil
+	}
+	end := t.dataEnd
+	if i+1 < len(t.index) {
+		end = t.index[i+1].off
+	}
+	block := make([]byte, end-t.index[i].off)
+	if _, err := t.f.ReadAt(block, t.index[i].off); err != nil {
+		return e, false, err
+	}
+	for len(block) > 0 {
+		var k K
+		if k, e, block, err = decodeSSTRecord[K, V](block); err != nil {
+			return e, false, err
+		}
+		if c := t.cmp(k, key); c == 0 {
+			return e, true, nil
+		} else if c > 0 {
+			break
+		}
+	}
+	return lsmEntry[V]{}, false, nil
+}
+
+func decodeSSTRecord[K, V any](src []byte) (key K, e lsmEntry[V], rest []byte, err error) {
+	kb, rest, ok := splitRecord(src)
+	if !ok || len(rest) == 0 {
+		return key, e, nil, fmt.Errorf("%w: truncated sstable record", ErrCorrupt)
+	}
+	if err := decodeValue(kb, &key); err != nil {
+		return key, e, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	kind := rest[0]
+	rest = rest[1:]
+	if kind == kindTombstone {
+		e.deleted = true
+		return key, e, rest, nil
+	}
+	rest, err = decodeRecord(rest, &e.value)
+	return key, e, rest, err
+}
+
+func (t *sstable[K, V]) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// unref drops a reference and, once nothing refers to a table that compaction has replaced, closes and deletes it.
+func (t *sstable[K, V]) unref() {
+	if atomic.AddInt32(&t.refs, -1) == 0 && atomic.LoadInt32(&t.obsolete) == 1 {
+		t.f.Close()
+		os.Remove(t.path)
+	}
+}
+
+// sstIterator reads a table's records sequentially.
+type sstIterator[K, V any] struct {
+	r   *bufio.Reader
+	key K
+	e   lsmEntry[V]
+	err error
+}
+
+func (t *sstable[K, V]) iterator() *sstIterator[K, V] {
+	return &sstIterator[K, V]{r: bufio.NewReaderSize(io.NewSectionReader(t.f, 0, t.dataEnd), 64<<10)}
+}
+
+// iteratorFrom returns an iterator positioned at the start of the index block that may contain lo, so a range scan
+// does not read the part of the table before it.
+func (t *sstable[K, V]) iteratorFrom(lo K) *sstIterator[K, V] {
+	var off int64
+	for _, ie := range t.index {
+		if t.cmp(ie.key, lo) > 0 {
+			break
+		}
+		off = ie.off
+	}
+	return &sstIterator[K, V]{r: bufio.NewReaderSize(io.NewSectionReader(t.f, off, t.dataEnd-off), 64<<10)}
+}
+
+func (it *sstIterator[K, V]) next() bool {
+	if it.err != nil {
+		return false
+	}
+	kb, err := readRecord(it.r)
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	var key K
+	var e lsmEntry[V]
+	if err := decodeValue(kb, &key); err != nil {
+		it.err = fmt.Errorf("%w: %v", ErrCorrupt, err)
+		return false
+	}
+	kind, err := it.r.ReadByte()
+	if err != nil {
+		it.err = fmt.Errorf("%w: truncated sstable record", ErrCorrupt)
+		return false
+	}
+	if kind == kindTombstone {
+		e.deleted = true
+	} else {
+		vb, err := readRecord(it.r)
+		if err != nil {
+			it.err = fmt.Errorf("%w: truncated sstable record", ErrCorrupt)
+			return false
+		}
+		if err := decodeValue(vb, &e.value); err != nil {
+			it.err = fmt.Errorf("%w: %v", ErrCorrupt, err)
+			return false
+		}
+	}
+	it.key, it.e = key, e
+	return true
+}
+
+func (it *sstIterator[K, V]) current() (K, lsmEntry[V]) { return it.key, it.e }
+func (it *sstIterator[K, V]) error() error              { return it.err }
+
+// readRecord reads one length-prefixed record. It returns io.EOF only at a clean record boundary.
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: truncated sstable record", ErrCorrupt)
+	}
+	return b, nil
+}
+
+// lsmIterator is a sorted stream of entries from one memtable or table.
+type lsmIterator[K, V any] interface {
+	next() bool
+	current() (K, lsmEntry[V])
+	error() error
+}
+
+// mergeIterator merges sorted sources into one sorted stream. Sources are given newest first; when several hold the
+// same key only the newest entry is produced.
+type mergeIterator[K, V any] struct {
+	cmp  func(a, b K) int
+	h    mergeHeap[K, V]
+	key  K
+	e    lsmEntry[V]
+	err  error
+	init bool
+}
+
+type mergeSource[K, V any] struct {
+	it  lsmIterator[K, V]
+	age int // position in the source list, lower is newer
+}
+
+type mergeHeap[K, V any] struct {
+	cmp     func(a, b K) int
+	sources []mergeSource[K, V]
+}
+
+func (h *mergeHeap[K, V]) Len() int { return len(h.sources) }
+func (h *mergeHeap[K, V]) Less(i, j int) bool {
+	ki, _ := h.sources[i].it.current()
+	kj, _ := h.sources[j].it.current()
+	if c := h.cmp(ki, kj); c != 0 {
+		return c < 0
+	}
+	return h.sources[i].age < h.sources[j].age
+}
+func (h *mergeHeap[K, V]) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap[K, V]) Push(x any)    { h.sources = append(h.sources, x.(mergeSource[K, V])) }
+func (h *mergeHeap[K, V]) Pop() any {
+	x := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return x
+}
+
+func newMergeIterator[K, V any](cmp func(a, b K) int, sources []lsmIterator[K, V]) *mergeIterator[K, V] {
+	m := &mergeIterator[K, V]{cmp: cmp, h: mergeHeap[K, V]{cmp: cmp}}
+	for age, it := range sources {
+		if it.next() {
+			m.h.sources = append(m.h.sources, mergeSource[K, V]{it: it, age: age})
+		} else if err := it.error(); err != nil && m.err == nil {
+			m.err = err
+		}
+	}
+	heap.Init(&m.h)
+	return m
+}
+
+func (m *mergeIterator[K, V]) next() bool {
+	if m.err != nil || m.h.Len() == 0 {
+		return false
+	}
+	m.key, m.e = m.h.sources[0].it.current()
+	// Advance the source we just consumed and every older source positioned on the same key.
+	for m.h.Len() > 0 {
+		top := m.h.sources[0]
+		if k, _ := top.it.current(); m.cmp(k, m.key) != 0 {
+			break
+		}
+		if top.it.next() {
+			heap.Fix(&m.h, 0)
+		} else {
+			if err := top.it.error(); err != nil {
+				m.err = err
+			}
+			heap.Pop(&m.h)
+		}
+	}
+	return true
+}
+
+func (m *mergeIterator[K, V]) current() (K, lsmEntry[V]) { return m.key, m.e }
+func (m *mergeIterator[K, V]) error() error              { return m.err }
+
+// treeIterator walks a tree that is no longer being modified, such as a snapshot or a frozen memtable, in order.
+type treeIterator[K, V any] struct {
+	stack []*node[K, lsmEntry[V]]
+	cur   *node[K, lsmEntry[V]]
+}
+
+func newTreeIterator[K, V any](root *node[K, lsmEntry[V]]) *treeIterator[K, V] {
+	it := &treeIterator[K, V]{}
+	it.pushLeft(root)
+	return it
+}
+
+func (it *treeIterator[K, V]) pushLeft(h *node[K, lsmEntry[V]]) {
+	for ; h != nil; h = h.left {
+		it.stack = append(it.stack, h)
+	}
+}
+
+func (it *treeIterator[K, V]) next() bool {
+	if len(it.stack) == 0 {
+		return false
+	}
+	it.cur = it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	it.pushLeft(it.cur.right)
+	return true
+}
+
+func (it *treeIterator[K, V]) current() (K, lsmEntry[V]) { return it.cur.key, it.cur.value }
+func (it *treeIterator[K, V]) error() error              { return nil }
+
+// bloomFilter is a standard bloom filter probed with double hashing of one 64-bit FNV-1a hash.
+type bloomFilter struct {
+	k    uint32
+	bits []byte
+}
+
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+func newBloomFilter(hashes []uint64) bloomFilter {
+	nbits := len(hashes) * sstBloomBits
+	if nbits < 64 {
+		nbits = 64
+	}
+	// k = bits per key * ln 2 minimises the false positive rate.
+	b := bloomFilter{k: sstBloomBits * 69 / 100, bits: make([]byte, (nbits+7)/8)}
+	for _, h := range hashes {
+		b.add(h)
+	}
+	return b
+}
+
+func (b bloomFilter) probes(h uint64, fn func(bit uint64) bool) bool {
+	n := uint64(len(b.bits)) * 8
+	h1, h2 := h, h>>32|h<<32
+	for i := uint32(0); i < b.k; i++ {
+		if !fn((h1 + uint64(i)*h2) % n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bloomFilter) add(h uint64) {
+	b.probes(h, func(bit uint64) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (b bloomFilter) mayContain(h uint64) bool {
+	if len(b.bits) == 0 {
+		return true
+	}
+	return b.probes(h, func(bit uint64) bool { return b.bits[bit/8]&(1<<(bit%8)) != 0 })
+}
+
+func (b bloomFilter) appendTo(dst []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(b.k))
+	return append(dst, b.bits...)
+}
+
+func decodeBloomFilter(src []byte) (bloomFilter, error) {
+	k, n := binary.Uvarint(src)
+	if n <= 0 || k == 0 || k > 64 {
+		return bloomFilter{}, fmt.Errorf("%w: bad bloom filter", ErrCorrupt)
+	}
+	return bloomFilter{k: uint32(k), bits: src[n:]}, nil
+}
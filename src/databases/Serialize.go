@@ -0,0 +1,415 @@
+package databases
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// On-disk format, version 1. All fixed-size integers are big-endian.
+//
+//   magic    [4]byte  "LLRB"
+//   version  uint16
+//   flags    uint16   reserved, must be zero
+//   count    uint64   number of records
+//   records  count × (uvarint key length, key bytes, uvarint value length, value bytes), in ascending key order
+//   checksum uint32   CRC-32C of every preceding byte
+//
+// Keys and values are encoded by type: integers as varints, floats by their IEEE 754 bits, strings and []byte as raw
+// bytes, bools as one byte, types whose pointer implements both encoding.BinaryMarshaler and BinaryUnmarshaler with
+// MarshalBinary and everything else with gob.
+
+const (
+	formatVersion = 1
+	headerSize    = 16
+	checksumSize  = 4
+)
+
+var (
+	formatMagic = [4]byte{'L', 'L', 'R', 'B'}
+	crcTable    = crc32.MakeTable(crc32.Castagnoli)
+
+	// ErrCorrupt is returned when serialized tree data fails its checksum or cannot be parsed.
+	ErrCorrupt = errors.New("llrb: corrupt data")
+)
+
+// WriteTo writes the tree to w in the versioned binary format described above. It implements io.WriterTo.
+func (t *Tree[K, V]) WriteTo(w io.Writer) (int64, error) {
+	var buf []byte
+	buf = append(buf, formatMagic[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, formatVersion)
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(t.Len()))
+
+	cw := &checksumWriter{w: w}
+	var err error
+	t.Ascend(func(key K, value V) bool {
+		if buf, err = appendRecord(buf, key); err != nil {
+			return false
+		}
+		if buf, err = appendRecord(buf, value); err != nil {
+			return false
+		}
+		// Flush in chunks so a large tree is never held in memory twice.
+		if len(buf) >= 64<<10 {
+			if _, err = cw.Write(buf); err != nil {
+				return false
+			}
+			buf = buf[:0]
+		}
+		return true
+	})
+	if err != nil {
+		return cw.n, err
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Update(cw.crc, crcTable, buf))
+	_, err = cw.w.Write(buf)
+	return cw.n + int64(len(buf)), err
+}
+
+// ReadFrom replaces the contents of the tree with data read from r until EOF, which must be in the format written by
+// WriteTo. The records must be in ascending order under the tree's comparator. It implements io.ReaderFrom.
+func (t *Tree[K, V]) ReadFrom(r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	return int64(len(data)), t.UnmarshalBinary(data)
+}
+
+// MarshalBinary returns the tree in the format written by WriteTo.
+func (t *Tree[K, V]) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	_, err := t.WriteTo(&b)
+	return b.Bytes(), err
+}
+
+// UnmarshalBinary replaces the contents of the tree with data in the format written by WriteTo. It does not retain
+// data, so data may be a memory-mapped file that is unmapped afterwards.
+func (t *Tree[K, V]) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize+checksumSize {
+		return fmt.Errorf("%w: %d bytes is too short", ErrCorrupt, len(data))
+	}
+	if !bytes.Equal(data[:4], formatMagic[:]) {
+		return fmt.Errorf("%w: bad magic %q", ErrCorrupt, data[:4])
+	}
+	if v := binary.BigEndian.Uint16(data[4:]); v != formatVersion {
+		return fmt.Errorf("llrb: unsupported format version %d", v)
+	}
+	if f := binary.BigEndian.Uint16(data[6:]); f != 0 {
+		return fmt.Errorf("llrb: unsupported flags %#04x", f)
+	}
+	body, sum := data[:len(data)-checksumSize], binary.BigEndian.Uint32(data[len(data)-checksumSize:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	count := binary.BigEndian.Uint64(data[8:])
+	// Every record takes at least two bytes, which bounds count before we allocate for it.
+	if count > uint64(len(body)-headerSize)/2 {
+		return fmt.Errorf("%w: record count %d does not fit in %d bytes", ErrCorrupt, count, len(data))
+	}
+
+	keys := make([]K, 0, count)
+	values := make([]V, 0, count)
+	rest := body[headerSize:]
+	for i := uint64(0); i < count; i++ {
+		var key K
+		var value V
+		var err error
+		if rest, err = decodeRecord(rest, &key); err != nil {
+			return err
+		}
+		if rest, err = decodeRecord(rest, &value); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes after %d records", ErrCorrupt, len(rest), count)
+	}
+	root, err := t.buildSorted(keys, values)
+	if err != nil {
+		return err
+	}
+	t.root = root
+	return nil
+}
+
+// NewFromSorted builds a tree from keys in strictly ascending order and their values in O(n), without the rebalancing
+// work of n calls to Put.
+func NewFromSorted[K, V any](cmp func(a, b K) int, keys []K, values []V) (*Tree[K, V], error) {
+	t := New[K, V](cmp)
+	root, err := t.buildSorted(keys, values)
+	if err != nil {
+		return nil, err
+	}
+	t.root = root
+	return t, nil
+}
+
+func (t *Tree[K, V]) buildSorted(keys []K, values []V) (*node[K, V], error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("llrb: %d keys but %d values", len(keys), len(values))
+	}
+	for i := 1; i < len(keys); i++ {
+		if t.cmp(keys[i-1], keys[i]) >= 0 {
+			return nil, fmt.Errorf("llrb: keys are not strictly ascending at index %d", i)
+		}
+	}
+	// Pick the largest black height whose smallest tree (all 2-nodes) still fits.
+	height := 0
+	for maxTwoNodeKeys(height+1) <= len(keys) {
+		height++
+	}
+	return t.build(keys, values, height), nil
+}
+
+// build returns an LLRB holding keys with the given black height. It reads the tree as a 2-3 tree: a subtree of black
+// height b holds between 2^b-1 keys (all 2-nodes) and 3^b-1 keys (all 3-nodes), so it splits the keys evenly across a
+// 2-node while they fit in two children of height b-1 and across a 3-node, encoded as a black node with a red left
+// child, otherwise.
+func (t *Tree[K, V]) build(keys []K, values []V, height int) *node[K, V] {
+	n := len(keys)
+	if n == 0 {
+		return nil
+	}
+	mk := func(i int, color bool, left, right *node[K, V]) *node[K, V] {
+		h := &node[K, V]{key: keys[i], value: values[i], color: color, left: left, right: right, gen: t.gen}
+		t.update(h)
+		return h
+	}
+	if n <= 2*maxThreeNodeKeys(height-1)+1 {
+		l := (n - 1) / 2
+		left := t.build(keys[:l], values[:l], height-1)
+		right := t.build(keys[l+1:], values[l+1:], height-1)
+		return mk(l, black, left, right)
+	}
+	a := (n - 2) / 3
+	b := (n - 2 - a) / 2
+	i, j := a, a+1+b
+	lower := mk(i, red, t.build(keys[:i], values[:i], height-1), t.build(keys[i+1:j], values[i+1:j], height-1))
+	return mk(j, black, lower, t.build(keys[j+1:], values[j+1:], height-1))
+}
+
+// maxTwoNodeKeys returns 2^b-1, saturating at math.MaxInt.
+func maxTwoNodeKeys(b int) int {
+	if b >= 63 {
+		return math.MaxInt
+	}
+	return 1<<b - 1
+}
+
+// maxThreeNodeKeys returns 3^b-1, saturating at math.MaxInt.
+func maxThreeNodeKeys(b int) int {
+	p := 1
+	for i := 0; i < b; i++ {
+		if p > math.MaxInt/3 {
+			return math.MaxInt
+		}
+		p *= 3
+	}
+	return p - 1
+}
+
+type checksumWriter struct {
+	w   io.Writer
+	crc uint32
+	n   int64
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc = crc32.Update(c.crc, crcTable, p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// appendRecord appends the length-prefixed encoding of v to dst.
+func appendRecord[T any](dst []byte, v T) ([]byte, error) {
+	enc, err := encodeValue(v)
+	if err != nil {
+		return dst, err
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(enc)))
+	return append(dst, enc...), nil
+}
+
+// decodeRecord decodes one length-prefixed record from src into v and returns the remaining bytes.
+func decodeRecord[T any](src []byte, v *T) ([]byte, error) {
+	l, n := binary.Uvarint(src)
+	if n <= 0 || l > uint64(len(src)-n) {
+		return nil, fmt.Errorf("%w: truncated record", ErrCorrupt)
+	}
+	if err := decodeValue(src[n:n+int(l)], v); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return src[n+int(l):], nil
+}
+
+func encodeValue[T any](v T) ([]byte, error) {
+	var b []byte
+	switch x := any(v).(type) {
+	case int:
+		return binary.AppendVarint(b, int64(x)), nil
+	case int8:
+		return binary.AppendVarint(b, int64(x)), nil
+	case int16:
+		return binary.AppendVarint(b, int64(x)), nil
+	case int32:
+		return binary.AppendVarint(b, int64(x)), nil
+	case int64:
+		return binary.AppendVarint(b, x), nil
+	case uint:
+		return binary.AppendUvarint(b, uint64(x)), nil
+	case uint8:
+		return binary.AppendUvarint(b, uint64(x)), nil
+	case uint16:
+		return binary.AppendUvarint(b, uint64(x)), nil
+	case uint32:
+		return binary.AppendUvarint(b, uint64(x)), nil
+	case uint64:
+		return binary.AppendUvarint(b, x), nil
+	case float32:
+		return binary.BigEndian.AppendUint32(b, math.Float32bits(x)), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(x)), nil
+	case bool:
+		if x {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case string:
+		return []byte(x), nil
+	case []byte:
+		return x, nil
+	}
+	if m, ok := binaryCodec(&v); ok {
+		return m.MarshalBinary()
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+// hasStableEncoding reports whether encodeValue encodes values of type T without falling back to gob. Gob numbers types
+// in the order a process first encodes them, so the same value can encode to different bytes in different processes;
+// that is harmless for data that is decoded again but not for bytes that are hashed and compared across runs.
+func hasStableEncoding[T any]() bool {
+	var zero T
+	switch any(zero).(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool, string, []byte:
+		return true
+	}
+	_, ok := binaryCodec(&zero)
+	return ok
+}
+
+func decodeValue[T any](src []byte, v *T) error {
+	switch p := any(v).(type) {
+	case *int:
+		x, err := varint(src)
+		*p = int(x)
+		return err
+	case *int8:
+		x, err := varint(src)
+		*p = int8(x)
+		return err
+	case *int16:
+		x, err := varint(src)
+		*p = int16(x)
+		return err
+	case *int32:
+		x, err := varint(src)
+		*p = int32(x)
+		return err
+	case *int64:
+		x, err := varint(src)
+		*p = x
+		return err
+	case *uint:
+		x, err := uvarint(src)
+		*p = uint(x)
+		return err
+	case *uint8:
+		x, err := uvarint(src)
+		*p = uint8(x)
+		return err
+	case *uint16:
+		x, err := uvarint(src)
+		*p = uint16(x)
+		return err
+	case *uint32:
+		x, err := uvarint(src)
+		*p = uint32(x)
+		return err
+	case *uint64:
+		x, err := uvarint(src)
+		*p = x
+		return err
+	case *float32:
+		if len(src) != 4 {
+			return errors.New("bad float32")
+		}
+		*p = math.Float32frombits(binary.BigEndian.Uint32(src))
+		return nil
+	case *float64:
+		if len(src) != 8 {
+			return errors.New("bad float64")
+		}
+		*p = math.Float64frombits(binary.BigEndian.Uint64(src))
+		return nil
+	case *bool:
+		if len(src) != 1 {
+			return errors.New("bad bool")
+		}
+		*p = src[0] != 0
+		return nil
+	case *string:
+		*p = string(src)
+		return nil
+	case *[]byte:
+		*p = append([]byte(nil), src...)
+		return nil
+	}
+	if u, ok := binaryCodec(v); ok {
+		return u.UnmarshalBinary(append([]byte(nil), src...))
+	}
+	return gob.NewDecoder(bytes.NewReader(src)).Decode(v)
+}
+
+// binaryCodec reports whether *T can both marshal and unmarshal itself. encodeValue and decodeValue ask the same
+// question of the same pointer type, so a value is never written one way and read back the other, whatever the
+// receivers of its methods.
+func binaryCodec[T any](p *T) (interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}, bool) {
+	c, ok := any(p).(interface {
+		encoding.BinaryMarshaler
+		encoding.BinaryUnmarshaler
+	})
+	return c, ok
+}
+
+func varint(src []byte) (int64, error) {
+	x, n := binary.Varint(src)
+	if n != len(src) {
+		return 0, errors.New("bad varint")
+	}
+	return x, nil
+}
+
+func uvarint(src []byte) (uint64, error) {
+	x, n := binary.Uvarint(src)
+	if n != len(src) {
+		return 0, errors.New("bad uvarint")
+	}
+	return x, nil
+}
@@ -0,0 +1,109 @@
+package databases
+
+import "sync/atomic"
+
+// Snapshots are implemented by path copying. Every node records the generation of the tree that created it, and a tree
+// only modifies nodes of its own generation in place. Taking a snapshot moves the tree to a fresh generation, so all
+// nodes reachable from the snapshot become shared: the next Put or Delete copies the nodes on the path from the root to
+// the changed key and leaves the originals untouched. A snapshot therefore costs O(1) to take, each later write costs
+// O(log n) extra allocations, and everything the writes did not touch is shared between the versions.
+//
+//   tree ──► A'            snapshot ──► A
+//           /  \                      /  \
+//          B    C'   (shared B)      B    C
+//                \                         \
+//                 D' (new key)              (nil)
+
+var generations uint64
+
+func nextGen() uint64 {
+	return atomic.AddUint64(&generations, 1)
+}
+
+// Snapshot is an immutable version of a Tree. Its read methods may be called from any number of goroutines without
+// locking, even while the tree it was taken from keeps being modified. Insert and Delete never change the snapshot;
+// they return a new snapshot that shares all unchanged nodes with the old one.
+type Snapshot[K, V any] struct {
+	t Tree[K, V]
+}
+
+// Snapshot returns an immutable view of the current contents of the tree in O(1).
+func (t *Tree[K, V]) Snapshot() *Snapshot[K, V] {
+	s := &Snapshot[K, V]{t: t.frozen()}
+	t.gen = nextGen()
+	return s
+}
+
+// frozen returns a copy of t's header for use by a snapshot, which never writes through it.
+func (t *Tree[K, V]) frozen() Tree[K, V] {
+	return Tree[K, V]{root: t.root, cmp: t.cmp, augment: t.augment}
+}
+
+// Clone returns an independent copy of the tree in O(1). The two trees share nodes until either one is modified.
+func (t *Tree[K, V]) Clone() *Tree[K, V] {
+	return t.Snapshot().Tree()
+}
+
+// Tree returns a mutable tree initialised with the contents of the snapshot. Writes to it do not affect s.
+func (s *Snapshot[K, V]) Tree() *Tree[K, V] {
+	t := s.t.frozen()
+	t.gen = nextGen()
+	return &t
+}
+
+// Insert returns a new snapshot in which key maps to value.
+func (s *Snapshot[K, V]) Insert(key K, value V) *Snapshot[K, V] {
+	t := s.Tree()
+	t.Put(key, value)
+	return &Snapshot[K, V]{t: t.frozen()}
+}
+
+// Delete returns a new snapshot without key. If key is not present, s itself is returned.
+func (s *Snapshot[K, V]) Delete(key K) *Snapshot[K, V] {
+	t := s.Tree()
+	if !t.Delete(key) {
+		return s
+	}
+	return &Snapshot[K, V]{t: t.frozen()}
+}
+
+// Len returns the number of keys in the snapshot.
+func (s *Snapshot[K, V]) Len() int { return s.t.Len() }
+
+// Get returns the value stored under key and whether the key was present.
+func (s *Snapshot[K, V]) Get(key K) (V, bool) { return s.t.Get(key) }
+
+// Has reports whether key is present in the snapshot.
+func (s *Snapshot[K, V]) Has(key K) bool { return s.t.Has(key) }
+
+// Min returns the smallest key in the snapshot and its value.
+func (s *Snapshot[K, V]) Min() (K, V, bool) { return s.t.Min() }
+
+// Max returns the largest key in the snapshot and its value.
+func (s *Snapshot[K, V]) Max() (K, V, bool) { return s.t.Max() }
+
+// Floor returns the largest key less than or equal to key.
+func (s *Snapshot[K, V]) Floor(key K) (K, V, bool) { return s.t.Floor(key) }
+
+// Ceiling returns the smallest key greater than or equal to key.
+func (s *Snapshot[K, V]) Ceiling(key K) (K, V, bool) { return s.t.Ceiling(key) }
+
+// Rank returns the number of keys strictly less than key.
+func (s *Snapshot[K, V]) Rank(key K) int { return s.t.Rank(key) }
+
+// Select returns the i-th smallest key counting from zero.
+func (s *Snapshot[K, V]) Select(i int) (K, V, bool) { return s.t.Select(i) }
+
+// Ascend calls fn for every key in ascending order until fn returns false.
+func (s *Snapshot[K, V]) Ascend(fn func(key K, value V) bool) { s.t.Ascend(fn) }
+
+// Descend calls fn for every key in descending order until fn returns false.
+func (s *Snapshot[K, V]) Descend(fn func(key K, value V) bool) { s.t.Descend(fn) }
+
+// AscendRange calls fn in ascending order for every key in [lo, hi) until fn returns false.
+func (s *Snapshot[K, V]) AscendRange(lo, hi K, fn func(key K, value V) bool) {
+	s.t.AscendRange(lo, hi, fn)
+}
+
+// Validate checks the red-black invariants of the snapshot. See Tree.Validate.
+func (s *Snapshot[K, V]) Validate() error { return s.t.Validate() }
@@ -0,0 +1,393 @@
+package databases
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a durable key-value store built from a Tree and a write-ahead log. Every Put and Delete is appended to the
+// log before it is applied to the tree. Checkpoints write the whole tree to a file in the WriteTo format and drop the
+// log segments it covers, so recovery loads the newest checkpoint and replays only the log written after it.
+//
+// A store directory contains:
+//
+//	0000000000000003.wal              log segments, oldest first
+//	checkpoint-00000000000004d2.llrb  tree contents as of sequence number 0x4d2
+type Store[K, V any] struct {
+	dir  string
+	opts Options
+
+	mu              sync.RWMutex
+	t               *Tree[K, V]
+	log             *wal
+	seq             uint64 // sequence number of the last applied write
+	sinceCheckpoint int
+	closed          bool
+
+	checkpointMu sync.Mutex
+	kick         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	wg           sync.WaitGroup
+	bgErr        error // first error from a background sync or checkpoint, guarded by mu
+}
+
+// Options configures a Store. The zero value is usable.
+type Options struct {
+	// SegmentSize is the size in bytes after which the log moves on to a new segment. Defaults to 64 MiB.
+	SegmentSize int64
+	// Sync decides when the log is fsynced. Defaults to SyncAlways.
+	Sync SyncPolicy
+	// SyncInterval is the fsync period for SyncInterval. Defaults to 100ms.
+	SyncInterval time.Duration
+	// CheckpointEvery is the number of writes after which a checkpoint is taken in the background. Zero disables
+	// automatic checkpoints; Checkpoint can still be called explicitly.
+	CheckpointEvery int
+}
+
+const (
+	checkpointPrefix = "checkpoint-"
+	checkpointSuffix = ".llrb"
+	tmpSuffix        = ".tmp"
+)
+
+// ErrClosed is returned by operations on a closed Store.
+var ErrClosed = errors.New("llrb: store is closed")
+
+// Open opens the store in dir, creating the directory if needed, and recovers its contents from the newest checkpoint
+// and the write-ahead log. opts may be nil.
+func Open[K, V any](dir string, cmp func(a, b K) int, opts *Options) (*Store[K, V], error) {
+	s := &Store[K, V]{
+		dir:  dir,
+		t:    New[K, V](cmp),
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.SegmentSize <= 0 {
+		s.opts.SegmentSize = 64 << 20
+	}
+	if s.opts.SyncInterval <= 0 {
+		s.opts.SyncInterval = 100 * time.Millisecond
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.background()
+	return s, nil
+}
+
+func (s *Store[K, V]) recover() error {
+	checkpoints, err := s.checkpoints()
+	if err != nil {
+		return err
+	}
+	if len(checkpoints) > 0 {
+		s.seq = checkpoints[len(checkpoints)-1]
+		if err := s.t.LoadFile(s.checkpointPath(s.seq)); err != nil {
+			return fmt.Errorf("llrb: loading checkpoint: %w", err)
+		}
+	}
+	last, err := replayWAL(s.dir, func(rec walRecord) error {
+		if rec.seq <= s.seq {
+			// Already contained in the checkpoint.
+			return nil
+		}
+		var key K
+		if err := decodeValue(rec.key, &key); err != nil {
+			return fmt.Errorf("%w: log record %d: %v", ErrCorrupt, rec.seq, err)
+		}
+		if rec.op == opDelete {
+			s.t.Delete(key)
+		} else {
+			var value V
+			if err := decodeValue(rec.value, &value); err != nil {
+				return fmt.Errorf("%w: log record %d: %v", ErrCorrupt, rec.seq, err)
+			}
+			s.t.Put(key, value)
+		}
+		s.seq = rec.seq
+		s.sinceCheckpoint++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if last == 0 {
+		last = 1
+	}
+	s.log = &wal{dir: s.dir, segmentSize: s.opts.SegmentSize, policy: s.opts.Sync}
+	return s.log.openSegment(last)
+}
+
+// checkpoints returns the sequence numbers of the complete checkpoints in the store directory in ascending order and
+// removes any temporary file left by a checkpoint that was interrupted.
+func (s *Store[K, V]) checkpoints() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var seq uint64
+		if !strings.HasPrefix(name, checkpointPrefix) || !strings.HasSuffix(name, checkpointSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(name, checkpointPrefix+"%016x"+checkpointSuffix, &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Store[K, V]) checkpointPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%016x%s", checkpointPrefix, seq, checkpointSuffix))
+}
+
+// Get returns the value stored under key and whether the key was present.
+func (s *Store[K, V]) Get(key K) (V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Get(key)
+}
+
+// Len returns the number of keys in the store.
+func (s *Store[K, V]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Len()
+}
+
+// Snapshot returns an immutable view of the current contents.
+func (s *Store[K, V]) Snapshot() *Snapshot[K, V] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.t.Snapshot()
+}
+
+// Put logs and applies a write of key. When it returns nil the write is as durable as the sync policy promises.
+func (s *Store[K, V]) Put(key K, value V) error {
+	body, err := s.encode(opPut, key, &value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(body); err != nil {
+		return err
+	}
+	s.t.Put(key, value)
+	return nil
+}
+
+// Delete logs and applies the removal of key and reports whether it was present. Deleting a missing key writes
+// nothing to the log.
+func (s *Store[K, V]) Delete(key K) (bool, error) {
+	body, err := s.encode(opDelete, key, nil)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false, ErrClosed
+	}
+	if !s.t.Has(key) {
+		return false, nil
+	}
+	if err := s.write(body); err != nil {
+		return false, err
+	}
+	return s.t.Delete(key), nil
+}
+
+// encode builds the part of a log payload that follows the sequence number.
+func (s *Store[K, V]) encode(op byte, key K, value *V) ([]byte, error) {
+	payload, err := appendRecord([]byte{op}, key)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil {
+		if payload, err = appendRecord(payload, *value); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
+
+// write prefixes body with the next sequence number and appends it to the log. s.mu must be held.
+func (s *Store[K, V]) write(body []byte) error {
+	if s.closed {
+		return ErrClosed
+	}
+	payload := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(body)), s.seq+1)
+	if err := s.log.append(append(payload, body...)); err != nil {
+		return err
+	}
+	s.seq++
+	s.sinceCheckpoint++
+	if s.opts.CheckpointEvery > 0 && s.sinceCheckpoint >= s.opts.CheckpointEvery {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Sync flushes the log to stable storage regardless of the sync policy.
+func (s *Store[K, V]) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.log.sync()
+}
+
+// Checkpoint writes the current contents of the store to a checkpoint file and deletes the log segments and older
+// checkpoints it makes redundant. Writers are only blocked while the tree is snapshotted and the log is rotated, not
+// while the checkpoint is written.
+func (s *Store[K, V]) Checkpoint() error {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	snap, seq := s.t.Snapshot(), s.seq
+	// Everything up to seq is in segments older than the new one, so they can go once the checkpoint is durable.
+	next := s.log.segID + 1
+	err := s.log.openSegment(next)
+	if err == nil {
+		s.sinceCheckpoint = 0
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := s.checkpointPath(seq)
+	if err := writeFileAtomic(path, func(f *os.File) error {
+		_, err := snap.t.WriteTo(f)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := s.log.removeBefore(next); err != nil {
+		return err
+	}
+	seqs, err := s.checkpoints()
+	if err != nil {
+		return err
+	}
+	for _, old := range seqs {
+		if old < seq {
+			if err := os.Remove(s.checkpointPath(old)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes path through a temporary file that is fsynced and renamed into place, so readers see either
+// the old file or the complete new one.
+func writeFileAtomic(path string, write func(*os.File) error) error {
+	tmp := path + tmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// background runs interval fsyncs and automatic checkpoints.
+func (s *Store[K, V]) background() {
+	defer s.wg.Done()
+	var tick <-chan time.Time
+	if s.opts.Sync == SyncInterval {
+		t := time.NewTicker(s.opts.SyncInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		var err error
+		select {
+		case <-s.done:
+			return
+		case <-tick:
+			s.mu.Lock()
+			if !s.closed {
+				err = s.log.sync()
+			}
+			s.mu.Unlock()
+		case <-s.kick:
+			if err = s.Checkpoint(); errors.Is(err, ErrClosed) {
+				err = nil
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			if s.bgErr == nil {
+				s.bgErr = err
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes the log and releases the store. It returns the first error hit by a background sync or checkpoint, if
+// any.
+func (s *Store[K, V]) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	if err := s.log.closeSegment(); err != nil {
+		return err
+	}
+	return s.bgErr
+}
@@ -0,0 +1,175 @@
+package databases
+
+import "sync"
+
+// SyncTree is a Tree that is safe for concurrent use. Lookups share a read lock and run in parallel; Put, Delete and
+// Apply take the write lock. Iteration runs over a snapshot, so a long scan never blocks writers and the callback may
+// call back into the tree.
+type SyncTree[K, V any] struct {
+	mu sync.RWMutex
+	t  *Tree[K, V]
+}
+
+// NewSyncTree wraps t. The caller must not use t directly afterwards.
+func NewSyncTree[K, V any](t *Tree[K, V]) *SyncTree[K, V] {
+	return &SyncTree[K, V]{t: t}
+}
+
+// Len returns the number of keys in the tree.
+func (s *SyncTree[K, V]) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Len()
+}
+
+// Get returns the value stored under key and whether the key was present.
+func (s *SyncTree[K, V]) Get(key K) (V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Get(key)
+}
+
+// Has reports whether key is present in the tree.
+func (s *SyncTree[K, V]) Has(key K) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Has(key)
+}
+
+// Min returns the smallest key in the tree and its value.
+func (s *SyncTree[K, V]) Min() (K, V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Min()
+}
+
+// Max returns the largest key in the tree and its value.
+func (s *SyncTree[K, V]) Max() (K, V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Max()
+}
+
+// Floor returns the largest key less than or equal to key.
+func (s *SyncTree[K, V]) Floor(key K) (K, V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Floor(key)
+}
+
+// Ceiling returns the smallest key greater than or equal to key.
+func (s *SyncTree[K, V]) Ceiling(key K) (K, V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Ceiling(key)
+}
+
+// Rank returns the number of keys strictly less than key.
+func (s *SyncTree[K, V]) Rank(key K) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Rank(key)
+}
+
+// Select returns the i-th smallest key counting from zero.
+func (s *SyncTree[K, V]) Select(i int) (K, V, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Select(i)
+}
+
+// Validate checks the red-black invariants of the tree. See Tree.Validate.
+func (s *SyncTree[K, V]) Validate() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Validate()
+}
+
+// Put associates value with key.
+func (s *SyncTree[K, V]) Put(key K, value V) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.t.Put(key, value)
+}
+
+// Delete removes key and reports whether it was present.
+func (s *SyncTree[K, V]) Delete(key K) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.t.Delete(key)
+}
+
+// Snapshot returns an immutable view of the current contents. Taking a snapshot moves the tree to a new generation, so
+// it needs the write lock, but only for O(1) work.
+func (s *SyncTree[K, V]) Snapshot() *Snapshot[K, V] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.t.Snapshot()
+}
+
+// Ascend calls fn for every key in ascending order until fn returns false. It sees the tree as of the start of the call.
+func (s *SyncTree[K, V]) Ascend(fn func(key K, value V) bool) {
+	s.Snapshot().Ascend(fn)
+}
+
+// Descend calls fn for every key in descending order until fn returns false. It sees the tree as of the start of the
+// call.
+func (s *SyncTree[K, V]) Descend(fn func(key K, value V) bool) {
+	s.Snapshot().Descend(fn)
+}
+
+// AscendRange calls fn in ascending order for every key in [lo, hi) until fn returns false. It sees the tree as of the
+// start of the call.
+func (s *SyncTree[K, V]) AscendRange(lo, hi K, fn func(key K, value V) bool) {
+	s.Snapshot().AscendRange(lo, hi, fn)
+}
+
+// Apply performs every operation in b, in the order they were added, while holding the write lock once. Concurrent
+// readers see either none or all of the batch.
+func (s *SyncTree[K, V]) Apply(b *Batch[K, V]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.applyTo(s.t)
+}
+
+// Batch collects puts and deletes to be applied together with SyncTree.Apply. The zero value is an empty batch. A
+// Batch is not safe for concurrent use.
+type Batch[K, V any] struct {
+	ops []batchOp[K, V]
+}
+
+type batchOp[K, V any] struct {
+	key    K
+	value  V
+	delete bool
+}
+
+// Put queues a put of key.
+func (b *Batch[K, V]) Put(key K, value V) {
+	b.ops = append(b.ops, batchOp[K, V]{key: key, value: value})
+}
+
+// Delete queues a delete of key. Deleting a key that is not present is a no-op.
+func (b *Batch[K, V]) Delete(key K) {
+	b.ops = append(b.ops, batchOp[K, V]{key: key, delete: true})
+}
+
+// Len returns the number of queued operations.
+func (b *Batch[K, V]) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch[K, V]) Reset() {
+	b.ops = b.ops[:0]
+}
+
+func (b *Batch[K, V]) applyTo(t *Tree[K, V]) {
+	for _, op := range b.ops {
+		if op.delete {
+			t.Delete(op.key)
+		} else {
+			t.Put(op.key, op.value)
+		}
+	}
+}
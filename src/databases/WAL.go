@@ -0,0 +1,288 @@
+package databases
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The write-ahead log is a directory of segment files named by a hexadecimal segment number. Every mutation is
+// appended to the newest segment as one frame:
+//
+//   length  uint32  length of payload
+//   crc     uint32  CRC-32C of payload
+//   payload         uvarint sequence number, op byte, key record, value record (puts only)
+//
+// A crash can leave a partially written frame at the end of the newest segment. Replay detects it with the length and
+// checksum, truncates the segment back to the last complete frame and carries on. A bad frame anywhere else means the
+// log itself is damaged and replay fails.
+
+const (
+	walSuffix      = ".wal"
+	frameHeaderLen = 8
+
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// SyncPolicy controls when the write-ahead log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every write. A write that returned nil survives a crash.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs from a background goroutine every Options.SyncInterval. A crash loses at most that much.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system. A process crash loses nothing, a machine crash may.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+type walRecord struct {
+	seq   uint64
+	op    byte
+	key   []byte
+	value []byte
+}
+
+type wal struct {
+	dir         string
+	segmentSize int64
+	policy      SyncPolicy
+
+	f      segmentFile
+	segID  uint64
+	size   int64
+	dirty  bool  // written since the last fsync
+	failed error // set when a torn frame could not be removed; every later append returns it
+}
+
+// segmentFile is the part of *os.File the log writes segments through.
+type segmentFile interface {
+	Write(p []byte) (int, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// segments returns the ids of the log segments in dir in ascending order.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		var id uint64
+		if !strings.HasSuffix(e.Name(), walSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(e.Name(), "%016x"+walSuffix, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func walPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x%s", id, walSuffix))
+}
+
+// replayWAL calls apply for every record in dir in log order, truncating a torn frame at the end of the last segment.
+// It returns the id of the last segment, or 0 if there are none.
+func replayWAL(dir string, apply func(walRecord) error) (uint64, error) {
+	ids, err := walSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	for i, id := range ids {
+		data, err := os.ReadFile(walPath(dir, id))
+		if err != nil {
+			return 0, err
+		}
+		good, err := replaySegment(data, apply)
+		if err != nil {
+			return 0, err
+		}
+		if good == len(data) {
+			continue
+		}
+		if i != len(ids)-1 {
+			return 0, fmt.Errorf("%w: bad frame at offset %d of segment %016x", ErrCorrupt, good, id)
+		}
+		if err := os.Truncate(walPath(dir, id), int64(good)); err != nil {
+			return 0, err
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return ids[len(ids)-1], nil
+}
+
+// replaySegment applies the complete, intact frames at the start of data and returns how many bytes they cover.
+func replaySegment(data []byte, apply func(walRecord) error) (int, error) {
+	off := 0
+	for len(data)-off >= frameHeaderLen {
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		sum := binary.BigEndian.Uint32(data[off+4:])
+		if n > len(data)-off-frameHeaderLen {
+			break
+		}
+		payload := data[off+frameHeaderLen : off+frameHeaderLen+n]
+		if crc32.Checksum(payload, crcTable) != sum {
+			break
+		}
+		rec, ok := decodeWALRecord(payload)
+		if !ok {
+			break
+		}
+		if err := apply(rec); err != nil {
+			return off, err
+		}
+		off += frameHeaderLen + n
+	}
+	return off, nil
+}
+
+func decodeWALRecord(payload []byte) (walRecord, bool) {
+	var rec walRecord
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 || n >= len(payload) {
+		return rec, false
+	}
+	rec.seq, rec.op = seq, payload[n]
+	rest := payload[n+1:]
+	var ok bool
+	if rec.key, rest, ok = splitRecord(rest); !ok {
+		return rec, false
+	}
+	if rec.op == opPut {
+		if rec.value, rest, ok = splitRecord(rest); !ok {
+			return rec, false
+		}
+	}
+	return rec, len(rest) == 0 && (rec.op == opPut || rec.op == opDelete)
+}
+
+func splitRecord(src []byte) (rec, rest []byte, ok bool) {
+	l, n := binary.Uvarint(src)
+	if n <= 0 || l > uint64(len(src)-n) {
+		return nil, nil, false
+	}
+	return src[n : n+int(l)], src[n+int(l):], true
+}
+
+// openSegment starts appending to segment id, creating it if needed.
+func (w *wal) openSegment(id uint64) error {
+	f, err := os.OpenFile(walPath(w.dir, id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if w.f != nil {
+		if err := w.closeSegment(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	w.f, w.segID, w.size = f, id, fi.Size()
+	return syncDir(w.dir)
+}
+
+func (w *wal) closeSegment() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+// append writes one framed record, rotating to a new segment first if the current one is full. If the write fails
+// part-way, the partial frame is cut off again: replay stops at the first bad frame, so anything appended after it
+// would be lost. If even that fails, the log refuses all further appends.
+func (w *wal) append(payload []byte) error {
+	if w.failed != nil {
+		return w.failed
+	}
+	if w.size > 0 && w.size+int64(frameHeaderLen+len(payload)) > w.segmentSize {
+		if err := w.openSegment(w.segID + 1); err != nil {
+			return err
+		}
+	}
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	frame = append(frame, payload...)
+	n, err := w.f.Write(frame)
+	if err != nil {
+		if n > 0 {
+			if terr := w.f.Truncate(w.size); terr != nil {
+				w.failed = fmt.Errorf("llrb: log segment %016x has a torn frame that could not be removed (%v): %w",
+					w.segID, terr, err)
+				return w.failed
+			}
+		}
+		return err
+	}
+	w.size += int64(n)
+	w.dirty = true
+	if w.policy == SyncAlways {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *wal) sync() error {
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// removeBefore deletes every segment older than id.
+func (w *wal) removeBefore(id uint64) error {
+	ids, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, old := range ids {
+		if old >= id {
+			break
+		}
+		if err := os.Remove(walPath(w.dir, old)); err != nil {
+			return err
+		}
+	}
+	return syncDir(w.dir)
+}
+
+// syncDir makes renames, creations and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,87 @@
+package databases
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// TestIntervalTreeAgainstScan checks Overlapping and Stab against a linear scan of a model while intervals are
+// randomly inserted and deleted.
+func TestIntervalTreeAgainstScan(t *testing.T) {
+	ops := 100000
+	if testing.Short() {
+		ops = 10000
+	}
+	const (
+		span   = 200
+		maxLen = 20
+	)
+
+	rng := rand.New(rand.NewSource(1))
+	it := NewIntervalTree[int, int](Compare[int])
+	model := make(map[Interval[int]]int)
+	random := func() Interval[int] {
+		lo := rng.Intn(span)
+		return Interval[int]{lo, lo + rng.Intn(maxLen)}
+	}
+	scan := func(lo, hi int) []IntervalEntry[int, int] {
+		var out []IntervalEntry[int, int]
+		for iv, v := range model {
+			if iv.Lo <= hi && iv.Hi >= lo {
+				out = append(out, IntervalEntry[int, int]{Interval: iv, Value: v})
+			}
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].Lo != out[j].Lo {
+				return out[i].Lo < out[j].Lo
+			}
+			return out[i].Hi < out[j].Hi
+		})
+		return out
+	}
+	check := func(op int, what string, got, want []IntervalEntry[int, int]) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("op %d: %s returned %d intervals; want %d", op, what, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("op %d: %s[%d] = %v; want %v", op, what, i, got[i], want[i])
+			}
+		}
+	}
+
+	for i := 0; i < ops; i++ {
+		switch op := rng.Intn(10); {
+		case op < 4:
+			iv := random()
+			it.Insert(iv.Lo, iv.Hi, i)
+			model[iv] = i
+		case op < 7:
+			iv := random()
+			_, want := model[iv]
+			if got := it.Delete(iv.Lo, iv.Hi); got != want {
+				t.Fatalf("op %d: Delete(%v) = %v; want %v", i, iv, got, want)
+			}
+			delete(model, iv)
+		case op < 9:
+			q := random()
+			check(i, "Overlapping", it.Overlapping(q.Lo, q.Hi), scan(q.Lo, q.Hi))
+		default:
+			p := rng.Intn(span + maxLen)
+			check(i, "Stab", it.Stab(p), scan(p, p))
+		}
+		if it.Len() != len(model) {
+			t.Fatalf("op %d: Len() = %d; want %d", i, it.Len(), len(model))
+		}
+		if i%1000 == 0 {
+			if err := it.Validate(); err != nil {
+				t.Fatalf("op %d: %v", i, err)
+			}
+		}
+	}
+	if err := it.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
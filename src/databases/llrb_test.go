@@ -0,0 +1,241 @@
+package databases
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// TestTreeAgainstMap drives a Tree and a map with the same random operations and checks they agree. The key space is
+// small enough that most deletes hit and large enough that many miss.
+func TestTreeAgainstMap(t *testing.T) {
+	ops := 2000000
+	if testing.Short() {
+		ops = 100000
+	}
+	const keySpace = 4096
+
+	rng := rand.New(rand.NewSource(1))
+	tree := NewOrdered[int, int]()
+	model := make(map[int]int)
+	missing := 0
+	for i := 0; i < ops; i++ {
+		key := rng.Intn(keySpace)
+		switch op := rng.Intn(10); {
+		case op < 5:
+			tree.Put(key, i)
+			model[key] = i
+		case op < 8:
+			_, want := model[key]
+			if !want {
+				missing++
+			}
+			if got := tree.Delete(key); got != want {
+				t.Fatalf("op %d: Delete(%d) = %v; want %v", i, key, got, want)
+			}
+			delete(model, key)
+		default:
+			want, wantOK := model[key]
+			if got, ok := tree.Get(key); got != want || ok != wantOK {
+				t.Fatalf("op %d: Get(%d) = %d, %v; want %d, %v", i, key, got, ok, want, wantOK)
+			}
+		}
+		if tree.Len() != len(model) {
+			t.Fatalf("op %d: Len() = %d; want %d", i, tree.Len(), len(model))
+		}
+		if i%10000 == 0 {
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("op %d: %v", i, err)
+			}
+		}
+	}
+	if missing == 0 {
+		t.Fatal("no delete of a missing key was exercised")
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, n := -1, 0
+	tree.Ascend(func(key, value int) bool {
+		if key <= prev {
+			t.Fatalf("Ascend yielded %d after %d", key, prev)
+		}
+		if want, ok := model[key]; !ok || value != want {
+			t.Fatalf("Ascend yielded %d=%d; model has %d, %v", key, value, want, ok)
+		}
+		if rank := tree.Rank(key); rank != n {
+			t.Fatalf("Rank(%d) = %d; want %d", key, rank, n)
+		}
+		if k, _, ok := tree.Select(n); !ok || k != key {
+			t.Fatalf("Select(%d) = %d, %v; want %d", n, k, ok, key)
+		}
+		prev = key
+		n++
+		return true
+	})
+	if n != len(model) {
+		t.Fatalf("Ascend yielded %d keys; want %d", n, len(model))
+	}
+}
+
+// TestTreeDeleteMissing checks that deleting absent keys from empty, single-node and larger trees leaves them intact.
+func TestTreeDeleteMissing(t *testing.T) {
+	tree := NewOrdered[int, string]()
+	if tree.Delete(1) {
+		t.Fatal("Delete on an empty tree reported true")
+	}
+	for i := 0; i < 100; i += 2 {
+		tree.Put(i, "v")
+		for _, k := range []int{-1, i + 1, 1000} {
+			if tree.Delete(k) {
+				t.Fatalf("Delete(%d) reported true", k)
+			}
+			if err := tree.Validate(); err != nil {
+				t.Fatalf("after Delete(%d): %v", k, err)
+			}
+		}
+		if tree.Len() != i/2+1 {
+			t.Fatalf("Len() = %d; want %d", tree.Len(), i/2+1)
+		}
+	}
+}
+
+// tens returns a tree holding 10, 20, ..., 10*n, each mapped to its key divided by ten.
+func tens(n int) *Tree[int, int] {
+	tree := NewOrdered[int, int]()
+	for i := 1; i <= n; i++ {
+		tree.Put(10*i, i)
+	}
+	return tree
+}
+
+func TestTreeFloorCeiling(t *testing.T) {
+	tree := tens(10)
+	tests := []struct {
+		name            string
+		key             int
+		floor, ceiling  int
+		floorOK, ceilOK bool
+	}{
+		{"below min", 5, 0, 10, false, true},
+		{"min", 10, 10, 10, true, true},
+		{"gap", 45, 40, 50, true, true},
+		{"exact", 70, 70, 70, true, true},
+		{"max", 100, 100, 100, true, true},
+		{"above max", 105, 100, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if k, v, ok := tree.Floor(tt.key); k != tt.floor || ok != tt.floorOK || (ok && v != k/10) {
+				t.Errorf("Floor(%d) = %d, %d, %v; want %d, %v", tt.key, k, v, ok, tt.floor, tt.floorOK)
+			}
+			if k, v, ok := tree.Ceiling(tt.key); k != tt.ceiling || ok != tt.ceilOK || (ok && v != k/10) {
+				t.Errorf("Ceiling(%d) = %d, %d, %v; want %d, %v", tt.key, k, v, ok, tt.ceiling, tt.ceilOK)
+			}
+		})
+	}
+
+	empty := NewOrdered[int, int]()
+	if _, _, ok := empty.Floor(1); ok {
+		t.Error("Floor on an empty tree reported a key")
+	}
+	if _, _, ok := empty.Ceiling(1); ok {
+		t.Error("Ceiling on an empty tree reported a key")
+	}
+}
+
+func TestTreeMinMax(t *testing.T) {
+	if _, _, ok := NewOrdered[int, int]().Min(); ok {
+		t.Error("Min on an empty tree reported a key")
+	}
+	if _, _, ok := NewOrdered[int, int]().Max(); ok {
+		t.Error("Max on an empty tree reported a key")
+	}
+	for _, n := range []int{1, 2, 10, 100} {
+		tree := tens(n)
+		if k, v, ok := tree.Min(); k != 10 || v != 1 || !ok {
+			t.Errorf("%d keys: Min() = %d, %d, %v; want 10, 1, true", n, k, v, ok)
+		}
+		if k, v, ok := tree.Max(); k != 10*n || v != n || !ok {
+			t.Errorf("%d keys: Max() = %d, %d, %v; want %d, %d, true", n, k, v, ok, 10*n, n)
+		}
+	}
+}
+
+// collect returns the keys an iteration visits, stopping it after limit keys if limit is positive.
+func collect(iterate func(fn func(key, value int) bool), limit int) []int {
+	keys := []int{}
+	iterate(func(key, value int) bool {
+		keys = append(keys, key)
+		return limit <= 0 || len(keys) < limit
+	})
+	return keys
+}
+
+func TestTreeAscendRange(t *testing.T) {
+	tree := tens(10)
+	tests := []struct {
+		name   string
+		lo, hi int
+		limit  int
+		want   []int
+	}{
+		{"everything", 0, 1000, 0, []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}},
+		{"exact bounds", 30, 60, 0, []int{30, 40, 50}},
+		{"gaps", 25, 65, 0, []int{30, 40, 50, 60}},
+		{"below min", 0, 10, 0, []int{}},
+		{"above max", 101, 200, 0, []int{}},
+		{"up to max", 90, 101, 0, []int{90, 100}},
+		{"empty range", 50, 50, 0, []int{}},
+		{"inverted range", 60, 30, 0, []int{}},
+		{"stopped early", 20, 90, 3, []int{20, 30, 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := collect(func(fn func(key, value int) bool) { tree.AscendRange(tt.lo, tt.hi, fn) }, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AscendRange(%d, %d) visited %v; want %v", tt.lo, tt.hi, got, tt.want)
+			}
+		})
+	}
+	empty := NewOrdered[int, int]()
+	if got := collect(func(fn func(key, value int) bool) { empty.AscendRange(0, 10, fn) }, 0); len(got) != 0 {
+		t.Errorf("AscendRange on an empty tree visited %v", got)
+	}
+}
+
+func TestTreeAscendDescend(t *testing.T) {
+	tree := tens(5)
+	if got, want := collect(tree.Ascend, 0), []int{10, 20, 30, 40, 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Ascend visited %v; want %v", got, want)
+	}
+	if got, want := collect(tree.Descend, 0), []int{50, 40, 30, 20, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Descend visited %v; want %v", got, want)
+	}
+	if got, want := collect(tree.Descend, 2), []int{50, 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Descend stopped after two keys visited %v; want %v", got, want)
+	}
+	if got := collect(NewOrdered[int, int]().Descend, 0); len(got) != 0 {
+		t.Errorf("Descend on an empty tree visited %v", got)
+	}
+}
+
+func TestTreeRankSelect(t *testing.T) {
+	tree := tens(10)
+	for _, tt := range []struct{ key, rank int }{{5, 0}, {10, 0}, {15, 1}, {100, 9}, {105, 10}} {
+		if got := tree.Rank(tt.key); got != tt.rank {
+			t.Errorf("Rank(%d) = %d; want %d", tt.key, got, tt.rank)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if k, _, ok := tree.Select(i); k != 10*(i+1) || !ok {
+			t.Errorf("Select(%d) = %d, %v; want %d", i, k, ok, 10*(i+1))
+		}
+	}
+	for _, i := range []int{-1, 10} {
+		if _, _, ok := tree.Select(i); ok {
+			t.Errorf("Select(%d) reported a key", i)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package databases
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenLSMRejectsGobKeys(t *testing.T) {
+	type point struct{ X, Y int }
+	_, err := OpenLSM[point, int](t.TempDir(), func(a, b point) int {
+		if a.X != b.X {
+			return Compare(a.X, b.X)
+		}
+		return Compare(a.Y, b.Y)
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "BinaryMarshaler") {
+		t.Fatalf("OpenLSM with a struct key = %v; want an error", err)
+	}
+}
+
+// TestLSMReopen flushes enough writes to spill into SSTables and checks every key can still be found through the
+// bloom filters after the engine is reopened.
+func TestLSMReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := &LSMOptions{MemtableSize: 4 << 10, Sync: SyncNever}
+	s, err := OpenLSM[string, int](dir, Compare[string], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		if err := s.Put(fmt.Sprintf("key%05d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 10 {
+		if err := s.Delete(fmt.Sprintf("key%05d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenLSM[string, int](dir, Compare[string], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < n; i++ {
+		v, ok, err := s.Get(fmt.Sprintf("key%05d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i%10 != 0; ok != want || (ok && v != i) {
+			t.Fatalf("Get(key%05d) = %d, %v; want %d, %v", i, v, ok, i, want)
+		}
+	}
+	if _, ok, err := s.Get("missing"); ok || err != nil {
+		t.Fatalf("Get(missing) = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestOpenLSMAcceptsPointerMarshalers(t *testing.T) {
+	s, err := OpenLSM[point, int](t.TempDir(), func(a, b point) int {
+		if a.X != b.X {
+			return Compare(a.X, b.X)
+		}
+		return Compare(a.Y, b.Y)
+	}, nil)
+	if err != nil {
+		t.Fatalf("OpenLSM with a key whose pointer implements BinaryMarshaler = %v", err)
+	}
+	s.Close()
+}
+
+// TestLSMAscendRange spreads writes over deeper levels, level 0, frozen memtables and the memtable, and checks that
+// range scans merge them so the newest entry of every key wins and tombstones hide the older values below them.
+func TestLSMAscendRange(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenLSM[int, string](dir, Compare[int], &LSMOptions{
+		MemtableSize: 2 << 10,
+		L0Tables:     2,
+		LevelSize:    8 << 10,
+		Sync:         SyncNever,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	model := map[int]string{}
+	put := func(k int, v string) {
+		t.Helper()
+		if err := s.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+		model[k] = v
+	}
+	del := func(k int) {
+		t.Helper()
+		if err := s.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(model, k)
+	}
+	// settle waits for the background flushes and compactions to catch up.
+	settle := func() {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			s.mu.RLock()
+			frozen := len(s.frozen)
+			s.mu.RUnlock()
+			if frozen == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for flushes")
+			}
+		}
+	}
+
+	for k := 0; k < 2000; k++ {
+		put(k, "old")
+	}
+	settle()
+	for k := 0; k < 2000; k += 3 {
+		del(k)
+	}
+	for k := 1; k < 2000; k += 7 {
+		put(k, "newer")
+	}
+	settle()
+	// The last writes stay in the memtable: resurrect some deleted keys, delete some rewritten ones.
+	for k := 0; k < 2000; k += 9 {
+		put(k, "newest")
+	}
+	for k := 1; k < 2000; k += 14 {
+		del(k)
+	}
+
+	s.mu.RLock()
+	deep := 0
+	for _, level := range s.current.levels[1:] {
+		if len(level) > 0 {
+			deep++
+		}
+	}
+	memLen := s.mem.Len()
+	s.mu.RUnlock()
+	if deep == 0 || memLen == 0 {
+		t.Fatalf("%d non-empty levels below 0 and %d memtable entries; want data in both", deep, memLen)
+	}
+
+	check := func(lo, hi, limit int) {
+		t.Helper()
+		var got []string
+		err := s.AscendRange(lo, hi, func(k int, v string) bool {
+			got = append(got, fmt.Sprintf("%d=%s", k, v))
+			return limit <= 0 || len(got) < limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for k := lo; k < hi && (limit <= 0 || len(want) < limit); k++ {
+			if v, ok := model[k]; ok {
+				want = append(want, fmt.Sprintf("%d=%s", k, v))
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("AscendRange(%d, %d) = %v; want %v", lo, hi, got, want)
+		}
+	}
+	check(0, 2000, 0)
+	check(-10, 5, 0)
+	check(1000, 1100, 0)
+	check(1995, 3000, 0)
+	check(500, 1500, 17)
+	check(700, 700, 0)
+	check(3000, 4000, 0)
+}
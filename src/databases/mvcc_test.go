@@ -0,0 +1,217 @@
+package databases
+
+import (
+	"errors"
+	"testing"
+)
+
+// mvccStep is one action in an MVCC scenario. tx names the transaction it applies to; Begin binds the name.
+type mvccStep struct {
+	op   string // begin, put, delete, get, commit, rollback, gc or versions
+	tx   string
+	key  int
+	val  string
+	ok   bool  // get: whether the key is expected to be visible
+	err  error // put, delete, get, commit: expected error
+	n    int   // gc: versions expected to be removed; versions: db.Len()
+	want string
+}
+
+func begin(tx string) mvccStep                { return mvccStep{op: "begin", tx: tx} }
+func put(tx string, k int, v string) mvccStep { return mvccStep{op: "put", tx: tx, key: k, val: v} }
+func del(tx string, k int) mvccStep           { return mvccStep{op: "delete", tx: tx, key: k} }
+func get(tx string, k int, v string) mvccStep {
+	return mvccStep{op: "get", tx: tx, key: k, want: v, ok: true}
+}
+func missing(tx string, k int) mvccStep { return mvccStep{op: "get", tx: tx, key: k} }
+func commit(tx string) mvccStep         { return mvccStep{op: "commit", tx: tx} }
+func rollback(tx string) mvccStep       { return mvccStep{op: "rollback", tx: tx} }
+func gc(n int) mvccStep                 { return mvccStep{op: "gc", n: n} }
+func versions(n int) mvccStep           { return mvccStep{op: "versions", n: n} }
+
+func fails(s mvccStep, err error) mvccStep {
+	s.err = err
+	return s
+}
+
+func TestMVCC(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []mvccStep
+	}{
+		{"read your own writes", []mvccStep{
+			begin("a"), missing("a", 1), put("a", 1, "x"), get("a", 1, "x"), del("a", 1), missing("a", 1),
+			put("a", 1, "y"), get("a", 1, "y"), commit("a"),
+			begin("b"), get("b", 1, "y"), versions(1),
+		}},
+		{"writes are invisible until commit", []mvccStep{
+			begin("a"), put("a", 1, "x"),
+			begin("b"), missing("b", 1),
+			commit("a"),
+			missing("b", 1), // b began before a committed
+			begin("c"), get("c", 1, "x"),
+		}},
+		{"snapshot reads ignore later commits", []mvccStep{
+			begin("w"), put("w", 1, "v1"), put("w", 2, "v1"), commit("w"),
+			begin("r"),
+			begin("w"), put("w", 1, "v2"), del("w", 2), put("w", 3, "v2"), commit("w"),
+			get("r", 1, "v1"), get("r", 2, "v1"), missing("r", 3),
+			begin("s"), get("s", 1, "v2"), missing("s", 2), get("s", 3, "v2"),
+		}},
+		{"first committer wins", []mvccStep{
+			begin("a"), begin("b"),
+			put("a", 1, "a"), put("b", 1, "b"), put("b", 2, "b"),
+			commit("a"),
+			fails(commit("b"), ErrConflict),
+			begin("c"), get("c", 1, "a"), missing("c", 2), // nothing of b was applied
+		}},
+		{"delete conflicts with put", []mvccStep{
+			begin("w"), put("w", 1, "x"), commit("w"),
+			begin("a"), begin("b"),
+			del("a", 1), put("b", 1, "y"),
+			commit("b"),
+			fails(commit("a"), ErrConflict),
+			begin("c"), get("c", 1, "y"),
+		}},
+		{"disjoint writes do not conflict", []mvccStep{
+			begin("a"), begin("b"), put("a", 1, "a"), put("b", 2, "b"), commit("b"), commit("a"),
+			begin("c"), get("c", 1, "a"), get("c", 2, "b"),
+		}},
+		{"reading a key does not conflict", []mvccStep{
+			begin("a"), begin("b"), missing("a", 1), put("b", 1, "b"), commit("b"), put("a", 2, "a"), commit("a"),
+		}},
+		{"sequential writers do not conflict", []mvccStep{
+			begin("a"), put("a", 1, "a"), commit("a"),
+			begin("b"), put("b", 1, "b"), commit("b"),
+			begin("c"), get("c", 1, "b"),
+		}},
+		{"rollback discards writes", []mvccStep{
+			begin("a"), put("a", 1, "x"), rollback("a"), rollback("a"),
+			begin("b"), missing("b", 1), versions(0),
+			begin("c"), put("c", 1, "y"), commit("c"), // a's buffered write is not a conflict
+		}},
+		{"finished transactions", []mvccStep{
+			begin("a"), put("a", 1, "x"), commit("a"),
+			fails(put("a", 2, "y"), ErrTxnDone), fails(del("a", 1), ErrTxnDone),
+			fails(get("a", 1, ""), ErrTxnDone), fails(commit("a"), ErrTxnDone),
+			begin("b"), rollback("b"), fails(commit("b"), ErrTxnDone),
+		}},
+		{"tombstones hide older versions", []mvccStep{
+			begin("w"), put("w", 1, "x"), commit("w"),
+			begin("old"),
+			begin("w"), del("w", 1), commit("w"),
+			begin("new"), missing("new", 1), get("old", 1, "x"),
+			begin("w"), put("w", 1, "z"), commit("w"),
+			missing("new", 1), get("old", 1, "x"),
+			begin("newest"), get("newest", 1, "z"),
+			versions(3),
+		}},
+		{"gc keeps the newest version of each key", []mvccStep{
+			begin("w"), put("w", 1, "v1"), put("w", 2, "v1"), commit("w"),
+			begin("w"), put("w", 1, "v2"), commit("w"),
+			begin("w"), put("w", 1, "v3"), commit("w"),
+			versions(4), gc(2), versions(2), gc(0),
+			begin("r"), get("r", 1, "v3"), get("r", 2, "v1"),
+		}},
+		{"gc drops deleted keys", []mvccStep{
+			begin("w"), put("w", 1, "x"), put("w", 2, "x"), commit("w"),
+			begin("w"), del("w", 1), commit("w"),
+			gc(2), versions(1),
+			begin("r"), missing("r", 1), get("r", 2, "x"),
+		}},
+		{"gc keeps what an open transaction can read", []mvccStep{
+			begin("w"), put("w", 1, "v1"), commit("w"),
+			begin("w"), put("w", 1, "v2"), commit("w"),
+			begin("old"),
+			begin("w"), put("w", 1, "v3"), del("w", 2), commit("w"),
+			begin("w"), put("w", 1, "v4"), commit("w"),
+			// Below old's start only v2 is still readable; v3, v4 and the tombstone of 2 are newer.
+			versions(5), gc(1), versions(4),
+			get("old", 1, "v2"), missing("old", 2),
+			commit("old"),
+			gc(3), versions(1),
+			begin("r"), get("r", 1, "v4"), missing("r", 2),
+		}},
+		{"gc keeps a tombstone an open transaction reads through", []mvccStep{
+			begin("w"), put("w", 1, "x"), commit("w"),
+			begin("w"), del("w", 1), commit("w"),
+			begin("old"),
+			begin("w"), put("w", 1, "y"), commit("w"),
+			gc(1), versions(2), missing("old", 1),
+			rollback("old"), gc(1), versions(1),
+		}},
+		{"gc with a transaction that began before any commit", []mvccStep{
+			begin("old"),
+			begin("w"), put("w", 1, "v1"), commit("w"),
+			begin("w"), put("w", 1, "v2"), commit("w"),
+			gc(0), missing("old", 1),
+			rollback("old"), gc(1),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewMVCC[int, string](Compare[int])
+			txns := map[string]*Txn[int, string]{}
+			for i, s := range tt.steps {
+				tx := txns[s.tx]
+				var err error
+				switch s.op {
+				case "begin":
+					txns[s.tx] = db.Begin()
+				case "put":
+					err = tx.Put(s.key, s.val)
+				case "delete":
+					err = tx.Delete(s.key)
+				case "get":
+					var v string
+					var ok bool
+					v, ok, err = tx.Get(s.key)
+					if err == nil && (v != s.want || ok != s.ok) {
+						t.Fatalf("step %d: %s.Get(%d) = %q, %v; want %q, %v", i, s.tx, s.key, v, ok, s.want, s.ok)
+					}
+				case "commit":
+					_, err = tx.Commit()
+				case "rollback":
+					tx.Rollback()
+				case "gc":
+					if n := db.GC(); n != s.n {
+						t.Fatalf("step %d: GC() = %d; want %d", i, n, s.n)
+					}
+				case "versions":
+					if n := db.Len(); n != s.n {
+						t.Fatalf("step %d: Len() = %d; want %d", i, n, s.n)
+					}
+				default:
+					t.Fatalf("step %d: unknown op %q", i, s.op)
+				}
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d: %s %s(%d) = %v; want %v", i, s.op, s.tx, s.key, err, s.err)
+				}
+			}
+		})
+	}
+}
+
+func TestMVCCCommitTimestamps(t *testing.T) {
+	db := NewMVCC[int, string](Compare[int])
+	var last uint64
+	for i := 0; i < 3; i++ {
+		tx := db.Begin()
+		if err := tx.Put(i, "x"); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts <= last {
+			t.Fatalf("commit %d got timestamp %d; want more than %d", i, ts, last)
+		}
+		last = ts
+	}
+	// A read-only transaction commits at its start timestamp without advancing the clock.
+	ro := db.Begin()
+	if ts, err := ro.Commit(); err != nil || ts != last {
+		t.Fatalf("read-only Commit() = %d, %v; want %d, nil", ts, err, last)
+	}
+}
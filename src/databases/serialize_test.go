@@ -0,0 +1,227 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalBinaryRoundTrip(t *testing.T) {
+	tree := NewOrdered[int, string]()
+	for i := 0; i < 1000; i++ {
+		tree.Put(i*7%1000, strings.Repeat("x", i%13))
+	}
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewOrdered[int, string]()
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != tree.Len() {
+		t.Fatalf("Len() = %d; want %d", got.Len(), tree.Len())
+	}
+	tree.Ascend(func(key int, value string) bool {
+		if v, ok := got.Get(key); !ok || v != value {
+			t.Fatalf("Get(%d) = %q, %v; want %q", key, v, ok, value)
+		}
+		return true
+	})
+	if err := got.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnmarshalBinaryRejectsFlags(t *testing.T) {
+	tree := NewOrdered[int, int]()
+	tree.Put(1, 1)
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set a reserved flag and fix up the checksum so only the flags are wrong.
+	binary.BigEndian.PutUint16(data[6:], 1)
+	body := data[:len(data)-checksumSize]
+	binary.BigEndian.PutUint32(data[len(body):], crc32.Checksum(body, crcTable))
+
+	err = NewOrdered[int, int]().UnmarshalBinary(data)
+	if err == nil || !strings.Contains(err.Error(), "flags") {
+		t.Fatalf("UnmarshalBinary with flags set = %v; want an unsupported flags error", err)
+	}
+}
+
+// point marshals itself through pointer receivers only, in a format gob would not produce.
+type point struct{ X, Y int32 }
+
+func (p *point) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", p.X, p.Y)), nil
+}
+
+func (p *point) UnmarshalBinary(data []byte) error {
+	_, err := fmt.Sscanf(string(data), "%d,%d", &p.X, &p.Y)
+	return err
+}
+
+func TestPointerReceiverMarshaler(t *testing.T) {
+	enc, err := encodeValue(point{3, -4})
+	if err != nil || string(enc) != "3,-4" {
+		t.Fatalf("encodeValue(point) = %q, %v; want MarshalBinary's %q", enc, err, "3,-4")
+	}
+
+	tree := NewOrdered[int, point]()
+	for i := 0; i < 100; i++ {
+		tree.Put(i, point{int32(i), int32(-i)})
+	}
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewOrdered[int, point]()
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if p, ok := got.Get(i); !ok || p != (point{int32(i), int32(-i)}) {
+			t.Fatalf("Get(%d) = %v, %v; want {%d %d}", i, p, ok, i, -i)
+		}
+	}
+}
+
+// TestNewFromSortedSizes bulk-loads every size up to a few hundred keys and checks the red-black invariants of each.
+func TestNewFromSortedSizes(t *testing.T) {
+	for n := 0; n <= 400; n++ {
+		keys := make([]int, n)
+		values := make([]string, n)
+		for i := range keys {
+			keys[i] = 2 * i
+			values[i] = strconv.Itoa(i)
+		}
+		tree, err := NewFromSorted(Compare[int], keys, values)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if tree.Len() != n {
+			t.Fatalf("n=%d: Len() = %d", n, tree.Len())
+		}
+		for i, k := range keys {
+			if v, ok := tree.Get(k); !ok || v != values[i] {
+				t.Fatalf("n=%d: Get(%d) = %q, %v; want %q", n, k, v, ok, values[i])
+			}
+			if k, _, ok := tree.Select(i); !ok || k != keys[i] {
+				t.Fatalf("n=%d: Select(%d) = %d, %v; want %d", n, i, k, ok, keys[i])
+			}
+		}
+		// The tree keeps working as an ordinary tree afterwards.
+		tree.Put(-1, "x")
+		tree.Delete(0)
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("n=%d: after Put and Delete: %v", n, err)
+		}
+	}
+}
+
+func TestNewFromSortedErrors(t *testing.T) {
+	if _, err := NewFromSorted(Compare[int], []int{1, 2}, []int{1}); err == nil {
+		t.Error("NewFromSorted with more keys than values succeeded")
+	}
+	if _, err := NewFromSorted(Compare[int], []int{1, 3, 2}, []int{1, 2, 3}); err == nil {
+		t.Error("NewFromSorted with unsorted keys succeeded")
+	}
+	if _, err := NewFromSorted(Compare[int], []int{1, 1}, []int{1, 2}); err == nil {
+		t.Error("NewFromSorted with a duplicate key succeeded")
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	tree := NewOrdered[string, int]()
+	// Enough records to cross the 64 KiB chunks WriteTo flushes in.
+	for i := 0; i < 20000; i++ {
+		tree.Put(fmt.Sprintf("key-%06d", i), i)
+	}
+	var buf bytes.Buffer
+	written, err := tree.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %d bytes; wrote %d", written, buf.Len())
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+
+	got := NewOrdered[string, int]()
+	read, err := got.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != written || got.Len() != tree.Len() {
+		t.Fatalf("ReadFrom read %d bytes and %d keys; want %d and %d", read, got.Len(), written, tree.Len())
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cut := range []int{0, headerSize, len(data) / 2, len(data) - 1} {
+		if _, err := NewOrdered[string, int]().ReadFrom(bytes.NewReader(data[:cut])); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("ReadFrom of the first %d bytes = %v; want ErrCorrupt", cut, err)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tree := NewOrdered[int, string]()
+	for i := 0; i < 1000; i++ {
+		tree.Put(i, strconv.Itoa(i*i))
+	}
+	path := filepath.Join(t.TempDir(), "tree.llrb")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := NewOrdered[int, string]()
+	got.Put(-5, "replaced")
+	if err := got.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 1000 || got.Has(-5) {
+		t.Fatalf("LoadFile left %d keys, Has(-5) = %v; want the file's 1000 keys only", got.Len(), got.Has(-5))
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := got.Get(i); !ok || v != strconv.Itoa(i*i) {
+			t.Fatalf("Get(%d) = %q, %v", i, v, ok)
+		}
+	}
+	// The tree must not keep pointing into the mapping once LoadFile has unmapped it.
+	got.Put(1000, "new")
+	if err := got.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.llrb")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := got.LoadFile(empty); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("LoadFile of an empty file = %v; want ErrCorrupt", err)
+	}
+	if err := got.LoadFile(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadFile of a missing file = %v; want os.ErrNotExist", err)
+	}
+}
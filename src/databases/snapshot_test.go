@@ -0,0 +1,206 @@
+package databases
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// checkTree fails the test unless tree holds exactly the pairs in want and satisfies the red-black invariants.
+func checkTree(t *testing.T, name string, tree interface {
+	Len() int
+	Get(key int) (int, bool)
+	Ascend(fn func(key, value int) bool)
+	Validate() error
+}, want map[int]int) {
+	t.Helper()
+	if err := tree.Validate(); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if tree.Len() != len(want) {
+		t.Fatalf("%s: Len() = %d; want %d", name, tree.Len(), len(want))
+	}
+	prev, first := 0, true
+	tree.Ascend(func(key, value int) bool {
+		if !first && key <= prev {
+			t.Fatalf("%s: keys out of order: %d after %d", name, key, prev)
+		}
+		if v, ok := want[key]; !ok || v != value {
+			t.Fatalf("%s: holds %d: %d; want %d, %v", name, key, value, v, ok)
+		}
+		prev, first = key, false
+		return true
+	})
+}
+
+func copyMap(m map[int]int) map[int]int {
+	c := make(map[int]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// mutate applies a random Put or Delete to tree and model alike.
+func mutate(rng *rand.Rand, tree *Tree[int, int], model map[int]int, i int) {
+	key := rng.Intn(500)
+	if rng.Intn(3) == 0 {
+		tree.Delete(key)
+		delete(model, key)
+	} else {
+		tree.Put(key, i)
+		model[key] = i
+	}
+}
+
+func TestSnapshotIgnoresLaterWrites(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tree := NewOrdered[int, int]()
+	model := map[int]int{}
+	var snaps []*Snapshot[int, int]
+	var models []map[int]int
+	for i := 0; i < 5000; i++ {
+		mutate(rng, tree, model, i)
+		if i%500 == 0 {
+			snaps = append(snaps, tree.Snapshot())
+			models = append(models, copyMap(model))
+		}
+	}
+	checkTree(t, "tree", tree, model)
+	for i, s := range snaps {
+		checkTree(t, "snapshot", s, models[i])
+	}
+}
+
+func TestCloneInterleaved(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	a := NewOrdered[int, int]()
+	modelA := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		mutate(rng, a, modelA, i)
+	}
+	b := a.Clone()
+	modelB := copyMap(modelA)
+	// Writes to either tree must copy the shared path instead of changing it under the other one.
+	for i := 0; i < 5000; i++ {
+		if rng.Intn(2) == 0 {
+			mutate(rng, a, modelA, i)
+		} else {
+			mutate(rng, b, modelB, i)
+		}
+		if i%1000 == 0 {
+			c := b.Clone()
+			modelC := copyMap(modelB)
+			mutate(rng, c, modelC, i)
+			checkTree(t, "clone of clone", c, modelC)
+		}
+	}
+	checkTree(t, "original", a, modelA)
+	checkTree(t, "clone", b, modelB)
+}
+
+func TestPersistentSnapshot(t *testing.T) {
+	base := NewOrdered[int, int]()
+	model := map[int]int{}
+	for i := 0; i < 100; i++ {
+		base.Put(i*2, i)
+		model[i*2] = i
+	}
+	v0 := base.Snapshot()
+
+	v1 := v0.Insert(7, 70)
+	v2 := v1.Delete(10)
+	v3 := v2.Insert(10, 100)
+	checkTree(t, "v0", v0, model)
+	want1 := copyMap(model)
+	want1[7] = 70
+	checkTree(t, "v1", v1, want1)
+	want2 := copyMap(want1)
+	delete(want2, 10)
+	checkTree(t, "v2", v2, want2)
+	want3 := copyMap(want2)
+	want3[10] = 100
+	checkTree(t, "v3", v3, want3)
+
+	if v2.Delete(11) != v2 {
+		t.Error("deleting a missing key returned a new snapshot")
+	}
+
+	// A tree made from a snapshot is independent of it in both directions.
+	tree := v1.Tree()
+	tree.Put(1, 1)
+	tree.Delete(7)
+	checkTree(t, "v1 after writing its tree", v1, want1)
+	base.Put(3, 3)
+	checkTree(t, "v0 after writing the base tree", v0, model)
+}
+
+// nodes returns the set of nodes reachable from h.
+func nodes(h *node[int, int], set map[*node[int, int]]bool) map[*node[int, int]]bool {
+	if h != nil {
+		set[h] = true
+		nodes(h.left, set)
+		nodes(h.right, set)
+	}
+	return set
+}
+
+// TestSnapshotSharesUnchangedNodes checks that a write after a snapshot copies only the path it changes.
+func TestSnapshotSharesUnchangedNodes(t *testing.T) {
+	tree := NewOrdered[int, int]()
+	for i := 0; i < 1024; i++ {
+		tree.Put(i, i)
+	}
+	s := tree.Snapshot()
+	tree.Put(2000, 0)
+	before := nodes(s.t.root, map[*node[int, int]]bool{})
+	after := nodes(tree.root, map[*node[int, int]]bool{})
+	copied := 0
+	for n := range after {
+		if !before[n] {
+			copied++
+		}
+	}
+	// The path from the root to the new key is at most 2 lg n long in a red-black tree.
+	if copied > 2*11+1 {
+		t.Fatalf("one Put after a snapshot made %d new nodes; want at most %d", copied, 2*11+1)
+	}
+	// A second write in the same generation modifies the copies in place.
+	tree.Put(2001, 0)
+	again := 0
+	for n := range nodes(tree.root, map[*node[int, int]]bool{}) {
+		if !before[n] && !after[n] {
+			again++
+		}
+	}
+	if again > 1+2 {
+		t.Fatalf("a second Put made %d new nodes; want only the new one and rotated copies", again)
+	}
+}
+
+// TestSnapshotConcurrentReads reads snapshots while the tree they came from keeps changing; run with -race.
+func TestSnapshotConcurrentReads(t *testing.T) {
+	tree := NewOrdered[int, int]()
+	for i := 0; i < 1000; i++ {
+		tree.Put(i, i)
+	}
+	s := tree.Snapshot()
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if v, ok := s.Get(i); !ok || v != i {
+					t.Errorf("Get(%d) = %d, %v; want %d", i, v, ok, i)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		tree.Put(i, -i)
+		tree.Delete(i + 500)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,275 @@
+package databases
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func openTestStore(t *testing.T, dir string) *Store[int, string] {
+	t.Helper()
+	s, err := Open[int, string](dir, Compare[int], &Options{SegmentSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func checkStore(t *testing.T, s *Store[int, string], want map[int]string) {
+	t.Helper()
+	if s.Len() != len(want) {
+		t.Fatalf("Len() = %d; want %d", s.Len(), len(want))
+	}
+	for k, v := range want {
+		if got, ok := s.Get(k); !ok || got != v {
+			t.Fatalf("Get(%d) = %q, %v; want %q", k, got, ok, v)
+		}
+	}
+}
+
+// TestStoreTornWrite appends an incomplete frame to the last log segment, as a crash in the middle of a write would,
+// and checks that reopening recovers every complete write and that writes after the truncation survive another reopen.
+func TestStoreTornWrite(t *testing.T) {
+	tails := map[string]func(frame []byte) []byte{
+		"partial header":  func(frame []byte) []byte { return frame[:frameHeaderLen-1] },
+		"partial payload": func(frame []byte) []byte { return frame[:len(frame)-1] },
+		"bad checksum": func(frame []byte) []byte {
+			frame = append([]byte(nil), frame...)
+			frame[len(frame)-1] ^= 0xff
+			return frame
+		},
+		"oversized length": func(frame []byte) []byte {
+			frame = append([]byte(nil), frame...)
+			binary.BigEndian.PutUint32(frame, 1<<30)
+			return frame
+		},
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStore(t, dir)
+			want := make(map[int]string)
+			for i := 0; i < 200; i++ {
+				v := string(rune('a' + i%26))
+				if err := s.Put(i, v); err != nil {
+					t.Fatal(err)
+				}
+				want[i] = v
+			}
+			for i := 0; i < 200; i += 3 {
+				if _, err := s.Delete(i); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, i)
+			}
+			body, err := s.encode(opPut, 1000, new(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := append(binary.AppendUvarint(nil, s.seq+1), body...)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			ids, err := walSegments(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) < 2 {
+				t.Fatalf("got %d log segments; want several", len(ids))
+			}
+			last := walPath(dir, ids[len(ids)-1])
+			before, err := os.Stat(last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tail(walFrame(payload))); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			s = openTestStore(t, dir)
+			checkStore(t, s, want)
+			if after, err := os.Stat(last); err != nil {
+				t.Fatal(err)
+			} else if after.Size() != before.Size() {
+				t.Fatalf("segment is %d bytes after recovery; want the torn tail truncated to %d", after.Size(), before.Size())
+			}
+			for i := 500; i < 600; i++ {
+				if err := s.Put(i, "new"); err != nil {
+					t.Fatal(err)
+				}
+				want[i] = "new"
+			}
+			if _, err := s.Delete(1); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, 1)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openTestStore(t, dir)
+			defer s.Close()
+			checkStore(t, s, want)
+		})
+	}
+}
+
+// walFrame frames payload the way wal.append does.
+func walFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+// failingFile writes only half of the next frame and fails, as a full disk would. If truncateErr is set, cutting the
+// torn frame off fails too.
+type failingFile struct {
+	segmentFile
+	fail        bool
+	truncateErr error
+}
+
+var errDiskFull = errors.New("no space left on device")
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if !f.fail {
+		return f.segmentFile.Write(p)
+	}
+	f.fail = false
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errDiskFull
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.truncateErr != nil {
+		return f.truncateErr
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+// TestStoreFailedWrite checks that a write that fails half-way is cut off the log, so the writes acknowledged after it
+// survive recovery, and that a log whose torn frame cannot be removed refuses further writes.
+func TestStoreFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	want := map[int]string{}
+	for i := 0; i < 10; i++ {
+		if err := s.Put(i, "before"); err != nil {
+			t.Fatal(err)
+		}
+		want[i] = "before"
+	}
+	f := &failingFile{segmentFile: s.log.f, fail: true}
+	s.log.f = f
+	if err := s.Put(100, "lost"); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Put on a full disk = %v; want errDiskFull", err)
+	}
+	for i := 10; i < 20; i++ {
+		if err := s.Put(i, "after"); err != nil {
+			t.Fatal(err)
+		}
+		want[i] = "after"
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, dir)
+	checkStore(t, s, want)
+
+	f = &failingFile{segmentFile: s.log.f, fail: true, truncateErr: errors.New("read-only file system")}
+	s.log.f = f
+	if err := s.Put(100, "lost"); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Put on a full disk = %v; want errDiskFull", err)
+	}
+	if err := s.Put(101, "refused"); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Put after an irreparable torn frame = %v; want the original error", err)
+	}
+	s.Close()
+	// The torn frame is still there, but it is the last one, so recovery truncates it and loses nothing acknowledged.
+	s = openTestStore(t, dir)
+	defer s.Close()
+	checkStore(t, s, want)
+}
+
+// TestStoreCheckpoint recovers from a checkpoint followed by more log entries, and checks that the checkpoint dropped
+// the segments it covers and that a Snapshot ignores later writes.
+func TestStoreCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	want := map[int]string{}
+	for i := 0; i < 300; i++ {
+		if err := s.Put(i, "v1"); err != nil {
+			t.Fatal(err)
+		}
+		want[i] = "v1"
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	snap := s.Snapshot()
+	ids, err := walSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("%d log segments after a checkpoint; want only the new one", len(ids))
+	}
+
+	// After the checkpoint: overwrite, delete, and add keys, across several segments.
+	for i := 0; i < 300; i += 2 {
+		if err := s.Put(i, "v2"); err != nil {
+			t.Fatal(err)
+		}
+		want[i] = "v2"
+	}
+	for i := 0; i < 300; i += 5 {
+		if _, err := s.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, i)
+	}
+	for i := 300; i < 400; i++ {
+		if err := s.Put(i, "v3"); err != nil {
+			t.Fatal(err)
+		}
+		want[i] = "v3"
+	}
+	if snap.Len() != 300 {
+		t.Fatalf("snapshot has %d keys after later writes; want 300", snap.Len())
+	}
+	if v, _ := snap.Get(0); v != "v1" {
+		t.Fatalf("snapshot Get(0) = %q after later writes; want v1", v)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, dir)
+	checkStore(t, s, want)
+	// A second checkpoint replaces the first.
+	if err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	seqs, err := s.checkpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 1 || seqs[0] != s.seq {
+		t.Fatalf("checkpoints = %v; want only the one at %d", seqs, s.seq)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, dir)
+	defer s.Close()
+	checkStore(t, s, want)
+}
@@ -0,0 +1,161 @@
+package databases
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// TestSyncTreeConcurrentBatches runs writers applying batches over disjoint key ranges alongside readers, and checks
+// the red-black invariants after every batch. Run it with -race.
+func TestSyncTreeConcurrentBatches(t *testing.T) {
+	const (
+		writers   = 8
+		readers   = 4
+		batches   = 200
+		batchSize = 32
+		keySpace  = 256
+	)
+	s := NewSyncTree(NewOrdered[int, int]())
+
+	// Each writer owns the keys [w*keySpace, (w+1)*keySpace) and keeps its own model of them, so the final contents
+	// can be checked without ordering the writers.
+	models := make([]map[int]int, writers)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	for w := 0; w < writers; w++ {
+		models[w] = make(map[int]int)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			model := models[w]
+			var b Batch[int, int]
+			for i := 0; i < batches; i++ {
+				b.Reset()
+				for j := 0; j < batchSize; j++ {
+					key := w*keySpace + rng.Intn(keySpace)
+					if rng.Intn(3) == 0 {
+						b.Delete(key)
+						delete(model, key)
+					} else {
+						b.Put(key, i)
+						model[key] = i
+					}
+				}
+				s.Apply(&b)
+				if err := s.Validate(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var rg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		rg.Add(1)
+		go func(r int) {
+			defer rg.Done()
+			rng := rand.New(rand.NewSource(int64(100 + r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s.Get(rng.Intn(writers * keySpace))
+				var err error
+				prev, n := -1, 0
+				s.Ascend(func(key, value int) bool {
+					if key <= prev {
+						err = fmt.Errorf("Ascend yielded %d after %d", key, prev)
+						return false
+					}
+					prev = key
+					n++
+					return true
+				})
+				if err == nil && n > writers*keySpace {
+					err = fmt.Errorf("Ascend yielded %d keys; at most %d exist", n, writers*keySpace)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(done)
+	rg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	want := 0
+	for w, model := range models {
+		want += len(model)
+		for key, value := range model {
+			got, ok := s.Get(key)
+			if !ok || got != value {
+				t.Fatalf("writer %d: Get(%d) = %d, %v; want %d, true", w, key, got, ok, value)
+			}
+		}
+	}
+	if s.Len() != want {
+		t.Fatalf("Len() = %d; want %d", s.Len(), want)
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncTreeApplyIsAtomic checks that readers never observe a batch half applied.
+func TestSyncTreeApplyIsAtomic(t *testing.T) {
+	const keys = 64
+	s := NewSyncTree(NewOrdered[int, int]())
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var b Batch[int, int]
+		for gen := 1; gen <= 500; gen++ {
+			b.Reset()
+			for k := 0; k < keys; k++ {
+				b.Put(k, gen)
+			}
+			s.Apply(&b)
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+			return
+		default:
+		}
+		first, n := -1, 0
+		s.Ascend(func(key, value int) bool {
+			if first < 0 {
+				first = value
+			}
+			if value != first {
+				t.Errorf("key %d has generation %d; key 0 has %d", key, value, first)
+				return false
+			}
+			n++
+			return true
+		})
+		if n != 0 && n != keys {
+			t.Fatalf("saw %d keys; want 0 or %d", n, keys)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bulkhead is a type that represents a single bulkhead. It wraps an http.Handler and lets at most Capacity requests
+// run it at a time; a bounded number of further requests wait for a slot, and the rest are turned away with 503 so an
+// overloaded bulkhead cannot take the rest of the server down with it.
+type Bulkhead struct {
+	handler  http.Handler
+	settings BulkheadSettings
+
+	// sem holds a slot for every request being handled and a queue place for every request waiting for one
+	sem *semaphore
+
+	// pool runs the handler when the bulkhead is Pooled
+	pool *WorkerPool[struct{}]
+}
+
+// BulkheadSettings configures a Bulkhead.
+type BulkheadSettings struct {
+	// Capacity is the maximum number of requests that the bulkhead can handle at a time. Defaults to 10.
+	Capacity int
+	// QueueSize is the number of requests that may wait for a slot once the bulkhead is full. Zero rejects them at once.
+	QueueSize int
+	// MaxQueueTime is how long a request may wait for a slot before it is rejected. Defaults to 1s.
+	MaxQueueTime time.Duration
+	// RetryAfter is the delay suggested to rejected clients. Defaults to 1s.
+	RetryAfter time.Duration
+	// Pooled runs the handler on Capacity worker goroutines owned by the bulkhead instead of on the goroutines of the
+	// requests themselves. Call Close to stop them.
+	Pooled bool
+}
+
+// NewBulkhead creates a new bulkhead in front of handler
+func NewBulkhead(s BulkheadSettings, handler http.Handler) *Bulkhead {
+	if s.Capacity <= 0 {
+		s.Capacity = 10
+	}
+	if s.MaxQueueTime <= 0 {
+		s.MaxQueueTime = time.Second
+	}
+	if s.RetryAfter <= 0 {
+		s.RetryAfter = time.Second
+	}
+	b := &Bulkhead{
+		handler:  handler,
+		settings: s,
+		sem: &semaphore{
+			slots:   make(chan struct{}, s.Capacity),
+			queue:   make(chan struct{}, s.QueueSize),
+			maxWait: s.MaxQueueTime,
+		},
+	}
+	if s.Pooled {
+		// A request only reaches the pool once it holds a slot, so a queue the size of the pool always has room
+		b.pool = NewWorkerPool[struct{}](s.Capacity, s.Capacity)
+	}
+	return b
+}
+
+// ServeHTTP runs the wrapped handler once a slot is free, or answers 503 with Retry-After if none frees up in time
+func (b *Bulkhead) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if b.sem.acquire(r.Context()) != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int((b.settings.RetryAfter+time.Second-1)/time.Second)))
+		http.Error(w, "bulkhead full", http.StatusServiceUnavailable)
+		return
+	}
+	// Free the slot when the handler returns, even if it panics
+	defer b.sem.release()
+	b.serve(w, r)
+}
+
+// serve runs the wrapped handler for a request that holds a slot, on one of the bulkhead's workers if it is Pooled. A
+// panic in the handler is raised again on the request's goroutine, where net/http expects it.
+func (b *Bulkhead) serve(w http.ResponseWriter, r *http.Request) {
+	if b.pool == nil {
+		b.handler.ServeHTTP(w, r)
+		return
+	}
+	result, err := b.pool.Submit(r.Context(), func(ctx context.Context) (struct{}, error) {
+		b.handler.ServeHTTP(w, r.WithContext(ctx))
+		return struct{}{}, nil
+	})
+	if err != nil {
+		// The bulkhead has been closed
+		http.Error(w, "bulkhead closed", http.StatusServiceUnavailable)
+		return
+	}
+	var perr *PanicError
+	if res := <-result; errors.As(res.Err, &perr) {
+		panic(perr.Value)
+	}
+}
+
+// Close stops the workers of a Pooled bulkhead once the requests they are handling are done, or cancels those requests
+// if ctx is done first. Requests that arrive afterwards are answered with 503. Close does nothing for a bulkhead that
+// is not Pooled.
+func (b *Bulkhead) Close(ctx context.Context) error {
+	if b.pool == nil {
+		return nil
+	}
+	return b.pool.Shutdown(ctx)
+}
+
+// InFlight returns the number of requests being handled
+func (b *Bulkhead) InFlight() int {
+	return len(b.sem.slots)
+}
+
+// Queued returns the number of requests waiting for a slot
+func (b *Bulkhead) Queued() int {
+	return len(b.sem.queue)
+}
@@ -0,0 +1,335 @@
+// Package resilience protects callers from dependencies that fail or slow down, and servers from the callers that
+// overload them.
+package resilience
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State is the state of a CircuitBreaker.
+//
+//	closed ──(trip policy trips)───────────────► open ──(open timeout elapsed)──► half-open
+//	  ▲                                           ▲                                  │
+//	  └──────(HalfOpenMaxRequests successes)──────┼────────────(any failure)─────────┘
+type State int
+
+const (
+	// StateClosed lets every request through and feeds their outcomes to the trip policy.
+	StateClosed State = iota
+	// StateOpen rejects every request until the open timeout has elapsed.
+	StateOpen
+	// StateHalfOpen lets a limited number of trial requests through to find out whether the service has recovered.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Clock tells the breaker the time. Tests inject a fake clock to move through the states without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Settings configures a CircuitBreaker.
+type Settings struct {
+	// Threshold is the number of consecutive failures that opens the circuit when no Policy is set. Defaults to 5.
+	Threshold int
+	// Policy decides when a closed circuit opens. Defaults to ConsecutiveFailures(Threshold).
+	Policy TripPolicy
+	// SlowCallDuration is the duration above which a call recorded with Record counts as slow. Zero means no call is
+	// slow.
+	SlowCallDuration time.Duration
+	// OpenTimeout is how long the circuit stays open before it lets trial requests through. Defaults to 60s.
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the number of trial requests allowed in the half-open state. The circuit closes once
+	// that many have succeeded. Defaults to 1.
+	HalfOpenMaxRequests int
+	// Clock defaults to the system clock.
+	Clock Clock
+	// IsFailure decides which errors returned through Execute count against the circuit; the rest are passed back to
+	// the caller but recorded as successes. Defaults to counting every error. Context deadline errors always count;
+	// calls cancelled by their caller are not recorded at all.
+	IsFailure func(err error) bool
+	// OnStateChange, if set, is called after every state transition. It runs without the breaker's lock held, so it
+	// may call back into the breaker, but transitions made by different goroutines can be reported concurrently.
+	OnStateChange func(from, to State)
+	// Shared, if set, makes the breaker act as one with the breakers of other replicas that share the same Name: a
+	// trip on any replica opens the circuit on all of them within about SyncInterval, and only one replica at a time
+	// sends the half-open trial requests. If the backend is unreachable the breaker carries on with its local state.
+	// Replicas' clocks are assumed to be roughly in sync.
+	Shared SharedState
+	// Name identifies the circuit in Shared. It is required when Shared is set.
+	Name string
+	// SyncInterval is how often the breaker reads the shared state. Defaults to 1s.
+	SyncInterval time.Duration
+	// OnSharedStateError, if set, is called with every error from Shared. Reads and writes of the shared state happen
+	// in the background, so this and Metrics.SharedStateErrors are the only places such errors show up.
+	OnSharedStateError func(err error)
+}
+
+// CircuitBreaker monitors the calls to a service and stops making them while the service is failing. Its TripPolicy
+// decides from the outcomes of recent calls when to open the circuit; once OpenTimeout has passed it lets
+// HalfOpenMaxRequests trial calls through and closes the circuit again if they all succeed.
+//
+// A call asks AllowRequest first and reports its outcome with the generation AllowRequest returned. The generation
+// changes with every state change, so the outcome of a call let through in an earlier state is ignored: a slow call
+// admitted while the circuit was closed cannot close it again once it is half-open.
+type CircuitBreaker struct {
+	settings Settings
+
+	lock       sync.Mutex
+	state      State
+	generation uint64    // incremented on every state change
+	openedAt   time.Time // when the circuit last opened
+	trials     int       // trial requests let through while half-open
+	successes  int       // trial requests that succeeded while half-open
+	metrics    Metrics   // TimeInState excludes the time since stateSince
+	stateSince time.Time // when the circuit entered its current state
+	changes    []stateChange
+
+	owner      string       // identifies this breaker to Shared
+	lastSync   time.Time    // when the shared state was last read
+	syncing    bool         // a read of the shared state is in flight
+	probing    bool         // this replica holds the half-open probe lease
+	pending    *publication // the latest state change not yet written to the shared state
+	publishing bool         // a write to the shared state is in flight
+}
+
+type stateChange struct {
+	from, to State
+}
+
+// Metrics are the running totals of a CircuitBreaker since it was created. Successes, Failures and SlowCalls count
+// every outcome reported to the breaker, including those from an earlier generation that no longer change its state;
+// abandoned calls are not counted.
+type Metrics struct {
+	Successes  uint64
+	Failures   uint64
+	Rejections uint64 // requests AllowRequest turned away
+	SlowCalls  uint64
+	// SharedStateErrors counts failed reads and writes of Settings.Shared.
+	SharedStateErrors uint64
+	// TimeInState is the total time spent in each state, indexed by State.
+	TimeInState [3]time.Duration
+}
+
+// NewCircuitBreaker creates a closed circuit breaker.
+func NewCircuitBreaker(s Settings) *CircuitBreaker {
+	if s.Threshold <= 0 {
+		s.Threshold = 5
+	}
+	if s.OpenTimeout <= 0 {
+		s.OpenTimeout = 60 * time.Second
+	}
+	if s.HalfOpenMaxRequests <= 0 {
+		s.HalfOpenMaxRequests = 1
+	}
+	if s.Clock == nil {
+		s.Clock = realClock{}
+	}
+	if s.Policy == nil {
+		s.Policy = ConsecutiveFailures(s.Threshold)
+	}
+	if s.IsFailure == nil {
+		s.IsFailure = func(err error) bool { return err != nil }
+	}
+	if s.SyncInterval <= 0 {
+		s.SyncInterval = time.Second
+	}
+	cb := &CircuitBreaker{settings: s, stateSince: s.Clock.Now()}
+	if s.Shared != nil {
+		if s.Name == "" {
+			panic("circuit breaker: Name is required with Shared")
+		}
+		var id [8]byte
+		rand.Read(id[:])
+		cb.owner = hex.EncodeToString(id[:])
+	}
+	return cb
+}
+
+// unlock releases cb.lock and then reports the state changes made while it was held.
+func (cb *CircuitBreaker) unlock() {
+	changes := cb.changes
+	cb.changes = nil
+	cb.lock.Unlock()
+	for _, c := range changes {
+		cb.settings.OnStateChange(c.from, c.to)
+	}
+}
+
+// Metrics returns a snapshot of the breaker's counters. Like State, it changes nothing: an open circuit whose timeout
+// has elapsed is counted as half-open from the moment the timeout elapsed.
+func (cb *CircuitBreaker) Metrics() Metrics {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	now := cb.settings.Clock.Now()
+	m := cb.metrics
+	since, state := cb.stateSince, cb.stateAt(now)
+	if state != cb.state {
+		halfOpenAt := cb.openedAt.Add(cb.settings.OpenTimeout)
+		m.TimeInState[cb.state] += halfOpenAt.Sub(since)
+		since = halfOpenAt
+	}
+	m.TimeInState[state] += now.Sub(since)
+	return m
+}
+
+// State returns the current state of the circuit.
+func (cb *CircuitBreaker) State() State {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.stateAt(cb.settings.Clock.Now())
+}
+
+// stateAt returns the state of the circuit at now, counting an open circuit whose timeout has elapsed as half-open
+// even before advance has moved it there. It changes nothing, so reading the state has no side effects. cb.lock must
+// be held.
+func (cb *CircuitBreaker) stateAt(now time.Time) State {
+	if cb.state == StateOpen && now.Sub(cb.openedAt) >= cb.settings.OpenTimeout {
+		return StateHalfOpen
+	}
+	return cb.state
+}
+
+// advance moves an open circuit to half-open once the open timeout has elapsed, dating the transition to when the
+// timeout elapsed rather than to when it was noticed. cb.lock must be held.
+func (cb *CircuitBreaker) advance() {
+	if cb.stateAt(cb.settings.Clock.Now()) != cb.state {
+		cb.setState(StateHalfOpen, cb.openedAt.Add(cb.settings.OpenTimeout))
+	}
+}
+
+// setState switches to state at the given time, starts a new generation and resets the counters that belong to the old
+// state. cb.lock must be held.
+func (cb *CircuitBreaker) setState(state State, at time.Time) {
+	cb.changeState(state, at, false)
+}
+
+// changeState is setState for transitions that may have been adopted from the shared state, which are not written back
+// to it. cb.lock must be held.
+func (cb *CircuitBreaker) changeState(state State, at time.Time, remote bool) {
+	cb.metrics.TimeInState[cb.state] += at.Sub(cb.stateSince)
+	if cb.settings.OnStateChange != nil {
+		cb.changes = append(cb.changes, stateChange{cb.state, state})
+	}
+	cb.state, cb.stateSince = state, at
+	cb.generation++
+	cb.trials, cb.successes, cb.probing = 0, 0, false
+	if state == StateClosed {
+		cb.settings.Policy.Reset()
+	}
+	if state == StateOpen {
+		cb.openedAt = at
+	}
+	if cb.settings.Shared != nil && !remote && state != StateHalfOpen {
+		cb.pending = &publication{state, cb.openedAt.Add(cb.settings.OpenTimeout)}
+		cb.maybePublish()
+	}
+}
+
+// AllowRequest reports whether a call may go ahead. A closed circuit lets every call through, an open one none, and a
+// half-open one only HalfOpenMaxRequests trial calls. The returned generation must be passed to RecordSuccess or
+// RecordFailure once the call is done, or to Abandon if it ended without an outcome.
+func (cb *CircuitBreaker) AllowRequest() (generation uint64, ok bool) {
+	cb.lock.Lock()
+	defer cb.unlock()
+	cb.advance()
+	cb.maybeSync()
+	switch cb.state {
+	case StateOpen:
+		// Circuit is open, do not allow requests
+		cb.metrics.Rejections++
+		return cb.generation, false
+	case StateHalfOpen:
+		// Only a limited number of trial requests may probe the service, and with shared state only from the
+		// replica holding the probe lease
+		if cb.trials >= cb.settings.HalfOpenMaxRequests || cb.settings.Shared != nil && !cb.probing {
+			cb.metrics.Rejections++
+			return cb.generation, false
+		}
+		cb.trials++
+		return cb.generation, true
+	}
+	// Circuit is closed, allow requests
+	return cb.generation, true
+}
+
+// RecordFailure reports that a call AllowRequest let through in generation failed. Outcomes from an earlier
+// generation are ignored.
+func (cb *CircuitBreaker) RecordFailure(generation uint64) {
+	cb.Record(generation, true, 0)
+}
+
+// RecordSuccess reports that a call AllowRequest let through in generation succeeded. Outcomes from an earlier
+// generation are ignored.
+func (cb *CircuitBreaker) RecordSuccess(generation uint64) {
+	cb.Record(generation, false, 0)
+}
+
+// Record reports the outcome of a call that AllowRequest let through in generation, together with how long it took so
+// the trip policy can account for slow calls. Outcomes from an earlier generation are ignored.
+func (cb *CircuitBreaker) Record(generation uint64, failed bool, elapsed time.Duration) {
+	cb.lock.Lock()
+	defer cb.unlock()
+	slow := cb.settings.SlowCallDuration > 0 && elapsed > cb.settings.SlowCallDuration
+	if failed {
+		cb.metrics.Failures++
+	} else {
+		cb.metrics.Successes++
+	}
+	if slow {
+		cb.metrics.SlowCalls++
+	}
+	if generation != cb.generation {
+		return
+	}
+	now := cb.settings.Clock.Now()
+	switch cb.state {
+	case StateClosed:
+		cb.settings.Policy.Record(now, failed, slow)
+		if cb.settings.Policy.ShouldTrip(now) {
+			// Open the circuit
+			cb.setState(StateOpen, now)
+		}
+	case StateHalfOpen:
+		if failed {
+			// The service has not recovered, open the circuit again
+			cb.setState(StateOpen, now)
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.settings.HalfOpenMaxRequests {
+			// Close the circuit
+			cb.setState(StateClosed, now)
+		}
+	}
+}
+
+// Abandon reports that a call AllowRequest let through in generation ended without telling anything about the service,
+// for example because its caller cancelled it. The call counts neither way; if it was a half-open trial, its slot is
+// freed for another one.
+func (cb *CircuitBreaker) Abandon(generation uint64) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if generation == cb.generation && cb.state == StateHalfOpen && cb.trials > 0 {
+		cb.trials--
+	}
+}
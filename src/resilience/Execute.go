@@ -0,0 +1,70 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Execute when the breaker rejects the call without running it.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Execute runs fn if the breaker allows it and records the outcome. A rejected call returns ErrCircuitOpen. A panic in
+// fn is recorded as a failure and then re-raised. A call that fails with context.Canceled is not recorded, since its
+// caller gave up on it rather than the service failing it.
+func Execute[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error)) (T, error) {
+	return ExecuteWithFallback(ctx, cb, fn, nil)
+}
+
+// ExecuteWithFallback is like Execute, but when the call is rejected or returns an error it returns what fallback
+// makes of that error instead. A nil fallback behaves like Execute.
+func ExecuteWithFallback[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error),
+	fallback func(ctx context.Context, err error) (T, error)) (T, error) {
+	var (
+		v   T
+		err error
+	)
+	if generation, ok := cb.AllowRequest(); ok {
+		v, err = run(ctx, cb, generation, fn)
+	} else {
+		err = ErrCircuitOpen
+	}
+	if err != nil && fallback != nil {
+		return fallback(ctx, err)
+	}
+	return v, err
+}
+
+// Do runs fn through the breaker like Execute, for calls that only return an error.
+func (cb *CircuitBreaker) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	_, err := Execute(ctx, cb, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// run calls fn and records how it went. AllowRequest must have let the call through in generation.
+func run[T any](ctx context.Context, cb *CircuitBreaker, generation uint64,
+	fn func(ctx context.Context) (T, error)) (T, error) {
+	start := cb.settings.Clock.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			cb.Record(generation, true, cb.settings.Clock.Now().Sub(start))
+			panic(r)
+		}
+	}()
+	v, err := fn(ctx)
+	cb.finish(generation, err, cb.settings.Clock.Now().Sub(start))
+	return v, err
+}
+
+// finish records a call that ended with err after elapsed. It is the one rule for classifying outcomes: a cancelled
+// call is abandoned, a deadline error is a failure, and any other error is a failure if IsFailure says so.
+func (cb *CircuitBreaker) finish(generation uint64, err error, elapsed time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		cb.Abandon(generation)
+		return
+	}
+	failed := errors.Is(err, context.DeadlineExceeded) || (err != nil && cb.settings.IsFailure(err))
+	cb.Record(generation, failed, elapsed)
+}
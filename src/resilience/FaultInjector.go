@@ -0,0 +1,401 @@
+package resilience
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes JSON as a string such as "150ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"150ms\": %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Scenario scripts the faults a FaultInjector injects, as a sequence of phases. It is usually loaded from a JSON file
+// with LoadScenario:
+//
+//	{
+//	  "seed": 1,
+//	  "phases": [
+//	    {"name": "healthy", "requests": 20, "latency": {"dist": "normal", "mean": "20ms", "stddev": "5ms"}},
+//	    {"name": "outage", "duration": "30s", "error_rate": 0.8, "reset_rate": 0.2},
+//	    {"name": "recovery", "requests": 50, "partial_rate": 0.05}
+//	  ]
+//	}
+type Scenario struct {
+	// Seed makes the injected faults repeatable. Zero seeds from the time.
+	Seed int64 `json:"seed"`
+	// Loop restarts the scenario after its last phase instead of staying in it.
+	Loop   bool    `json:"loop"`
+	Phases []Phase `json:"phases"`
+}
+
+// Phase is one step of a Scenario. It lasts for Duration or for Requests requests, whichever is set; with both set it
+// ends at whichever comes first.
+type Phase struct {
+	Name     string   `json:"name"`
+	Duration Duration `json:"duration"`
+	Requests int      `json:"requests"`
+	Fault
+}
+
+// Fault is what goes wrong during a phase. The rates are the fractions of requests affected, and at most one of error,
+// reset and partial response happens to a request.
+type Fault struct {
+	Latency Latency `json:"latency"`
+	// ErrorRate of requests are answered with Status, 500 by default, instead of reaching the service.
+	ErrorRate float64 `json:"error_rate"`
+	Status    int     `json:"status"`
+	// ResetRate of requests have their connection reset.
+	ResetRate float64 `json:"reset_rate"`
+	// PartialRate of requests get a response whose body is cut off halfway.
+	PartialRate float64 `json:"partial_rate"`
+}
+
+// Latency is the distribution of the delay added to each request. Dist is one of "fixed" (Mean), "uniform" (Min to
+// Max), "normal" (Mean and StdDev) or "exponential" (Mean); an empty Dist adds no delay.
+type Latency struct {
+	Dist   string   `json:"dist"`
+	Mean   Duration `json:"mean"`
+	StdDev Duration `json:"stddev"`
+	Min    Duration `json:"min"`
+	Max    Duration `json:"max"`
+}
+
+// LoadScenario reads and validates a scenario file.
+func LoadScenario(path string) (Scenario, error) {
+	var s Scenario
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Validate reports the first problem with the scenario.
+func (s Scenario) Validate() error {
+	if len(s.Phases) == 0 {
+		return errors.New("scenario has no phases")
+	}
+	for i, p := range s.Phases {
+		where := fmt.Sprintf("phases[%d]", i)
+		if p.Name != "" {
+			where += fmt.Sprintf(" (%s)", p.Name)
+		}
+		if p.Duration <= 0 && p.Requests <= 0 && (i < len(s.Phases)-1 || s.Loop) {
+			return fmt.Errorf("%s: needs a duration or a number of requests", where)
+		}
+		for _, r := range []struct {
+			name string
+			rate float64
+		}{{"error_rate", p.ErrorRate}, {"reset_rate", p.ResetRate}, {"partial_rate", p.PartialRate}} {
+			if r.rate < 0 || r.rate > 1 {
+				return fmt.Errorf("%s: %s must be between 0 and 1, got %g", where, r.name, r.rate)
+			}
+		}
+		if sum := p.ErrorRate + p.ResetRate + p.PartialRate; sum > 1 {
+			return fmt.Errorf("%s: error_rate, reset_rate and partial_rate add up to %g, more than 1", where, sum)
+		}
+		if p.Status != 0 && (p.Status < 100 || p.Status > 599) {
+			return fmt.Errorf("%s: status %d is not an HTTP status code", where, p.Status)
+		}
+		switch l := p.Latency; l.Dist {
+		case "":
+		case "fixed", "exponential":
+			if l.Mean <= 0 {
+				return fmt.Errorf("%s: %s latency needs a positive mean", where, l.Dist)
+			}
+		case "normal":
+			if l.Mean <= 0 || l.StdDev < 0 {
+				return fmt.Errorf("%s: normal latency needs a positive mean and a non-negative stddev", where)
+			}
+		case "uniform":
+			if l.Min < 0 || l.Max < l.Min {
+				return fmt.Errorf("%s: uniform latency needs 0 <= min <= max", where)
+			}
+		default:
+			return fmt.Errorf("%s: unknown latency distribution %q", where, l.Dist)
+		}
+	}
+	return nil
+}
+
+// FaultInjector injects the faults of a Scenario into HTTP traffic, either in front of a server with Handler or in
+// front of a client's transport with RoundTripper, to test how CircuitBreaker and friends hold up.
+type FaultInjector struct {
+	scenario Scenario
+	clock    Clock
+
+	lock       sync.Mutex
+	rand       *mathrand.Rand
+	phase      int
+	phaseStart time.Time
+	served     int // requests seen in the current phase
+}
+
+// NewFaultInjector starts scenario, or returns the error Validate finds in it. clock defaults to the system clock.
+func NewFaultInjector(scenario Scenario, clock Clock) (*FaultInjector, error) {
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	seed := scenario.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultInjector{
+		scenario:   scenario,
+		clock:      clock,
+		rand:       mathrand.New(mathrand.NewSource(seed)),
+		phaseStart: clock.Now(),
+	}, nil
+}
+
+type faultKind int
+
+const (
+	faultNone faultKind = iota
+	faultError
+	faultReset
+	faultPartial
+)
+
+type injection struct {
+	delay  time.Duration
+	kind   faultKind
+	status int
+}
+
+// Phase returns the name of the current phase.
+func (f *FaultInjector) Phase() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.advance()
+	return f.scenario.Phases[f.phase].Name
+}
+
+// advance moves past the phases that have ended. f.lock must be held.
+func (f *FaultInjector) advance() {
+	now := f.clock.Now()
+	for {
+		p := f.scenario.Phases[f.phase]
+		timeUp := p.Duration > 0 && now.Sub(f.phaseStart) >= time.Duration(p.Duration)
+		countUp := p.Requests > 0 && f.served >= p.Requests
+		if !timeUp && !countUp {
+			return
+		}
+		if f.phase == len(f.scenario.Phases)-1 && !f.scenario.Loop {
+			return
+		}
+		f.phase = (f.phase + 1) % len(f.scenario.Phases)
+		f.served = 0
+		if timeUp {
+			f.phaseStart = f.phaseStart.Add(time.Duration(p.Duration))
+		} else {
+			f.phaseStart = now
+		}
+	}
+}
+
+// next decides what happens to the next request.
+func (f *FaultInjector) next() injection {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.advance()
+	p := f.scenario.Phases[f.phase]
+	f.served++
+
+	var in injection
+	switch l := p.Latency; l.Dist {
+	case "fixed":
+		in.delay = time.Duration(l.Mean)
+	case "uniform":
+		in.delay = time.Duration(l.Min) + time.Duration(f.rand.Float64()*float64(l.Max-l.Min))
+	case "normal":
+		in.delay = time.Duration(f.rand.NormFloat64()*float64(l.StdDev) + float64(l.Mean))
+	case "exponential":
+		in.delay = time.Duration(f.rand.ExpFloat64() * float64(l.Mean))
+	}
+	if in.delay < 0 {
+		in.delay = 0
+	}
+	switch r := f.rand.Float64(); {
+	case r < p.ErrorRate:
+		in.kind, in.status = faultError, p.Status
+		if in.status == 0 {
+			in.status = http.StatusInternalServerError
+		}
+	case r < p.ErrorRate+p.ResetRate:
+		in.kind = faultReset
+	case r < p.ErrorRate+p.ResetRate+p.PartialRate:
+		in.kind = faultPartial
+	}
+	return in
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Handler injects faults in front of next. A reset closes the client's connection without a response, and a partial
+// response promises the full body in Content-Length but closes the connection halfway through it.
+func (f *FaultInjector) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := f.next()
+		if sleep(r.Context(), in.delay) != nil {
+			return
+		}
+		switch in.kind {
+		case faultError:
+			http.Error(w, "injected fault", in.status)
+		case faultReset:
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					if tcp, ok := conn.(*net.TCPConn); ok {
+						// Make Close send a RST instead of a FIN.
+						tcp.SetLinger(0)
+					}
+					conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		case faultPartial:
+			buf := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+			next.ServeHTTP(buf, r)
+			for k, v := range buf.header {
+				w.Header()[k] = v
+			}
+			body := buf.body.Bytes()
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(buf.status)
+			w.Write(body[:len(body)/2])
+			if fl, ok := w.(http.Flusher); ok {
+				fl.Flush()
+			}
+			panic(http.ErrAbortHandler)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// bufferedResponse collects a handler's response so that only part of it can be sent on.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+// RoundTripper injects faults in front of next, which defaults to http.DefaultTransport. A reset fails the request with
+// ECONNRESET without sending it, and a partial response reads the real body but ends it halfway with
+// io.ErrUnexpectedEOF. Requests that never reach next have their body closed, as the RoundTripper contract requires.
+func (f *FaultInjector) RoundTripper(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		in := f.next()
+		if err := sleep(req.Context(), in.delay); err != nil {
+			closeBody(req)
+			return nil, err
+		}
+		switch in.kind {
+		case faultError:
+			closeBody(req)
+			body := "injected fault\n"
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", in.status, http.StatusText(in.status)),
+				StatusCode:    in.status,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:          io.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}, nil
+		case faultReset:
+			closeBody(req)
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+		}
+		resp, err := next.RoundTrip(req)
+		if err != nil || in.kind != faultPartial {
+			return resp, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errReader{io.ErrUnexpectedEOF}))
+		return resp, nil
+	})
+}
+
+// closeBody closes the body of a request that is answered without being sent.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,215 @@
+package resilience
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter caps the number of requests in flight to a dependency at a limit that a LimitAlgorithm keeps adjusting from
+// the latencies it observes. Where a CircuitBreaker only reacts once calls fail, a Limiter throttles a dependency as it
+// slows down. It gates calls like a breaker: AllowRequest before the call, Record after it.
+type Limiter struct {
+	algorithm LimitAlgorithm
+
+	lock     sync.Mutex
+	inFlight int
+}
+
+// LimitAlgorithm computes a Limiter's concurrency limit. The limiter calls it with its lock held.
+type LimitAlgorithm interface {
+	// Limit returns the current limit.
+	Limit() int
+	// Update adjusts the limit after a call that took rtt with inFlight calls outstanding. dropped reports that the
+	// call failed or timed out, which every algorithm treats as a sign of overload.
+	Update(rtt time.Duration, inFlight int, dropped bool)
+}
+
+// NewLimiter creates a limiter driven by algorithm.
+func NewLimiter(algorithm LimitAlgorithm) *Limiter {
+	return &Limiter{algorithm: algorithm}
+}
+
+// AllowRequest reports whether another call may start. Every call it allows must be finished with Record.
+func (l *Limiter) AllowRequest() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.inFlight >= l.algorithm.Limit() {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+// Record finishes a call that AllowRequest let through and feeds its latency to the algorithm.
+func (l *Limiter) Record(failed bool, elapsed time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.algorithm.Update(elapsed, l.inFlight, failed)
+	l.inFlight--
+}
+
+// Limit returns the current concurrency limit.
+func (l *Limiter) Limit() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.algorithm.Limit()
+}
+
+// InFlight returns the number of calls in flight.
+func (l *Limiter) InFlight() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.inFlight
+}
+
+// LimitSettings bounds the limit of every LimitAlgorithm.
+type LimitSettings struct {
+	// Initial is the limit to start from. Defaults to 20.
+	Initial int
+	// Min is the lowest the limit can go. Defaults to 1.
+	Min int
+	// Max is the highest the limit can go. Defaults to 1000.
+	Max int
+}
+
+func (s LimitSettings) withDefaults() LimitSettings {
+	if s.Min <= 0 {
+		s.Min = 1
+	}
+	if s.Max <= 0 {
+		s.Max = 1000
+	}
+	if s.Initial <= 0 {
+		s.Initial = 20
+	}
+	if s.Initial < s.Min {
+		s.Initial = s.Min
+	}
+	if s.Initial > s.Max {
+		s.Initial = s.Max
+	}
+	return s
+}
+
+func (s LimitSettings) clamp(limit float64) float64 {
+	return math.Max(float64(s.Min), math.Min(float64(s.Max), limit))
+}
+
+// NewAIMD returns an additive-increase/multiplicative-decrease algorithm: the limit grows by one after each successful
+// call that was made while the limiter was at least half full, and shrinks by backoff (0.9 if zero) after a dropped
+// call or one slower than timeout (no timeout if zero).
+func NewAIMD(s LimitSettings, backoff float64, timeout time.Duration) LimitAlgorithm {
+	s = s.withDefaults()
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+	return &aimd{settings: s, limit: float64(s.Initial), backoff: backoff, timeout: timeout}
+}
+
+type aimd struct {
+	settings LimitSettings
+	limit    float64
+	backoff  float64
+	timeout  time.Duration
+}
+
+func (a *aimd) Limit() int { return int(a.limit) }
+
+func (a *aimd) Update(rtt time.Duration, inFlight int, dropped bool) {
+	switch {
+	case dropped || (a.timeout > 0 && rtt > a.timeout):
+		a.limit = a.settings.clamp(a.limit * a.backoff)
+	case 2*inFlight >= int(a.limit):
+		// Only grow a limit that is actually being used.
+		a.limit = a.settings.clamp(a.limit + 1)
+	}
+}
+
+// NewGradient returns an algorithm that scales the limit by the ratio of the unloaded latency to the latest one, so the
+// limit shrinks as soon as latency climbs above the tolerated level and grows back, with headroom of sqrt(limit) for
+// queueing, while it stays below. The unloaded latency is the lowest seen over a window of recent calls, so it follows
+// a dependency whose baseline latency changes for good.
+func NewGradient(s LimitSettings) LimitAlgorithm {
+	s = s.withDefaults()
+	return &gradient{settings: s, limit: float64(s.Initial)}
+}
+
+// Gradient tuning, after Netflix's concurrency-limits.
+const (
+	gradientTolerance = 1.5 // how far latency may rise above the unloaded latency before the limit shrinks
+	gradientSmoothing = 0.2 // weight of each new estimate in the limit
+	gradientWindow    = 600 // number of calls the unloaded latency is measured over
+)
+
+type gradient struct {
+	settings LimitSettings
+	limit    float64
+	minRTT   time.Duration // lowest latency of the previous window and the current one
+	nextMin  time.Duration // lowest latency of the current window
+	samples  int           // calls in the current window
+}
+
+func (g *gradient) Limit() int { return int(g.limit) }
+
+func (g *gradient) Update(rtt time.Duration, inFlight int, dropped bool) {
+	if rtt <= 0 {
+		return
+	}
+	if g.minRTT == 0 || rtt < g.minRTT {
+		g.minRTT = rtt
+	}
+	if g.nextMin == 0 || rtt < g.nextMin {
+		g.nextMin = rtt
+	}
+	if g.samples++; g.samples == gradientWindow {
+		g.minRTT, g.nextMin, g.samples = g.nextMin, 0, 0
+	}
+	grad := 0.5
+	if !dropped {
+		if 2*inFlight < int(g.limit) {
+			// An underused limit says nothing about how far it could grow.
+			return
+		}
+		grad = math.Max(0.5, math.Min(1, gradientTolerance*float64(g.minRTT)/float64(rtt)))
+	}
+	next := g.limit*grad + math.Sqrt(g.limit)
+	g.limit = g.settings.clamp(g.limit*(1-gradientSmoothing) + next*gradientSmoothing)
+}
+
+// NewVegas returns an algorithm modelled on TCP Vegas. It estimates how many calls are queued at the dependency from
+// how far the latency has risen above the lowest seen, grows the limit while the queue is short and shrinks it once the
+// queue gets long or a call is dropped.
+func NewVegas(s LimitSettings) LimitAlgorithm {
+	s = s.withDefaults()
+	return &vegas{settings: s, limit: float64(s.Initial)}
+}
+
+type vegas struct {
+	settings LimitSettings
+	limit    float64
+	minRTT   time.Duration // latency with no queueing, estimated as the lowest seen
+}
+
+func (v *vegas) Limit() int { return int(v.limit) }
+
+func (v *vegas) Update(rtt time.Duration, inFlight int, dropped bool) {
+	if rtt <= 0 {
+		return
+	}
+	if v.minRTT == 0 || rtt < v.minRTT {
+		v.minRTT = rtt
+	}
+	step := math.Max(1, math.Log10(v.limit))
+	if dropped {
+		v.limit = v.settings.clamp(v.limit - step)
+		return
+	}
+	queue := v.limit * (1 - float64(v.minRTT)/float64(rtt))
+	switch {
+	case queue >= 6*step:
+		v.limit = v.settings.clamp(v.limit - step)
+	case queue <= 3*step && 2*inFlight >= int(v.limit):
+		v.limit = v.settings.clamp(v.limit + step)
+	}
+}
@@ -0,0 +1,37 @@
+package resilience
+
+import (
+	"net/http"
+	"time"
+)
+
+// LoadBalancer is a type that distributes requests to different bulkheads
+type LoadBalancer struct {
+	// bulkheads is a slice of all the bulkheads managed by the load balancer
+	bulkheads []*Bulkhead
+
+	// picker chooses among bulkheads
+	picker Picker
+}
+
+// NewLoadBalancer creates a new load balancer that sends each request to the least loaded of the given bulkheads
+func NewLoadBalancer(bulkheads []*Bulkhead) *LoadBalancer {
+	return NewLoadBalancerWithPicker(bulkheads, NewLeastOutstanding())
+}
+
+// NewLoadBalancerWithPicker creates a new load balancer that lets picker choose among the given bulkheads
+func NewLoadBalancerWithPicker(bulkheads []*Bulkhead, picker Picker) *LoadBalancer {
+	return &LoadBalancer{
+		bulkheads: bulkheads,
+		picker:    picker,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface, allowing the load balancer to act as an HTTP server
+func (l *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Let the picker choose a bulkhead and tell it how the request went
+	i := l.picker.Pick(r, l.bulkheads)
+	start := time.Now()
+	defer func() { l.picker.Done(i, time.Since(start)) }()
+	l.bulkheads[i].ServeHTTP(w, r)
+}
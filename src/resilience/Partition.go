@@ -0,0 +1,179 @@
+package resilience
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Route picks the partition a request belongs to, or reports false to leave the request to the next route
+type Route func(r *http.Request) (partition string, ok bool)
+
+// PathPrefix routes requests whose path starts with prefix to partition
+func PathPrefix(prefix, partition string) Route {
+	return func(r *http.Request) (string, bool) {
+		return partition, strings.HasPrefix(r.URL.Path, prefix)
+	}
+}
+
+// HeaderValue routes requests to the partition named by their header, such as a tenant ID that has a partition of its
+// own
+func HeaderValue(header string) Route {
+	return func(r *http.Request) (string, bool) {
+		v := r.Header.Get(header)
+		return v, v != ""
+	}
+}
+
+// HeaderKey returns the value of header, for use as the key of ConsistentHash
+func HeaderKey(header string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// ConsistentHash routes requests to one of partitions by a hash of key(r), so requests with the same key always share a
+// partition and adding or removing a partition only moves the keys next to it on the ring. Each partition is placed on
+// the ring replicas times (100 if zero) to even out the split. Requests with an empty key are left to the next route.
+func ConsistentHash(key func(r *http.Request) string, partitions []string, replicas int) Route {
+	ring := newHashRing(partitions, replicas)
+	return func(r *http.Request) (string, bool) {
+		i := ring.lookup(key(r))
+		if i < 0 {
+			return "", false
+		}
+		return partitions[i], true
+	}
+}
+
+// hashRing is a consistent hash ring over a list of named nodes
+type hashRing []ringPoint
+
+type ringPoint struct {
+	hash uint64
+	node int // index of the node in the list the ring was built from
+}
+
+// newHashRing places each node on the ring replicas times, 100 if zero
+func newHashRing(nodes []string, replicas int) hashRing {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	ring := make(hashRing, 0, len(nodes)*replicas)
+	for i, n := range nodes {
+		for j := 0; j < replicas; j++ {
+			ring = append(ring, ringPoint{hashKey(n + "#" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// hashKey hashes s with FNV-1a and then mixes the bits with MurmurHash3's finalizer, since FNV alone, like CRC, maps
+// similar strings such as "node#1" and "node#2" to nearby values and would bunch each node's points on the ring
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// lookup returns the node that owns key, or -1 for an empty key or ring
+func (ring hashRing) lookup(key string) int {
+	if key == "" || len(ring) == 0 {
+		return -1
+	}
+	h := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+// Partitioning configures a PartitionRouter
+type Partitioning struct {
+	// Partitions are the bulkheads by name; each has its own capacity, so one partition filling up does not affect the
+	// others. Pooled bulkheads also give each partition its own worker goroutines.
+	Partitions map[string]*Bulkhead
+	// Routes are tried in order; the first that names an existing partition wins
+	Routes []Route
+	// Default is the partition for requests no route claims. Without one they are rejected with 503.
+	Default string
+	// Overflow, if set, is a pool shared by all partitions that takes requests a full partition would otherwise
+	// queue. The partition's handler still serves them, on the request's own goroutine since the partition's workers
+	// are busy.
+	Overflow *Bulkhead
+}
+
+// PartitionRouter is an http.Handler that sends every request to the bulkhead of its partition, so a noisy tenant or
+// endpoint can only use up its own partition's capacity
+type PartitionRouter struct {
+	partitions map[string]*Bulkhead
+	routes     []Route
+	overflow   *Bulkhead
+}
+
+// NewPartitionRouter creates a router over the partitions of p. It fails if there are no partitions, if one of them
+// has no bulkhead or handler, or if Default names a partition that does not exist.
+func NewPartitionRouter(p Partitioning) (*PartitionRouter, error) {
+	if len(p.Partitions) == 0 {
+		return nil, errors.New("no partitions")
+	}
+	for name, b := range p.Partitions {
+		if b == nil || b.handler == nil {
+			return nil, fmt.Errorf("partition %q: need a bulkhead with a handler", name)
+		}
+	}
+	if _, ok := p.Partitions[p.Default]; p.Default != "" && !ok {
+		return nil, fmt.Errorf("default partition %q does not exist", p.Default)
+	}
+	l := &PartitionRouter{partitions: p.Partitions, routes: p.Routes, overflow: p.Overflow}
+	if p.Default != "" {
+		l.routes = append(l.routes[:len(l.routes):len(l.routes)], func(*http.Request) (string, bool) {
+			return p.Default, true
+		})
+	}
+	return l, nil
+}
+
+// ServeHTTP passes the request to the bulkhead of the partition the first matching route names, or to the overflow
+// pool if that bulkhead is full. Requests no route claims are rejected with 503.
+func (l *PartitionRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b *Bulkhead
+	for _, route := range l.routes {
+		if name, ok := route(r); ok {
+			if b, ok = l.partitions[name]; ok {
+				break
+			}
+		}
+	}
+	if b == nil {
+		http.Error(w, "no partition for request", http.StatusServiceUnavailable)
+		return
+	}
+	if l.overflow == nil {
+		b.ServeHTTP(w, r)
+		return
+	}
+	switch {
+	case b.sem.tryAcquire():
+		defer b.sem.release()
+		b.serve(w, r)
+	case l.overflow.sem.tryAcquire():
+		defer l.overflow.sem.release()
+		b.handler.ServeHTTP(w, r)
+	default:
+		// Both are full, so wait in the partition's own queue
+		b.ServeHTTP(w, r)
+	}
+}
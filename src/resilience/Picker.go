@@ -0,0 +1,325 @@
+package resilience
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Picker is a load-balancing strategy: it chooses which of the bulkheads of a LoadBalancer or Proxy serves each
+// request. A picker is used for one fixed list of bulkheads and must be safe for concurrent use.
+type Picker interface {
+	// Pick returns the index in bulkheads of the bulkhead that should serve r
+	Pick(r *http.Request, bulkheads []*Bulkhead) int
+	// Done reports that a request picked for bulkheads[i] finished after elapsed
+	Done(i int, elapsed time.Duration)
+}
+
+// load is the number of requests a bulkhead is handling or holding in its queue
+func load(b *Bulkhead) int {
+	return b.InFlight() + b.Queued()
+}
+
+// roundRobin takes turns through the bulkheads
+type roundRobin struct {
+	next uint64
+}
+
+// NewRoundRobin returns a picker that takes turns through the bulkheads
+func NewRoundRobin() Picker {
+	return &roundRobin{}
+}
+
+func (p *roundRobin) Pick(_ *http.Request, bulkheads []*Bulkhead) int {
+	return int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(bulkheads)))
+}
+
+func (p *roundRobin) Done(int, time.Duration) {}
+
+// weightedRoundRobin is nginx's smooth weighted round-robin, which interleaves the turns of heavy bulkheads with the
+// light ones instead of sending each its whole share in a burst
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+	total   int
+}
+
+// NewWeightedRoundRobin returns a picker that gives bulkheads[i] weights[i] turns out of every sum(weights). Bulkheads
+// without a weight get 1.
+func NewWeightedRoundRobin(weights []int) Picker {
+	return &weightedRoundRobin{weights: weights}
+}
+
+func (p *weightedRoundRobin) Pick(_ *http.Request, bulkheads []*Bulkhead) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.current) != len(bulkheads) {
+		p.current = make([]int, len(bulkheads))
+		p.total = 0
+		for i := range bulkheads {
+			p.total += p.weight(i)
+		}
+	}
+	best := 0
+	for i := range p.current {
+		p.current[i] += p.weight(i)
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.total
+	return best
+}
+
+func (p *weightedRoundRobin) weight(i int) int {
+	if i < len(p.weights) && p.weights[i] > 0 {
+		return p.weights[i]
+	}
+	return 1
+}
+
+func (p *weightedRoundRobin) Done(int, time.Duration) {}
+
+// pickerRand is a locked random source shared by the randomized pickers, seeded since math/rand's global source is not
+// before Go 1.20
+var pickerRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// twoRandom returns two distinct random indexes below n, which must be at least 2
+func twoRandom(n int) (int, int) {
+	pickerRand.Lock()
+	defer pickerRand.Unlock()
+	i := pickerRand.Intn(n)
+	j := pickerRand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
+
+// powerOfTwoChoices picks the less loaded of two random bulkheads
+type powerOfTwoChoices struct{}
+
+// NewPowerOfTwoChoices returns a picker that samples two bulkheads at random and takes the less loaded one. It spreads
+// load almost as evenly as scanning every bulkhead, without the scan, and does not herd every request onto the
+// bulkhead that happens to look idlest.
+func NewPowerOfTwoChoices() Picker {
+	return powerOfTwoChoices{}
+}
+
+func (powerOfTwoChoices) Pick(_ *http.Request, bulkheads []*Bulkhead) int {
+	if len(bulkheads) == 1 {
+		return 0
+	}
+	i, j := twoRandom(len(bulkheads))
+	if load(bulkheads[j]) < load(bulkheads[i]) {
+		return j
+	}
+	return i
+}
+
+func (powerOfTwoChoices) Done(int, time.Duration) {}
+
+// leastOutstanding picks the bulkhead with the fewest requests in flight or queued
+type leastOutstanding struct {
+	start uint64
+}
+
+// NewLeastOutstanding returns a picker that picks the bulkhead with the fewest requests in flight or queued. Ties go to
+// the bulkheads in turn rather than always to the first.
+func NewLeastOutstanding() Picker {
+	return &leastOutstanding{}
+}
+
+func (p *leastOutstanding) Pick(_ *http.Request, bulkheads []*Bulkhead) int {
+	n := len(bulkheads)
+	start := int((atomic.AddUint64(&p.start, 1) - 1) % uint64(n))
+	best, bestLoad := start, load(bulkheads[start])
+	for k := 1; k < n; k++ {
+		i := (start + k) % n
+		if l := load(bulkheads[i]); l < bestLoad {
+			best, bestLoad = i, l
+		}
+	}
+	return best
+}
+
+func (p *leastOutstanding) Done(int, time.Duration) {}
+
+// ewma picks by a moving average of each bulkhead's latency
+type ewma struct {
+	decay time.Duration
+
+	mu      sync.Mutex
+	latency []float64   // moving average latency in nanoseconds, 0 until the first sample
+	updated []time.Time // when latency was last updated
+}
+
+// NewEWMA returns a picker that keeps an exponentially weighted moving average of each bulkhead's latency, decaying
+// with a time constant of decay (10s if zero), and samples two bulkheads at random, taking the one whose average
+// latency times its outstanding requests is lower. A bulkhead that slows down quickly loses traffic to the others.
+func NewEWMA(decay time.Duration) Picker {
+	if decay <= 0 {
+		decay = 10 * time.Second
+	}
+	return &ewma{decay: decay}
+}
+
+func (p *ewma) Pick(_ *http.Request, bulkheads []*Bulkhead) int {
+	if len(bulkheads) == 1 {
+		return 0
+	}
+	i, j := twoRandom(len(bulkheads))
+	p.mu.Lock()
+	p.grow(len(bulkheads))
+	li, lj := p.latency[i], p.latency[j]
+	p.mu.Unlock()
+	// Unmeasured bulkheads cost nothing, so each gets tried
+	if lj*float64(load(bulkheads[j])+1) < li*float64(load(bulkheads[i])+1) {
+		return j
+	}
+	return i
+}
+
+// grow makes room for n bulkheads. p.mu must be held.
+func (p *ewma) grow(n int) {
+	for len(p.latency) < n {
+		p.latency = append(p.latency, 0)
+		p.updated = append(p.updated, time.Time{})
+	}
+}
+
+func (p *ewma) Done(i int, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.grow(i + 1)
+	now := time.Now()
+	if p.updated[i].IsZero() {
+		p.latency[i] = float64(elapsed)
+	} else {
+		// Weigh the old average by how recently it was updated, so a bulkhead that sees little traffic still follows
+		// its latest samples
+		w := math.Exp(-float64(now.Sub(p.updated[i])) / float64(p.decay))
+		p.latency[i] = p.latency[i]*w + float64(elapsed)*(1-w)
+	}
+	p.updated[i] = now
+}
+
+// ringHash picks by a consistent hash of a request key
+type ringHash struct {
+	key      func(r *http.Request) string
+	replicas int
+	fallback roundRobin
+
+	mu   sync.Mutex
+	ring hashRing
+	n    int // number of bulkheads ring was built for
+}
+
+// NewRingHash returns a picker that sends requests with the same key(r), such as a session ID, to the same bulkhead,
+// using a consistent hash ring with replicas points per bulkhead (100 if zero). Requests with an empty key are spread
+// round-robin.
+func NewRingHash(key func(r *http.Request) string, replicas int) Picker {
+	return &ringHash{key: key, replicas: replicas}
+}
+
+func (p *ringHash) Pick(r *http.Request, bulkheads []*Bulkhead) int {
+	p.mu.Lock()
+	if p.n != len(bulkheads) {
+		p.ring, p.n = newHashRing(nodeNames(len(bulkheads)), p.replicas), len(bulkheads)
+	}
+	ring := p.ring
+	p.mu.Unlock()
+	if i := ring.lookup(p.key(r)); i >= 0 {
+		return i
+	}
+	return p.fallback.Pick(r, bulkheads)
+}
+
+func (p *ringHash) Done(int, time.Duration) {}
+
+// nodeNames names n bulkheads by their index, for hashing
+func nodeNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "bulkhead-" + strconv.Itoa(i)
+	}
+	return names
+}
+
+// maglevTableSize is the size of a Maglev lookup table. It must be prime and should be well above 100 times the number
+// of bulkheads for an even split.
+const maglevTableSize = 65537
+
+// maglev picks by Google's Maglev consistent hashing
+type maglev struct {
+	key      func(r *http.Request) string
+	fallback roundRobin
+
+	mu    sync.Mutex
+	table []int // bulkhead index for each slot
+	n     int   // number of bulkheads table was built for
+}
+
+// NewMaglev returns a picker that, like NewRingHash, sends requests with the same key(r) to the same bulkhead, using a
+// Maglev lookup table: each bulkhead gets an almost exactly equal share of keys, and a lookup is one hash and an index.
+// Requests with an empty key are spread round-robin.
+func NewMaglev(key func(r *http.Request) string) Picker {
+	return &maglev{key: key}
+}
+
+func (p *maglev) Pick(r *http.Request, bulkheads []*Bulkhead) int {
+	p.mu.Lock()
+	if p.n != len(bulkheads) {
+		p.table, p.n = maglevTable(nodeNames(len(bulkheads))), len(bulkheads)
+	}
+	table := p.table
+	p.mu.Unlock()
+	k := p.key(r)
+	if k == "" {
+		return p.fallback.Pick(r, bulkheads)
+	}
+	return table[hashKey(k)%maglevTableSize]
+}
+
+func (p *maglev) Done(int, time.Duration) {}
+
+// maglevTable fills the lookup table by letting the nodes take turns claiming their next preferred free slot, each
+// node's preference order being a permutation derived from two hashes of its name
+func maglevTable(nodes []string) []int {
+	const m = maglevTableSize
+	offset := make([]uint64, len(nodes))
+	skip := make([]uint64, len(nodes))
+	next := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		h := hashKey(n)
+		offset[i] = (h >> 32) % m
+		skip[i] = (h&0xffffffff)%(m-1) + 1
+	}
+	table := make([]int, m)
+	for i := range table {
+		table[i] = -1
+	}
+	for filled := 0; filled < m; {
+		for i := range nodes {
+			c := (offset[i] + next[i]*skip[i]) % m
+			for table[c] >= 0 {
+				next[i]++
+				c = (offset[i] + next[i]*skip[i]) % m
+			}
+			table[c] = i
+			next[i]++
+			if filled++; filled == m {
+				break
+			}
+		}
+	}
+	return table
+}
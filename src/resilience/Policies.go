@@ -0,0 +1,538 @@
+package resilience
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PolicyFile is a JSON file that maps each dependency to the resilience settings calls to it go through, so they can be
+// tuned without a rebuild:
+//
+//	{
+//	  "dependencies": {
+//	    "payments": {
+//	      "timeout": "2s",
+//	      "breaker": {
+//	        "open_timeout": "30s",
+//	        "window": {"type": "count", "size": 50, "min_calls": 20, "failure_rate": 50}
+//	      },
+//	      "bulkhead": {"max_concurrent": 10, "queue_size": 20, "max_wait": "100ms"},
+//	      "retry": {"max_attempts": 3, "base_delay": "50ms", "jitter": "decorrelated", "budget_ratio": 0.1}
+//	    }
+//	  }
+//	}
+//
+// Every section is optional; a dependency without a breaker, bulkhead or retry section goes without one. Policy files
+// are JSON only; YAML is not supported, since the module has no YAML parser to build on.
+type PolicyFile struct {
+	Dependencies map[string]DependencyConfig `json:"dependencies"`
+}
+
+// DependencyConfig is the policy for one dependency.
+type DependencyConfig struct {
+	// Timeout bounds each attempt. Zero means no timeout.
+	Timeout  Duration        `json:"timeout"`
+	Breaker  *BreakerConfig  `json:"breaker"`
+	Bulkhead *BulkheadConfig `json:"bulkhead"`
+	Retry    *RetryConfig    `json:"retry"`
+}
+
+// BreakerConfig mirrors Settings. Without a window the breaker trips on Threshold consecutive failures.
+type BreakerConfig struct {
+	Threshold           int           `json:"threshold"`
+	OpenTimeout         Duration      `json:"open_timeout"`
+	HalfOpenMaxRequests int           `json:"half_open_max_requests"`
+	SlowCallDuration    Duration      `json:"slow_call_duration"`
+	Window              *WindowConfig `json:"window"`
+}
+
+// WindowConfig selects a CountWindow ("count", over Size calls) or a TimeWindow ("time", over Duration split into
+// Buckets) trip policy.
+type WindowConfig struct {
+	Type         string   `json:"type"`
+	Size         int      `json:"size"`
+	Duration     Duration `json:"duration"`
+	Buckets      int      `json:"buckets"`
+	MinCalls     int      `json:"min_calls"`
+	FailureRate  float64  `json:"failure_rate"`
+	SlowCallRate float64  `json:"slow_call_rate"`
+}
+
+// BulkheadConfig caps the calls in flight to a dependency at MaxConcurrent and lets up to QueueSize more wait for
+// MaxWait, or for as long as their context allows if MaxWait is zero. A call that cannot start fails with
+// ErrBulkheadFull.
+type BulkheadConfig struct {
+	MaxConcurrent int      `json:"max_concurrent"`
+	QueueSize     int      `json:"queue_size"`
+	MaxWait       Duration `json:"max_wait"`
+}
+
+// Settings returns the BulkheadSettings of a Bulkhead sized like the config. A zero MaxWait becomes the Bulkhead's
+// default queue time.
+func (c *BulkheadConfig) Settings() BulkheadSettings {
+	return BulkheadSettings{
+		Capacity:     c.MaxConcurrent,
+		QueueSize:    c.QueueSize,
+		MaxQueueTime: time.Duration(c.MaxWait),
+	}
+}
+
+// RetryConfig mirrors RetryPolicy. Jitter is "full" (the default) or "decorrelated". A positive BudgetRatio adds a
+// RetryBudget of that ratio holding up to BudgetCapacity retries, 10 by default.
+type RetryConfig struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	BaseDelay      Duration `json:"base_delay"`
+	MaxDelay       Duration `json:"max_delay"`
+	Jitter         string   `json:"jitter"`
+	BudgetRatio    float64  `json:"budget_ratio"`
+	BudgetCapacity int      `json:"budget_capacity"`
+}
+
+// PolicyError lists every problem found in a policy file, one per line, each prefixed with the path of the offending
+// field.
+type PolicyError []string
+
+func (e PolicyError) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// ParsePolicyFile decodes and validates a policy file. Syntax and type errors carry the line and column they were found
+// at; unknown fields are rejected so that a misspelt setting does not silently fall back to its default, and so is
+// anything after the policy object, such as a second object left over from a bad merge.
+func ParsePolicyFile(data []byte) (*PolicyFile, error) {
+	var f PolicyFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		var (
+			syntaxErr *json.SyntaxError
+			typeErr   *json.UnmarshalTypeError
+		)
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, fmt.Errorf("%s: %w", position(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return nil, fmt.Errorf("%s: %s: expected %s, got %s", position(data, typeErr.Offset), typeErr.Field,
+				typeErr.Type, typeErr.Value)
+		}
+		return nil, fmt.Errorf("%s: %w", position(data, dec.InputOffset()), err)
+	}
+	// dec.More alone misses a stray closing brace, so make sure the next token is the end of the input.
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		end += int64(len(data[end:]) - len(bytes.TrimLeft(data[end:], " \t\r\n")))
+		return nil, fmt.Errorf("%s: unexpected data after the policy object", position(data, end))
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// position formats a byte offset into data as line:column.
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// Validate checks every dependency's settings and returns a PolicyError listing all the problems, or nil.
+func (f *PolicyFile) Validate() error {
+	var errs PolicyError
+	bad := func(path, format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	names := make([]string, 0, len(f.Dependencies))
+	for name := range f.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := f.Dependencies[name]
+		path := "dependencies." + name
+		if name == "" {
+			bad(path, "dependency name must not be empty")
+		}
+		if d.Timeout < 0 {
+			bad(path+".timeout", "must not be negative")
+		}
+		if b := d.Breaker; b != nil {
+			path := path + ".breaker"
+			if b.Threshold < 0 {
+				bad(path+".threshold", "must not be negative")
+			}
+			if b.OpenTimeout < 0 {
+				bad(path+".open_timeout", "must not be negative")
+			}
+			if b.HalfOpenMaxRequests < 0 {
+				bad(path+".half_open_max_requests", "must not be negative")
+			}
+			if b.SlowCallDuration < 0 {
+				bad(path+".slow_call_duration", "must not be negative")
+			}
+			if w := b.Window; w != nil {
+				path := path + ".window"
+				switch w.Type {
+				case "count":
+					if w.Size <= 0 {
+						bad(path+".size", "must be positive for a count window")
+					}
+				case "time":
+					if w.Duration <= 0 {
+						bad(path+".duration", "must be positive for a time window")
+					}
+					if w.Buckets <= 0 {
+						bad(path+".buckets", "must be positive for a time window")
+					} else if w.Duration > 0 && time.Duration(w.Duration)/time.Duration(w.Buckets) <= 0 {
+						bad(path+".buckets", "%d buckets are more than %s can be split into", w.Buckets,
+							time.Duration(w.Duration))
+					}
+				default:
+					bad(path+".type", "must be \"count\" or \"time\", got %q", w.Type)
+				}
+				if w.MinCalls < 0 {
+					bad(path+".min_calls", "must not be negative")
+				}
+				if w.FailureRate < 0 || w.FailureRate > 100 {
+					bad(path+".failure_rate", "must be a percentage between 0 and 100, got %g", w.FailureRate)
+				}
+				if w.SlowCallRate < 0 || w.SlowCallRate > 100 {
+					bad(path+".slow_call_rate", "must be a percentage between 0 and 100, got %g", w.SlowCallRate)
+				}
+				if w.FailureRate == 0 && w.SlowCallRate == 0 {
+					bad(path, "needs a failure_rate or a slow_call_rate, or it can never trip")
+				}
+				if w.SlowCallRate > 0 && b.SlowCallDuration == 0 {
+					bad(path+".slow_call_rate", "needs breaker.slow_call_duration to tell which calls are slow")
+				}
+			}
+		}
+		if b := d.Bulkhead; b != nil {
+			path := path + ".bulkhead"
+			if b.MaxConcurrent <= 0 {
+				bad(path+".max_concurrent", "must be positive")
+			}
+			if b.QueueSize < 0 {
+				bad(path+".queue_size", "must not be negative")
+			}
+			if b.MaxWait < 0 {
+				bad(path+".max_wait", "must not be negative")
+			} else if b.MaxWait > 0 && b.QueueSize == 0 {
+				bad(path+".max_wait", "has no effect without a queue_size")
+			}
+		}
+		if r := d.Retry; r != nil {
+			path := path + ".retry"
+			if r.MaxAttempts < 0 {
+				bad(path+".max_attempts", "must not be negative")
+			}
+			if r.BaseDelay < 0 {
+				bad(path+".base_delay", "must not be negative")
+			}
+			if r.MaxDelay < 0 {
+				bad(path+".max_delay", "must not be negative")
+			} else if r.MaxDelay > 0 && r.MaxDelay < r.BaseDelay {
+				bad(path+".max_delay", "%s is less than base_delay %s", time.Duration(r.MaxDelay),
+					time.Duration(r.BaseDelay))
+			}
+			if r.Jitter != "" && r.Jitter != "full" && r.Jitter != "decorrelated" {
+				bad(path+".jitter", "must be \"full\" or \"decorrelated\", got %q", r.Jitter)
+			}
+			if r.BudgetRatio < 0 {
+				bad(path+".budget_ratio", "must not be negative")
+			}
+			if r.BudgetCapacity < 0 {
+				bad(path+".budget_capacity", "must not be negative")
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ErrBulkheadFull is returned when a bulkhead has no room for a call within its max wait.
+var ErrBulkheadFull = errors.New("bulkhead is full")
+
+// Dependency is the resilience stack built from one dependency's policy. Calls go through it with Call.
+type Dependency struct {
+	Name     string
+	config   DependencyConfig
+	breaker  *CircuitBreaker // nil without a breaker section
+	bulkhead *semaphore      // nil without a bulkhead section
+	retry    *RetryPolicy    // nil without a retry section
+}
+
+// Breaker returns the dependency's circuit breaker, or nil if its policy has none.
+func (d *Dependency) Breaker() *CircuitBreaker {
+	return d.breaker
+}
+
+// InFlight returns the number of calls holding one of the dependency's bulkhead slots, or 0 if its policy has no
+// bulkhead.
+func (d *Dependency) InFlight() int {
+	if d.bulkhead == nil {
+		return 0
+	}
+	return len(d.bulkhead.slots)
+}
+
+// semaphore is the bulkhead of a Dependency: slots holds a token for every call in flight and queue one for every call
+// waiting for a slot.
+type semaphore struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	maxWait time.Duration
+}
+
+func newSemaphore(c *BulkheadConfig) *semaphore {
+	return &semaphore{
+		slots:   make(chan struct{}, c.MaxConcurrent),
+		queue:   make(chan struct{}, c.QueueSize),
+		maxWait: time.Duration(c.MaxWait),
+	}
+}
+
+// acquire takes a slot, queueing for one if all are taken and the queue is not full. It fails with ErrBulkheadFull if
+// it cannot queue or waits longer than maxWait, and with ctx's error if ctx is done first.
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s.tryAcquire() {
+		return nil
+	}
+	select {
+	case s.queue <- struct{}{}:
+		defer func() { <-s.queue }()
+	default:
+		return ErrBulkheadFull
+	}
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		timer := time.NewTimer(s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrBulkheadFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tryAcquire takes a slot if one is free right away
+func (s *semaphore) tryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot taken by acquire or tryAcquire
+func (s *semaphore) release() {
+	<-s.slots
+}
+
+// newDependency builds the stack for config. Parts whose settings did not change are taken over from prev, so a
+// reload keeps the breaker's state and the bulkhead's in-flight calls.
+func newDependency(name string, config DependencyConfig, prev *Dependency) *Dependency {
+	d := &Dependency{Name: name, config: config}
+	if b := config.Breaker; b != nil {
+		if prev != nil && prev.breaker != nil && reflect.DeepEqual(b, prev.config.Breaker) {
+			d.breaker = prev.breaker
+		} else {
+			s := Settings{
+				Threshold:           b.Threshold,
+				OpenTimeout:         time.Duration(b.OpenTimeout),
+				HalfOpenMaxRequests: b.HalfOpenMaxRequests,
+				SlowCallDuration:    time.Duration(b.SlowCallDuration),
+			}
+			if w := b.Window; w != nil {
+				rates := RateThresholds{MinCalls: w.MinCalls, FailureRate: w.FailureRate, SlowCallRate: w.SlowCallRate}
+				if w.Type == "time" {
+					s.Policy = TimeWindow(time.Duration(w.Duration), w.Buckets, rates)
+				} else {
+					s.Policy = CountWindow(w.Size, rates)
+				}
+			}
+			d.breaker = NewCircuitBreaker(s)
+		}
+	}
+	if b := config.Bulkhead; b != nil {
+		if prev != nil && prev.bulkhead != nil && reflect.DeepEqual(b, prev.config.Bulkhead) {
+			d.bulkhead = prev.bulkhead
+		} else {
+			d.bulkhead = newSemaphore(b)
+		}
+	}
+	if r := config.Retry; r != nil {
+		p := &RetryPolicy{
+			MaxAttempts: r.MaxAttempts,
+			BaseDelay:   time.Duration(r.BaseDelay),
+			MaxDelay:    time.Duration(r.MaxDelay),
+		}
+		if r.Jitter == "decorrelated" {
+			p.Jitter = DecorrelatedJitter
+		}
+		if r.BudgetRatio > 0 {
+			if prev != nil && prev.retry != nil && prev.retry.Budget != nil && reflect.DeepEqual(r, prev.config.Retry) {
+				p.Budget = prev.retry.Budget
+			} else {
+				capacity := r.BudgetCapacity
+				if capacity == 0 {
+					capacity = 10
+				}
+				p.Budget = NewRetryBudget(r.BudgetRatio, capacity)
+			}
+		}
+		breaker := d.breaker
+		p.Retryable = func(err error, idempotent bool) bool {
+			if errors.Is(err, ErrBulkheadFull) || (breaker != nil && breaker.State() == StateOpen) {
+				return false
+			}
+			return DefaultRetryable(err, idempotent)
+		}
+		d.retry = p
+	}
+	return d
+}
+
+// Call runs fn under d's policy: each attempt waits for a bulkhead slot, goes through the breaker and is bounded by
+// the timeout, and failed attempts are retried. idempotent is passed on to the retry policy.
+func Call[T any](ctx context.Context, d *Dependency, idempotent bool,
+	fn func(ctx context.Context) (T, error)) (T, error) {
+	attempt := func(ctx context.Context) (T, error) {
+		var zero T
+		if d.bulkhead != nil {
+			if err := d.bulkhead.acquire(ctx); err != nil {
+				return zero, err
+			}
+			defer d.bulkhead.release()
+		}
+		if d.config.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(d.config.Timeout))
+			defer cancel()
+		}
+		if d.breaker != nil {
+			return Execute(ctx, d.breaker, fn)
+		}
+		return fn(ctx)
+	}
+	if d.retry == nil {
+		return attempt(ctx)
+	}
+	return Retry(ctx, *d.retry, idempotent, attempt)
+}
+
+// Policies holds the live Dependency of every dependency in a policy file and swaps them when the file changes. A call
+// keeps the Dependency it started with, so a reload never disturbs calls in flight.
+type Policies struct {
+	path string
+	deps atomic.Value // map[string]*Dependency
+
+	reload  sync.Mutex // serializes reloads
+	modTime time.Time
+	size    int64
+}
+
+// LoadPolicies loads the policy file at path.
+func LoadPolicies(path string) (*Policies, error) {
+	p := &Policies{path: path}
+	p.deps.Store(map[string]*Dependency{})
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Get returns the current stack of the named dependency.
+func (p *Policies) Get(name string) (*Dependency, bool) {
+	d, ok := p.deps.Load().(map[string]*Dependency)[name]
+	return d, ok
+}
+
+// Reload reads the policy file again and swaps in its policies. If the file is invalid the current policies stay in
+// place and the error says why.
+func (p *Policies) Reload() error {
+	p.reload.Lock()
+	defer p.reload.Unlock()
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	f, err := ParsePolicyFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.path, err)
+	}
+	prev := p.deps.Load().(map[string]*Dependency)
+	deps := make(map[string]*Dependency, len(f.Dependencies))
+	for name, config := range f.Dependencies {
+		deps[name] = newDependency(name, config, prev[name])
+	}
+	p.deps.Store(deps)
+	p.modTime, p.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// Watch reloads the policies on SIGHUP and whenever the file's modification time or size changes, checking every
+// interval, until ctx is done. onReload, if not nil, is told the outcome of every reload.
+func (p *Policies) Watch(ctx context.Context, interval time.Duration, onReload func(err error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(p.path)
+			p.reload.Lock()
+			changed := err == nil && (!info.ModTime().Equal(p.modTime) || info.Size() != p.size)
+			p.reload.Unlock()
+			if !changed {
+				continue
+			}
+		}
+		err := p.Reload()
+		if onReload != nil {
+			onReload(err)
+		}
+		if err != nil {
+			// Do not report the same broken file on every tick.
+			if info, statErr := os.Stat(p.path); statErr == nil {
+				p.reload.Lock()
+				p.modTime, p.size = info.ModTime(), info.Size()
+				p.reload.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxySettings configures a Proxy
+type ProxySettings struct {
+	// Upstreams are the base URLs of the upstream servers
+	Upstreams []string
+	// Bulkhead configures the bulkhead each upstream gets
+	Bulkhead BulkheadSettings
+	// Picker chooses among the upstreams. Defaults to NewLeastOutstanding().
+	Picker Picker
+	// Transport carries the proxied requests and health checks. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// HealthCheckPath is requested on every upstream each HealthCheckInterval (10s by default); an upstream that does
+	// not answer it with a 2xx or 3xx within HealthCheckTimeout (2s by default) gets no traffic until it does. Empty
+	// disables active health checks.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+
+	// EjectAfter consecutive 5xx responses or transport errors eject an upstream for EjectionTime. Default to 5 and
+	// 30s.
+	EjectAfter   int
+	EjectionTime time.Duration
+
+	// Clock times ejections and the latencies reported to Picker. Defaults to the system clock.
+	Clock Clock
+}
+
+// upstream is one upstream server of a Proxy
+type upstream struct {
+	url *url.URL
+
+	// healthy is the result of the last active health check, 1 or 0
+	healthy int32
+
+	// mu guards failures and ejectedUntil
+	mu           sync.Mutex
+	failures     int       // consecutive failed responses
+	ejectedUntil time.Time // when a passive ejection ends
+}
+
+// available reports whether the upstream should get traffic
+func (u *upstream) available(now time.Time) bool {
+	if atomic.LoadInt32(&u.healthy) == 0 {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.ejectedUntil)
+}
+
+// record counts a proxied response toward passive outlier ejection
+func (u *upstream) record(failed bool, s ProxySettings) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !failed {
+		u.failures = 0
+		return
+	}
+	if u.failures++; u.failures >= s.EjectAfter {
+		u.failures = 0
+		u.ejectedUntil = s.Clock.Now().Add(s.EjectionTime)
+	}
+}
+
+// Proxy is an http.Handler that load-balances requests over upstream servers as a reverse proxy. Each upstream has its
+// own bulkhead, gets no traffic while its health check fails, and is ejected for a while after a run of failures.
+type Proxy struct {
+	// bulkheads has one bulkhead for each of upstreams, in front of the reverse proxy to it
+	bulkheads []*Bulkhead
+	upstreams []*upstream
+	settings  ProxySettings
+
+	// fallback chooses among the available upstreams when the picker's choice is not available
+	fallback leastOutstanding
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewProxy creates a reverse proxy over the upstream servers. Call Close to stop its health checks and bulkheads.
+func NewProxy(s ProxySettings) (*Proxy, error) {
+	if len(s.Upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	if s.Picker == nil {
+		s.Picker = NewLeastOutstanding()
+	}
+	if s.Transport == nil {
+		s.Transport = http.DefaultTransport
+	}
+	if s.HealthCheckInterval <= 0 {
+		s.HealthCheckInterval = 10 * time.Second
+	}
+	if s.HealthCheckTimeout <= 0 {
+		s.HealthCheckTimeout = 2 * time.Second
+	}
+	if s.EjectAfter <= 0 {
+		s.EjectAfter = 5
+	}
+	if s.EjectionTime <= 0 {
+		s.EjectionTime = 30 * time.Second
+	}
+	if s.Clock == nil {
+		s.Clock = realClock{}
+	}
+
+	p := &Proxy{settings: s, stop: make(chan struct{})}
+	for _, raw := range s.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", raw, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("upstream %q: need an absolute http or https URL", raw)
+		}
+		up := &upstream{url: u, healthy: 1}
+		p.upstreams = append(p.upstreams, up)
+		p.bulkheads = append(p.bulkheads, NewBulkhead(s.Bulkhead, p.reverseProxy(up)))
+	}
+	if s.HealthCheckPath != "" {
+		go p.healthCheck()
+	}
+	return p, nil
+}
+
+// reverseProxy forwards requests to up, adding the X-Forwarded-* headers and streaming the response back as it
+// arrives
+func (p *Proxy) reverseProxy(up *upstream) http.Handler {
+	rp := httputil.NewSingleHostReverseProxy(up.url)
+	direct := rp.Director
+	rp.Director = func(r *http.Request) {
+		// ReverseProxy appends the client address to X-Forwarded-For itself
+		r.Header.Set("X-Forwarded-Host", r.Host)
+		if r.TLS != nil {
+			r.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			r.Header.Set("X-Forwarded-Proto", "http")
+		}
+		direct(r)
+	}
+	rp.Transport = p.settings.Transport
+	rp.FlushInterval = -1
+	rp.ModifyResponse = func(resp *http.Response) error {
+		up.record(resp.StatusCode >= 500, p.settings)
+		return nil
+	}
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() == nil {
+			// A client that went away says nothing about the upstream
+			up.record(true, p.settings)
+		}
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}
+	return rp
+}
+
+// healthCheck probes every upstream each interval until Close
+func (p *Proxy) healthCheck() {
+	client := &http.Client{
+		Transport: p.settings.Transport,
+		Timeout:   p.settings.HealthCheckTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(p.settings.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, up := range p.upstreams {
+			wg.Add(1)
+			go func(up *upstream) {
+				defer wg.Done()
+				healthy := int32(0)
+				resp, err := client.Get(up.url.ResolveReference(&url.URL{Path: p.settings.HealthCheckPath}).String())
+				if err == nil {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode < 400 {
+						healthy = 1
+					}
+				}
+				atomic.StoreInt32(&up.healthy, healthy)
+			}(up)
+		}
+		wg.Wait()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the health checks and closes the bulkhead of every upstream, waiting for requests that pooled bulkheads
+// are handling until ctx is done. It returns the first error a bulkhead reports.
+func (p *Proxy) Close(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	var first error
+	for _, b := range p.bulkheads {
+		if err := b.Close(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ServeHTTP passes the request to the bulkhead of the upstream the picker chooses, or of another available upstream
+// if that one is unhealthy or ejected
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	picker, clock := p.settings.Picker, p.settings.Clock
+	now := clock.Now()
+	i := picker.Pick(r, p.bulkheads)
+	if !p.upstreams[i].available(now) {
+		i = p.repick(r, i, now)
+	}
+	start := clock.Now()
+	defer func() { picker.Done(i, clock.Now().Sub(start)) }()
+	p.bulkheads[i].ServeHTTP(w, r)
+}
+
+// repick chooses the least loaded of the available upstreams, taking tied ones in turn, so the traffic of an
+// unavailable upstream is spread over the rest instead of all landing on its neighbour. The picker itself is not asked
+// again since it keeps its state per position in the full list. If no upstream is available, picked is used anyway:
+// some chance of an answer beats none.
+func (p *Proxy) repick(r *http.Request, picked int, now time.Time) int {
+	var indexes []int
+	var bulkheads []*Bulkhead
+	for i, up := range p.upstreams {
+		if up.available(now) {
+			indexes = append(indexes, i)
+			bulkheads = append(bulkheads, p.bulkheads[i])
+		}
+	}
+	if len(indexes) == 0 {
+		return picked
+	}
+	return indexes[p.fallback.Pick(r, bulkheads)]
+}
@@ -0,0 +1,111 @@
+package resilience
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry names the circuit breakers of a process and serves their metrics to Prometheus.
+type Registry struct {
+	lock     sync.RWMutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{breakers: map[string]*CircuitBreaker{}}
+}
+
+// Register adds cb under name, which must not already be taken.
+func (r *Registry) Register(name string, cb *CircuitBreaker) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.breakers[name]; ok {
+		return fmt.Errorf("circuit breaker %q already registered", name)
+	}
+	r.breakers[name] = cb
+	return nil
+}
+
+// Unregister removes the breaker registered under name.
+func (r *Registry) Unregister(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.breakers, name)
+}
+
+// Get returns the breaker registered under name.
+func (r *Registry) Get(name string) (*CircuitBreaker, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	cb, ok := r.breakers[name]
+	return cb, ok
+}
+
+// ServeHTTP writes the state and metrics of every registered breaker in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.lock.RLock()
+	names := make([]string, 0, len(r.breakers))
+	for name := range r.breakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	breakers := make([]*CircuitBreaker, len(names))
+	for i, name := range names {
+		breakers[i] = r.breakers[name]
+	}
+	r.lock.RUnlock()
+
+	// The breakers are read without r.lock held, so that a state change hook that registers a breaker cannot
+	// deadlock against the scrape. Reading them changes nothing, so scrapes do not move a circuit to half-open.
+	states := make([]State, len(names))
+	metrics := make([]Metrics, len(names))
+	for i, cb := range breakers {
+		states[i], metrics[i] = cb.State(), cb.Metrics()
+	}
+
+	var b strings.Builder
+	family := func(name, typ, help string, sample func(i int, label string)) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for i, n := range names {
+			sample(i, `name="`+escapeLabel(n)+`"`)
+		}
+	}
+	family("circuit_breaker_state", "gauge", "Current state of the circuit: 0 closed, 1 open, 2 half-open.",
+		func(i int, label string) { fmt.Fprintf(&b, "circuit_breaker_state{%s} %d\n", label, states[i]) })
+	family("circuit_breaker_calls_total", "counter", "Calls recorded by the breaker, by result.",
+		func(i int, label string) {
+			fmt.Fprintf(&b, "circuit_breaker_calls_total{%s,result=\"success\"} %d\n", label, metrics[i].Successes)
+			fmt.Fprintf(&b, "circuit_breaker_calls_total{%s,result=\"failure\"} %d\n", label, metrics[i].Failures)
+		})
+	family("circuit_breaker_rejections_total", "counter", "Requests rejected because the circuit was not closed.",
+		func(i int, label string) {
+			fmt.Fprintf(&b, "circuit_breaker_rejections_total{%s} %d\n", label, metrics[i].Rejections)
+		})
+	family("circuit_breaker_slow_calls_total", "counter", "Calls that took longer than the slow call duration.",
+		func(i int, label string) {
+			fmt.Fprintf(&b, "circuit_breaker_slow_calls_total{%s} %d\n", label, metrics[i].SlowCalls)
+		})
+	family("circuit_breaker_shared_state_errors_total", "counter", "Failed reads and writes of the shared state.",
+		func(i int, label string) {
+			fmt.Fprintf(&b, "circuit_breaker_shared_state_errors_total{%s} %d\n", label, metrics[i].SharedStateErrors)
+		})
+	family("circuit_breaker_state_seconds_total", "counter", "Time spent in each state.",
+		func(i int, label string) {
+			for s, d := range metrics[i].TimeInState {
+				fmt.Fprintf(&b, "circuit_breaker_state_seconds_total{%s,state=\"%s\"} %g\n", label, State(s), d.Seconds())
+			}
+		})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
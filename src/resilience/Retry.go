@@ -0,0 +1,174 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"math"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Jitter spreads out the delays between retries so that callers that failed together do not retry together.
+type Jitter int
+
+const (
+	// FullJitter waits a random time between zero and the exponential backoff.
+	FullJitter Jitter = iota
+	// DecorrelatedJitter waits a random time between BaseDelay and three times the previous delay.
+	DecorrelatedJitter
+)
+
+// RetryPolicy configures Retry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first. Defaults to 3.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubling with every retry after it. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff. Defaults to 10s.
+	MaxDelay time.Duration
+	// Jitter defaults to FullJitter.
+	Jitter Jitter
+	// Retryable decides whether an error is worth another attempt. idempotent is the value passed to Retry. Defaults
+	// to DefaultRetryable.
+	Retryable func(err error, idempotent bool) bool
+	// Budget, if set, caps retries at a fraction of the calls going through it.
+	Budget *RetryBudget
+	// Breaker, if set, guards every attempt; retrying stops as soon as it opens.
+	Breaker *CircuitBreaker
+}
+
+// DefaultRetryable retries an idempotent call after any error, and any call after an error that shows its request was
+// never sent, such as a failed dial. Calls rejected by an open circuit are never retried.
+func DefaultRetryable(err error, idempotent bool) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return idempotent
+}
+
+// jitterRand is seeded once, since math/rand's global source is not seeded before Go 1.20.
+var jitterRand = struct {
+	sync.Mutex
+	*mathrand.Rand
+}{Rand: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+
+func randomDuration(lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	jitterRand.Lock()
+	defer jitterRand.Unlock()
+	return lo + time.Duration(jitterRand.Int63n(int64(hi-lo)))
+}
+
+// Retry calls fn until it succeeds, the policy runs out of attempts or budget, the error is not retryable, the breaker
+// opens or ctx is done, and returns the result of the last attempt. idempotent tells the policy whether repeating fn
+// is safe. Waits between attempts end early when ctx is done.
+func Retry[T any](ctx context.Context, p RetryPolicy, idempotent bool,
+	fn func(ctx context.Context) (T, error)) (T, error) {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 100 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 10 * time.Second
+	}
+	if p.Retryable == nil {
+		p.Retryable = DefaultRetryable
+	}
+	if p.Budget != nil {
+		p.Budget.deposit()
+	}
+
+	delay := p.BaseDelay
+	for attempt := 1; ; attempt++ {
+		var (
+			v   T
+			err error
+		)
+		if p.Breaker != nil {
+			v, err = Execute(ctx, p.Breaker, fn)
+		} else {
+			v, err = fn(ctx)
+		}
+		if err == nil || attempt == p.MaxAttempts || ctx.Err() != nil || !p.Retryable(err, idempotent) {
+			return v, err
+		}
+		if p.Breaker != nil && p.Breaker.State() == StateOpen {
+			return v, err
+		}
+		if p.Budget != nil && !p.Budget.withdraw() {
+			return v, err
+		}
+
+		delay = p.nextDelay(attempt, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return v, err
+		case <-timer.C:
+		}
+	}
+}
+
+// nextDelay returns how long to wait before retry number retry, counting from 1, given the wait before the previous
+// retry. The defaults must have been applied to p.
+func (p RetryPolicy) nextDelay(retry int, prev time.Duration) time.Duration {
+	if p.Jitter == DecorrelatedJitter {
+		// Cap 3*prev before multiplying, so a huge MaxDelay cannot make it overflow.
+		hi := p.MaxDelay
+		if prev <= p.MaxDelay/3 {
+			hi = 3 * prev
+		}
+		if d := randomDuration(p.BaseDelay, hi); d < p.MaxDelay {
+			return d
+		}
+		return p.MaxDelay
+	}
+	// BaseDelay<<shift can overflow long before shift reaches 63, so compare against MaxDelay before shifting.
+	backoff := p.MaxDelay
+	if shift := retry - 1; shift < 63 && p.BaseDelay <= p.MaxDelay>>shift {
+		backoff = p.BaseDelay << shift
+	}
+	return randomDuration(0, backoff)
+}
+
+// RetryBudget is a token bucket that limits retries to a fraction of traffic, so that retries cannot multiply the
+// load on a dependency that is already struggling. Every call deposits ratio tokens and every retry takes one.
+type RetryBudget struct {
+	ratio, max float64
+
+	lock   sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget creates a budget that allows ratio retries per call, with at most capacity retries saved up. It starts
+// full, so a quiet service can still retry.
+func NewRetryBudget(ratio float64, capacity int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, max: float64(capacity), tokens: float64(capacity)}
+}
+
+func (b *RetryBudget) deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.max, b.tokens+b.ratio)
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
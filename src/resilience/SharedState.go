@@ -0,0 +1,243 @@
+package resilience
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// SharedState is where the breakers of several replicas keep the state of a circuit they share. A tripped circuit is
+// open until its open time passes and then half-open until it is reset.
+type SharedState interface {
+	// Trip records that the circuit opened and stays open until the given time.
+	Trip(ctx context.Context, name string, until time.Time) error
+	// Reset records that the circuit closed, and releases its probe lease.
+	Reset(ctx context.Context, name string) error
+	// Status returns whether the circuit is tripped and if so until when it is open.
+	Status(ctx context.Context, name string) (until time.Time, tripped bool, err error)
+	// AcquireProbe takes or renews the lease to send half-open trial requests for ttl. It reports false while another
+	// owner holds the lease.
+	AcquireProbe(ctx context.Context, name, owner string, ttl time.Duration) (bool, error)
+}
+
+// maybeSync starts a read of the shared state if the last one is more than SyncInterval old. cb.lock must be held.
+func (cb *CircuitBreaker) maybeSync() {
+	if cb.settings.Shared == nil || cb.syncing {
+		return
+	}
+	now := cb.settings.Clock.Now()
+	if now.Sub(cb.lastSync) < cb.settings.SyncInterval {
+		return
+	}
+	cb.syncing, cb.lastSync = true, now
+	go cb.sync()
+}
+
+// sync brings the breaker in line with the shared state, and competes for the probe lease while half-open.
+func (cb *CircuitBreaker) sync() {
+	ctx, cancel := context.WithTimeout(context.Background(), cb.settings.SyncInterval)
+	defer cancel()
+	shared, name := cb.settings.Shared, cb.settings.Name
+	until, tripped, err := shared.Status(ctx, name)
+	cb.sharedStateError(err)
+
+	cb.lock.Lock()
+	cb.syncing = false
+	cb.advance()
+	now := cb.settings.Clock.Now()
+	switch {
+	case err != nil:
+		// Keep the local state until the backend is back.
+	case cb.publishing:
+		// This breaker's own change is still on its way to the backend, so what was read may predate it.
+	case tripped && until.After(now):
+		// Another replica tripped the circuit, or tripped it again after a failed probe.
+		if cb.state != StateOpen || cb.openedAt.Add(cb.settings.OpenTimeout).Before(until) {
+			cb.changeState(StateOpen, now, true)
+			cb.openedAt = until.Add(-cb.settings.OpenTimeout)
+		}
+	case tripped:
+		if cb.state == StateClosed {
+			cb.changeState(StateHalfOpen, now, true)
+		}
+	case cb.state == StateHalfOpen:
+		// The replica that probed found the dependency healthy. A circuit that is open here but not tripped in the
+		// shared state is left alone, since its trip may still be on its way to the backend.
+		cb.changeState(StateClosed, now, true)
+	}
+	halfOpen, generation := cb.state == StateHalfOpen, cb.generation
+	cb.unlock()
+	if !halfOpen {
+		return
+	}
+
+	ok, err := shared.AcquireProbe(ctx, name, cb.owner, cb.settings.OpenTimeout)
+	cb.sharedStateError(err)
+	cb.lock.Lock()
+	defer cb.unlock()
+	if cb.generation == generation {
+		cb.probing = ok && err == nil
+	}
+}
+
+// publication is a trip or reset caused by this breaker's own calls, waiting to be written to the shared state.
+type publication struct {
+	to        State
+	openUntil time.Time
+}
+
+// maybePublish starts writing cb.pending to the shared state unless a write is already in flight, in which case that
+// write picks it up when it is done. cb.lock must be held.
+func (cb *CircuitBreaker) maybePublish() {
+	if cb.publishing || cb.pending == nil {
+		return
+	}
+	cb.publishing = true
+	go cb.publish()
+}
+
+// publish writes pending state changes to the shared state until there are none left. Changes are written in the
+// order they happened, and a change that is superseded while an earlier one is being written is skipped.
+func (cb *CircuitBreaker) publish() {
+	cb.lock.Lock()
+	for cb.pending != nil {
+		p := *cb.pending
+		cb.pending = nil
+		cb.lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cb.settings.SyncInterval)
+		var err error
+		if p.to == StateOpen {
+			err = cb.settings.Shared.Trip(ctx, cb.settings.Name, p.openUntil)
+		} else {
+			err = cb.settings.Shared.Reset(ctx, cb.settings.Name)
+		}
+		cancel()
+		cb.sharedStateError(err)
+		cb.lock.Lock()
+	}
+	cb.publishing = false
+	cb.lock.Unlock()
+}
+
+// sharedStateError counts and reports a failed call to the shared state. cb.lock must not be held.
+func (cb *CircuitBreaker) sharedStateError(err error) {
+	if err == nil {
+		return
+	}
+	cb.lock.Lock()
+	cb.metrics.SharedStateErrors++
+	cb.lock.Unlock()
+	if cb.settings.OnSharedStateError != nil {
+		cb.settings.OnSharedStateError(err)
+	}
+}
+
+// MemoryState is an in-process SharedState, for tests and for breakers that only need to share state within one
+// process.
+type MemoryState struct {
+	clock  Clock
+	lock   sync.Mutex
+	trips  map[string]time.Time
+	probes map[string]probeLease
+}
+
+type probeLease struct {
+	owner   string
+	expires time.Time
+}
+
+// NewMemoryState creates an empty MemoryState. clock defaults to the system clock.
+func NewMemoryState(clock Clock) *MemoryState {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &MemoryState{clock: clock, trips: map[string]time.Time{}, probes: map[string]probeLease{}}
+}
+
+func (m *MemoryState) Trip(_ context.Context, name string, until time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.trips[name] = until
+	return nil
+}
+
+func (m *MemoryState) Reset(_ context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.trips, name)
+	delete(m.probes, name)
+	return nil
+}
+
+func (m *MemoryState) Status(_ context.Context, name string) (time.Time, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	until, ok := m.trips[name]
+	return until, ok, nil
+}
+
+func (m *MemoryState) AcquireProbe(_ context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.clock.Now()
+	if l, ok := m.probes[name]; ok && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+	m.probes[name] = probeLease{owner, now.Add(ttl)}
+	return true, nil
+}
+
+// RedisState is a SharedState kept in Redis. A circuit called name is stored under prefix+name, as the Unix time in
+// milliseconds until which it is open, and its probe lease under prefix+name+":probe".
+type RedisState struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// tripRetention is how long a trip outlives its open time in Redis. A circuit whose prober died without resetting it
+// closes again once the trip expires.
+const tripRetention = 10 * time.Minute
+
+// acquireProbe sets the lease if it is free and extends it if the caller already holds it.
+var acquireProbe = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// NewRedisState creates a RedisState whose keys start with prefix.
+func NewRedisState(client redis.UniversalClient, prefix string) *RedisState {
+	return &RedisState{client: client, prefix: prefix}
+}
+
+func (r *RedisState) Trip(ctx context.Context, name string, until time.Time) error {
+	return r.client.Set(ctx, r.prefix+name, until.UnixMilli(), time.Until(until)+tripRetention).Err()
+}
+
+func (r *RedisState) Reset(ctx context.Context, name string) error {
+	return r.client.Del(ctx, r.prefix+name, r.prefix+name+":probe").Err()
+}
+
+func (r *RedisState) Status(ctx context.Context, name string) (time.Time, bool, error) {
+	ms, err := r.client.Get(ctx, r.prefix+name).Int64()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(ms), true, nil
+}
+
+func (r *RedisState) AcquireProbe(ctx context.Context, name, owner string, ttl time.Duration) (bool, error) {
+	ok, err := acquireProbe.Run(ctx, r.client, []string{r.prefix + name + ":probe"}, owner, ttl.Milliseconds()).Int()
+	return ok == 1, err
+}
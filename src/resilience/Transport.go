@@ -0,0 +1,132 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that sends requests through one circuit breaker per host, so a failing host does
+// not take the others down with it. Responses with a 5xx status and transport errors count as failures, classified
+// by the same rule as Execute: timeouts always count, other errors as the breaker's IsFailure decides, and requests
+// the caller cancelled are not recorded at all. While a host's circuit is open, Transport answers with a synthetic 503
+// without contacting it.
+type Transport struct {
+	base       http.RoundTripper
+	newBreaker func(host string) *CircuitBreaker
+
+	lock     sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewTransport wraps base, which defaults to http.DefaultTransport. newBreaker creates the breaker for a host the first
+// time it is seen; it defaults to NewCircuitBreaker with zero Settings. Each host needs its own breaker, and its own
+// TripPolicy, because both keep state.
+func NewTransport(base http.RoundTripper, newBreaker func(host string) *CircuitBreaker) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if newBreaker == nil {
+		newBreaker = func(string) *CircuitBreaker { return NewCircuitBreaker(Settings{}) }
+	}
+	return &Transport{base: base, newBreaker: newBreaker, breakers: map[string]*CircuitBreaker{}}
+}
+
+// Breaker returns the breaker guarding host, creating it if needed.
+func (t *Transport) Breaker(host string) *CircuitBreaker {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cb, ok := t.breakers[host]
+	if !ok {
+		cb = t.newBreaker(host)
+		t.breakers[host] = cb
+	}
+	return cb
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cb := t.Breaker(req.URL.Host)
+	generation, ok := cb.AllowRequest()
+	if !ok {
+		closeBody(req)
+		return circuitOpenResponse(req, cb), nil
+	}
+	start := cb.settings.Clock.Now()
+	resp, err := t.base.RoundTrip(req)
+	outcome := err
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// The transport does not always wrap the context's error, so ask the context whether the caller gave up.
+		outcome = context.Canceled
+	case err == nil && resp.StatusCode >= 500:
+		outcome = serverError(resp.StatusCode)
+	}
+	cb.finish(generation, outcome, cb.settings.Clock.Now().Sub(start))
+	return resp, err
+}
+
+// serverError is how Transport reports a 5xx response to the breaker, so it is classified by the same rule as the
+// errors returned through Execute.
+type serverError int
+
+func (e serverError) Error() string {
+	return "server error: " + http.StatusText(int(e))
+}
+
+// circuitOpenResponse is the 503 Transport returns in place of contacting a host whose circuit is open.
+func circuitOpenResponse(req *http.Request, cb *CircuitBreaker) *http.Response {
+	body := ErrCircuitOpen.Error() + "\n"
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if d := cb.retryAfter(); d > 0 {
+		header.Set("Retry-After", retryAfterSeconds(d))
+	}
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// retryAfter returns how long an open circuit stays open, or 0 if it is not open. Like State, it changes nothing.
+func (cb *CircuitBreaker) retryAfter() time.Duration {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	now := cb.settings.Clock.Now()
+	if cb.stateAt(now) != StateOpen {
+		return 0
+	}
+	return cb.settings.OpenTimeout - now.Sub(cb.openedAt)
+}
+
+// retryAfterSeconds formats d for a Retry-After header, rounding up to whole seconds.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// ShedLoad is server middleware that answers 503 instead of calling next while any of the breakers guarding next's
+// downstream dependencies is open, since the request would most likely fail anyway. It only looks at the breakers'
+// state, so it does not use up half-open trial requests.
+func ShedLoad(next http.Handler, breakers ...*CircuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cb := range breakers {
+			if d := cb.retryAfter(); d > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(d))
+				http.Error(w, "downstream dependency unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,180 @@
+package resilience
+
+import (
+	"time"
+)
+
+// TripPolicy decides when a closed circuit opens, based on the outcomes of the calls made while it was closed. A
+// breaker calls its policy with its lock held, so implementations need not be safe for concurrent use.
+type TripPolicy interface {
+	// Record adds the outcome of one call.
+	Record(now time.Time, failed, slow bool)
+	// ShouldTrip reports whether the recorded calls warrant opening the circuit.
+	ShouldTrip(now time.Time) bool
+	// Reset forgets every recorded call. It is called whenever the circuit closes.
+	Reset()
+}
+
+// ConsecutiveFailures returns a policy that trips after threshold failures in a row. Any success resets the count.
+func ConsecutiveFailures(threshold int) TripPolicy {
+	return &consecutiveFailures{threshold: threshold}
+}
+
+type consecutiveFailures struct {
+	threshold int
+	failures  int
+}
+
+func (p *consecutiveFailures) Record(_ time.Time, failed, _ bool) {
+	if failed {
+		p.failures++
+	} else {
+		p.failures = 0
+	}
+}
+
+func (p *consecutiveFailures) ShouldTrip(time.Time) bool { return p.failures >= p.threshold }
+func (p *consecutiveFailures) Reset()                    { p.failures = 0 }
+
+// RateThresholds are the trip conditions shared by the window policies. Rates are percentages of the calls in the
+// window; a zero rate disables that condition.
+type RateThresholds struct {
+	// MinCalls is the number of calls the window must hold before the breaker may trip, so a handful of failures at
+	// low traffic does not open the circuit.
+	MinCalls int
+	// FailureRate trips the breaker when at least this percentage of calls failed.
+	FailureRate float64
+	// SlowCallRate trips the breaker when at least this percentage of calls were slow.
+	SlowCallRate float64
+}
+
+func (r RateThresholds) exceeded(calls, failures, slow int) bool {
+	if calls == 0 || calls < r.MinCalls {
+		return false
+	}
+	if r.FailureRate > 0 && float64(failures)*100 >= r.FailureRate*float64(calls) {
+		return true
+	}
+	return r.SlowCallRate > 0 && float64(slow)*100 >= r.SlowCallRate*float64(calls)
+}
+
+// CountWindow returns a policy that looks at the outcomes of the last size calls, kept in a ring buffer. A size below
+// one defaults to 100.
+func CountWindow(size int, thresholds RateThresholds) TripPolicy {
+	if size <= 0 {
+		size = 100
+	}
+	return &countWindow{outcomes: make([]outcome, size), thresholds: thresholds}
+}
+
+type outcome struct {
+	failed, slow bool
+}
+
+type countWindow struct {
+	thresholds     RateThresholds
+	outcomes       []outcome
+	next, calls    int
+	failures, slow int
+}
+
+func (p *countWindow) Record(_ time.Time, failed, slow bool) {
+	if p.calls == len(p.outcomes) {
+		// The window is full, so the oldest outcome drops out.
+		old := p.outcomes[p.next]
+		p.failures -= b2i(old.failed)
+		p.slow -= b2i(old.slow)
+	} else {
+		p.calls++
+	}
+	p.outcomes[p.next] = outcome{failed, slow}
+	p.failures += b2i(failed)
+	p.slow += b2i(slow)
+	p.next = (p.next + 1) % len(p.outcomes)
+}
+
+func (p *countWindow) ShouldTrip(time.Time) bool {
+	return p.thresholds.exceeded(p.calls, p.failures, p.slow)
+}
+
+func (p *countWindow) Reset() {
+	p.next, p.calls, p.failures, p.slow = 0, 0, 0, 0
+}
+
+// TimeWindow returns a policy that looks at the calls made in the last window, split into the given number of
+// buckets. Outcomes expire one bucket at a time, so the window slides in steps of window/buckets. A window that is not
+// positive defaults to 60s and a bucket count below one to 10; there are never more buckets than nanoseconds in the
+// window.
+func TimeWindow(window time.Duration, buckets int, thresholds RateThresholds) TripPolicy {
+	if window <= 0 {
+		window = 60 * time.Second
+	}
+	if buckets <= 0 {
+		buckets = 10
+	}
+	if time.Duration(buckets) > window {
+		buckets = int(window)
+	}
+	return &timeWindow{
+		width:      window / time.Duration(buckets),
+		buckets:    make([]bucket, buckets),
+		thresholds: thresholds,
+	}
+}
+
+type bucket struct {
+	epoch                 int64 // index of the time slice this bucket currently counts
+	calls, failures, slow int
+}
+
+type timeWindow struct {
+	thresholds RateThresholds
+	width      time.Duration
+	buckets    []bucket
+}
+
+func (p *timeWindow) epoch(now time.Time) int64 {
+	return now.UnixNano() / int64(p.width)
+}
+
+func (p *timeWindow) Record(now time.Time, failed, slow bool) {
+	e := p.epoch(now)
+	i := e % int64(len(p.buckets))
+	if i < 0 {
+		// Before 1970 the epoch is negative.
+		i += int64(len(p.buckets))
+	}
+	b := &p.buckets[i]
+	if b.epoch != e {
+		*b = bucket{epoch: e}
+	}
+	b.calls++
+	b.failures += b2i(failed)
+	b.slow += b2i(slow)
+}
+
+func (p *timeWindow) ShouldTrip(now time.Time) bool {
+	e := p.epoch(now)
+	var calls, failures, slow int
+	for _, b := range p.buckets {
+		if age := e - b.epoch; age >= 0 && age < int64(len(p.buckets)) {
+			calls += b.calls
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	return p.thresholds.exceeded(calls, failures, slow)
+}
+
+func (p *timeWindow) Reset() {
+	for i := range p.buckets {
+		p.buckets[i] = bucket{}
+	}
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,168 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// WorkerPool is the thread-pool flavour of a bulkhead: a fixed number of long-lived goroutines pull tasks from a
+// bounded queue and run them, so however slow its work gets, a pool never runs more tasks at once than it has workers
+// and starts no goroutines per task. Callers get their result on a channel instead of waiting in line themselves.
+type WorkerPool[T any] struct {
+	tasks chan poolTask[T]
+
+	// mu guards closed, and is held for reading while tasks are submitted so Shutdown cannot close tasks under them
+	mu     sync.RWMutex
+	closed bool
+
+	// runMu guards aborted and running. aborted is set when a graceful shutdown runs out of time; running holds the
+	// cancel func of the task each worker is running, so Shutdown can cancel them.
+	runMu   sync.Mutex
+	aborted bool
+	running []context.CancelFunc
+
+	workers sync.WaitGroup
+}
+
+// Result is the outcome of a task run by a WorkerPool
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+type poolTask[T any] struct {
+	ctx    context.Context
+	fn     func(ctx context.Context) (T, error)
+	result chan Result[T]
+}
+
+var (
+	// ErrPoolFull is returned by Submit when the pool's queue has no room
+	ErrPoolFull = errors.New("worker pool queue is full")
+	// ErrPoolClosed is returned by Submit after Shutdown
+	ErrPoolClosed = errors.New("worker pool is shut down")
+)
+
+// NewWorkerPool starts workers goroutines serving a queue of queueSize tasks. workers defaults to 10 and a negative
+// queueSize to 0.
+func NewWorkerPool[T any](workers, queueSize int) *WorkerPool[T] {
+	if workers <= 0 {
+		workers = 10
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &WorkerPool[T]{tasks: make(chan poolTask[T], queueSize), running: make([]context.CancelFunc, workers)}
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work(i)
+	}
+	return p
+}
+
+// Submit queues fn and returns the channel its result will be sent on. fn runs with a context that is cancelled when
+// ctx is or when Shutdown gives up waiting; a task whose context is done before a worker picks it up is not run at all
+// and reports the context's error. Submit never blocks: if the queue is full it returns ErrPoolFull.
+func (p *WorkerPool[T]) Submit(ctx context.Context,
+	fn func(ctx context.Context) (T, error)) (<-chan Result[T], error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	t := poolTask[T]{ctx: ctx, fn: fn, result: make(chan Result[T], 1)}
+	select {
+	case p.tasks <- t:
+		return t.result, nil
+	default:
+		return nil, ErrPoolFull
+	}
+}
+
+// work runs tasks on worker id until the queue is closed and drained
+func (p *WorkerPool[T]) work(id int) {
+	defer p.workers.Done()
+	for t := range p.tasks {
+		t.result <- p.run(id, t)
+	}
+}
+
+// run runs one task on worker id, with a context that is cancelled when the submitter's is or when Shutdown gives up
+// waiting
+func (p *WorkerPool[T]) run(id int, t poolTask[T]) (res Result[T]) {
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+	p.runMu.Lock()
+	aborted := p.aborted
+	p.running[id] = cancel
+	p.runMu.Unlock()
+	defer func() {
+		p.runMu.Lock()
+		p.running[id] = nil
+		p.runMu.Unlock()
+	}()
+	if aborted {
+		return Result[T]{Err: context.Canceled}
+	}
+	if err := ctx.Err(); err != nil {
+		return Result[T]{Err: err}
+	}
+	defer func() {
+		// A panicking task must not take its worker, and with it the pool's capacity, down with it
+		if r := recover(); r != nil {
+			res = Result[T]{Err: &PanicError{Value: r}}
+		}
+	}()
+	v, err := t.fn(ctx)
+	return Result[T]{Value: v, Err: err}
+}
+
+// PanicError is the error a WorkerPool reports for a task that panicked
+type PanicError struct {
+	// Value is what the task panicked with
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("task panicked: %v", e.Value)
+}
+
+// abort cancels the running tasks and makes the queued ones report context.Canceled without running
+func (p *WorkerPool[T]) abort() {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	p.aborted = true
+	for _, cancel := range p.running {
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
+
+// Shutdown stops the pool from taking new tasks and waits for the queued and running ones to finish. If ctx is done
+// first, the remaining tasks are cancelled: queued ones report context.Canceled without running and running ones see
+// their context cancelled. Shutdown then waits for the workers to exit and returns ctx's error.
+func (p *WorkerPool[T]) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.abort()
+		<-done
+		return ctx.Err()
+	}
+}
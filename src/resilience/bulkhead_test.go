@@ -0,0 +1,231 @@
+package resilience
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// blockingHandler answers once release is closed, and reports each request it starts on started.
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("done"))
+	})
+}
+
+// serveAsync serves a request on h in the background and delivers the response on the returned channel.
+func serveAsync(h http.Handler, r *http.Request) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		done <- w
+	}()
+	return done
+}
+
+func TestBulkheadRejectsWhenFull(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		started, release := make(chan struct{}), make(chan struct{})
+		b := NewBulkhead(BulkheadSettings{
+			Capacity:     2,
+			QueueSize:    1,
+			MaxQueueTime: 10 * time.Millisecond,
+			RetryAfter:   1500 * time.Millisecond,
+			Pooled:       pooled,
+		}, blockingHandler(started, release))
+		var admitted []<-chan *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			admitted = append(admitted, serveAsync(b, httptest.NewRequest("GET", "/", nil)))
+			<-started
+		}
+		if b.InFlight() != 2 {
+			t.Fatalf("pooled %v: InFlight() = %d; want 2", pooled, b.InFlight())
+		}
+
+		// The third request waits out MaxQueueTime in the queue and is turned away.
+		w := httptest.NewRecorder()
+		b.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+			t.Fatalf("pooled %v: full bulkhead answered %d with Retry-After %q; want 503 and 2",
+				pooled, w.Code, w.Header().Get("Retry-After"))
+		}
+
+		close(release)
+		for _, done := range admitted {
+			if w := <-done; w.Code != http.StatusOK || w.Body.String() != "done" {
+				t.Fatalf("pooled %v: admitted request answered %d %q", pooled, w.Code, w.Body)
+			}
+		}
+		if b.InFlight() != 0 {
+			t.Fatalf("pooled %v: InFlight() = %d after every request finished; want 0", pooled, b.InFlight())
+		}
+		if err := b.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestBulkheadQueue checks that a queued request gets the slot a finished one frees, that the queue is bounded, and
+// that a queued request whose client goes away leaves the queue.
+func TestBulkheadQueue(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	b := NewBulkhead(BulkheadSettings{Capacity: 1, QueueSize: 1, MaxQueueTime: time.Minute},
+		blockingHandler(started, release))
+	first := serveAsync(b, httptest.NewRequest("GET", "/", nil))
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := serveAsync(b, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	eventually(t, "the request to queue", func() bool { return b.Queued() == 1 })
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("request beyond the queue answered %d; want 503", w.Code)
+	}
+	cancel()
+	if w := <-abandoned; w.Code != http.StatusServiceUnavailable || b.Queued() != 0 {
+		t.Fatalf("cancelled request answered %d with %d queued; want 503 and an empty queue", w.Code, b.Queued())
+	}
+
+	queued := serveAsync(b, httptest.NewRequest("GET", "/", nil))
+	eventually(t, "the request to queue", func() bool { return b.Queued() == 1 })
+	release <- struct{}{}
+	<-first
+	<-started
+	close(release)
+	if w := <-queued; w.Code != http.StatusOK {
+		t.Fatalf("queued request answered %d; want 200", w.Code)
+	}
+}
+
+func TestBulkheadReleasesOnPanic(t *testing.T) {
+	b := NewBulkhead(BulkheadSettings{Capacity: 1}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}))
+	func() {
+		defer func() { recover() }()
+		b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if b.InFlight() != 0 {
+		t.Fatalf("InFlight() = %d after a panic; want 0", b.InFlight())
+	}
+}
+
+func TestLoadBalancerLeastLoaded(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	bulkheads := []*Bulkhead{
+		NewBulkhead(BulkheadSettings{Capacity: 2}, blockingHandler(started, release)),
+		NewBulkhead(BulkheadSettings{Capacity: 2}, blockingHandler(started, release)),
+	}
+	lb := NewLoadBalancer(bulkheads)
+	var done []<-chan *httptest.ResponseRecorder
+	for i := 0; i < 4; i++ {
+		done = append(done, serveAsync(lb, httptest.NewRequest("GET", "/", nil)))
+		<-started
+	}
+	for i, b := range bulkheads {
+		if b.InFlight() != 2 {
+			t.Errorf("bulkhead %d has %d requests in flight; want the load spread 2 and 2", i, b.InFlight())
+		}
+	}
+	close(release)
+	for _, d := range done {
+		<-d
+	}
+}
+
+// recordingPicker always picks the same bulkhead and records every Done it is told about.
+type recordingPicker struct {
+	pick int
+	done chan int
+}
+
+func (p *recordingPicker) Pick(*http.Request, []*Bulkhead) int { return p.pick }
+
+func (p *recordingPicker) Done(i int, elapsed time.Duration) {
+	if elapsed <= 0 {
+		panic("Done called with a non-positive elapsed time")
+	}
+	p.done <- i
+}
+
+func TestLoadBalancerReportsDone(t *testing.T) {
+	picker := &recordingPicker{pick: 1, done: make(chan int, 1)}
+	served := make(chan int, 1)
+	handler := func(i int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served <- i
+			time.Sleep(time.Millisecond)
+			if r.URL.Path == "/panic" {
+				panic("boom")
+			}
+		})
+	}
+	lb := NewLoadBalancerWithPicker([]*Bulkhead{
+		NewBulkhead(BulkheadSettings{}, handler(0)),
+		NewBulkhead(BulkheadSettings{}, handler(1)),
+	}, picker)
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if i := <-served; i != 1 {
+		t.Fatalf("bulkhead %d served the request; want the picked one, 1", i)
+	}
+	select {
+	case i := <-picker.done:
+		if i != 1 {
+			t.Fatalf("Done(%d, ...); want Done(1, ...)", i)
+		}
+	default:
+		t.Fatal("Done was not called once the request finished")
+	}
+
+	// The picker still hears about a request whose handler panics.
+	func() {
+		defer func() { recover() }()
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+	<-served
+	select {
+	case <-picker.done:
+	default:
+		t.Fatal("Done was not called after the handler panicked")
+	}
+}
+
+func TestPooledBulkhead(t *testing.T) {
+	b := NewBulkhead(BulkheadSettings{Capacity: 1, Pooled: true}, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		panic("boom")
+	}))
+
+	// A panic on a worker is raised again on the request's goroutine.
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recovered %v; want boom", r)
+			}
+		}()
+		b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		t.Fatal("the handler's panic was swallowed")
+	}()
+	if b.InFlight() != 0 {
+		t.Fatalf("InFlight() = %d after a panic; want 0", b.InFlight())
+	}
+
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("closed bulkhead answered %d; want 503", w.Code)
+	}
+}
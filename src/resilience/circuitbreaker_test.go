@@ -0,0 +1,383 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// allow calls AllowRequest and fails the test if the call is rejected.
+func allow(t *testing.T, cb *CircuitBreaker) uint64 {
+	t.Helper()
+	generation, ok := cb.AllowRequest()
+	if !ok {
+		t.Fatalf("AllowRequest() rejected a call in state %v", cb.State())
+	}
+	return generation
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{
+		Threshold:           3,
+		OpenTimeout:         10 * time.Second,
+		HalfOpenMaxRequests: 2,
+		Clock:               clock,
+	})
+	expect := func(want State) {
+		t.Helper()
+		if got := cb.State(); got != want {
+			t.Fatalf("State() = %v; want %v", got, want)
+		}
+	}
+	call := func(failed bool) {
+		t.Helper()
+		generation := allow(t, cb)
+		if failed {
+			cb.RecordFailure(generation)
+		} else {
+			cb.RecordSuccess(generation)
+		}
+	}
+
+	// A success in between resets the consecutive failure count.
+	call(true)
+	call(true)
+	call(false)
+	call(true)
+	call(true)
+	expect(StateClosed)
+	call(true)
+	expect(StateOpen)
+
+	if _, ok := cb.AllowRequest(); ok {
+		t.Fatal("open circuit allowed a request")
+	}
+	clock.Advance(10*time.Second - time.Nanosecond)
+	expect(StateOpen)
+	clock.Advance(time.Nanosecond)
+	expect(StateHalfOpen)
+
+	// Only HalfOpenMaxRequests trials go through, and a failing trial reopens the circuit.
+	first, second := allow(t, cb), allow(t, cb)
+	if _, ok := cb.AllowRequest(); ok {
+		t.Fatal("half-open circuit allowed more than HalfOpenMaxRequests trials")
+	}
+	cb.RecordSuccess(first)
+	expect(StateHalfOpen)
+	cb.RecordFailure(second)
+	expect(StateOpen)
+
+	clock.Advance(10 * time.Second)
+	expect(StateHalfOpen)
+	call(false)
+	expect(StateHalfOpen)
+	call(false)
+	expect(StateClosed)
+}
+
+// TestCircuitBreakerIgnoresEarlierGenerations checks that calls let through before the circuit changed state cannot
+// decide the outcome of the half-open trials, nor trip a circuit that has closed again since.
+func TestCircuitBreakerIgnoresEarlierGenerations(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{Threshold: 2, OpenTimeout: time.Second, Clock: clock})
+
+	slow := make([]uint64, 4)
+	for i := range slow {
+		slow[i] = allow(t, cb)
+	}
+	cb.RecordFailure(slow[0])
+	cb.RecordFailure(slow[1])
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v after two failures; want open", cb.State())
+	}
+	clock.Advance(time.Second)
+	probe := allow(t, cb)
+
+	// The slow calls from while the circuit was closed finish while it is half-open.
+	cb.RecordSuccess(slow[2])
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("a call admitted while closed closed the half-open circuit: State() = %v", cb.State())
+	}
+	cb.RecordFailure(slow[3])
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("a call admitted while closed reopened the half-open circuit: State() = %v", cb.State())
+	}
+	if _, ok := cb.AllowRequest(); ok {
+		t.Fatal("a stale outcome gave the probe's trial slot to another call")
+	}
+
+	cb.RecordSuccess(probe)
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after the probe succeeded; want closed", cb.State())
+	}
+	// A probe reporting twice, or an old failure arriving late, does not count against the closed circuit.
+	cb.RecordFailure(probe)
+	cb.RecordFailure(slow[0])
+	g := allow(t, cb)
+	cb.RecordFailure(g)
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after one failure in the new generation; want closed", cb.State())
+	}
+}
+
+// TestCircuitBreakerStateHasNoSideEffects checks that reading the state of an open circuit whose timeout has elapsed
+// reports half-open without starting a new generation, so calls still in flight from before are not cut off by a
+// reader.
+func TestCircuitBreakerStateHasNoSideEffects(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{Threshold: 1, OpenTimeout: time.Second, Clock: clock})
+	cb.RecordFailure(allow(t, cb))
+	before := cb.generation
+	clock.Advance(time.Second)
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("State() = %v once the open timeout elapsed; want half-open", cb.State())
+	}
+	if cb.state != StateOpen || cb.generation != before {
+		t.Fatalf("State() moved the circuit to %v, generation %d; want it left open in generation %d", cb.state,
+			cb.generation, before)
+	}
+}
+
+func TestCircuitBreakerPolicyResetsOnClose(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{Threshold: 2, OpenTimeout: time.Second, Clock: clock})
+	cb.RecordFailure(allow(t, cb))
+	cb.RecordFailure(allow(t, cb))
+	clock.Advance(time.Second)
+	cb.RecordSuccess(allow(t, cb))
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v; want closed", cb.State())
+	}
+	// The failures from before the circuit opened must not count towards the next trip.
+	cb.RecordFailure(allow(t, cb))
+	if cb.State() != StateClosed {
+		t.Fatalf("one failure after closing tripped the circuit")
+	}
+}
+
+// TestCircuitBreakerSlowCalls checks that a window policy trips on slow calls as measured against SlowCallDuration.
+func TestCircuitBreakerSlowCalls(t *testing.T) {
+	cb := NewCircuitBreaker(Settings{
+		Policy:           CountWindow(4, RateThresholds{MinCalls: 4, SlowCallRate: 50}),
+		SlowCallDuration: 100 * time.Millisecond,
+		Clock:            newFakeClock(),
+	})
+	for _, elapsed := range []time.Duration{50, 100, 150} {
+		cb.Record(allow(t, cb), false, elapsed*time.Millisecond)
+	}
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after one slow call in three; want closed", cb.State())
+	}
+	cb.Record(allow(t, cb), false, time.Second)
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v after two slow calls in four; want open", cb.State())
+	}
+}
+
+func TestExecute(t *testing.T) {
+	clock := newFakeClock()
+	errBoom := errors.New("boom")
+	errIgnored := errors.New("not found")
+	cb := NewCircuitBreaker(Settings{
+		Threshold: 2,
+		Clock:     clock,
+		IsFailure: func(err error) bool { return !errors.Is(err, errIgnored) },
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := Execute(ctx, cb, func(context.Context) (int, error) { return 0, errIgnored }); err != errIgnored {
+			t.Fatalf("Execute returned %v; want %v", err, errIgnored)
+		}
+	}
+	if cb.State() != StateClosed {
+		t.Fatal("errors IsFailure rejects opened the circuit")
+	}
+
+	v, err := ExecuteWithFallback(ctx, cb, func(context.Context) (int, error) { return 0, errBoom },
+		func(_ context.Context, err error) (int, error) { return 42, nil })
+	if v != 42 || err != nil {
+		t.Fatalf("ExecuteWithFallback = %d, %v; want 42, nil", v, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Execute swallowed a panic")
+			}
+		}()
+		Execute(ctx, cb, func(context.Context) (int, error) { panic("boom") })
+	}()
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v after two failures; want open", cb.State())
+	}
+
+	called := false
+	err = cb.Do(ctx, func(context.Context) error { called = true; return nil })
+	if !errors.Is(err, ErrCircuitOpen) || called {
+		t.Fatalf("Do on an open circuit = %v, called %v; want ErrCircuitOpen without calling", err, called)
+	}
+}
+
+// TestExecuteContextErrors checks that deadline errors count as failures even when IsFailure says otherwise, and that
+// cancelled calls are not recorded and give their half-open trial slot back.
+func TestExecuteContextErrors(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{
+		Threshold:   1,
+		OpenTimeout: time.Second,
+		Clock:       clock,
+		IsFailure:   func(error) bool { return false },
+	})
+	ctx := context.Background()
+	cancelled := func(context.Context) error { return context.Canceled }
+
+	for i := 0; i < 3; i++ {
+		if err := cb.Do(ctx, cancelled); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Do = %v; want context.Canceled", err)
+		}
+	}
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after cancelled calls; want closed", cb.State())
+	}
+	cb.Do(ctx, func(context.Context) error { return context.DeadlineExceeded })
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v after a deadline error; want open", cb.State())
+	}
+
+	clock.Advance(time.Second)
+	cb.Do(ctx, cancelled)
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("State() = %v after a cancelled probe; want half-open", cb.State())
+	}
+	// The cancelled probe must not hold on to the only trial slot.
+	if err := cb.Do(ctx, func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("Do after a cancelled probe = %v; want a trial call", err)
+	}
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after a successful probe; want closed", cb.State())
+	}
+}
+
+// transitions records the state changes a breaker reports.
+type transitions struct {
+	mu   sync.Mutex
+	seen []State
+}
+
+func (tr *transitions) record(from, to State) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.seen) == 0 {
+		tr.seen = append(tr.seen, from)
+	}
+	tr.seen = append(tr.seen, to)
+}
+
+func (tr *transitions) get() []State {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]State(nil), tr.seen...)
+}
+
+func TestCircuitBreakerOnStateChange(t *testing.T) {
+	clock := newFakeClock()
+	var tr transitions
+	var cb *CircuitBreaker
+	cb = NewCircuitBreaker(Settings{
+		Threshold:   1,
+		OpenTimeout: time.Second,
+		Clock:       clock,
+		OnStateChange: func(from, to State) {
+			// The hook runs without the lock held, so it may call back into the breaker.
+			if got := cb.State(); got != to {
+				t.Errorf("State() = %v in the hook for a change to %v", got, to)
+			}
+			tr.record(from, to)
+		},
+	})
+	cb.RecordFailure(allow(t, cb))
+	clock.Advance(time.Second)
+	cb.State() // reading the state reports nothing
+	cb.RecordFailure(allow(t, cb))
+	clock.Advance(time.Second)
+	cb.RecordSuccess(allow(t, cb))
+
+	want := []State{StateClosed, StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if got := tr.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("transitions = %v; want %v", got, want)
+	}
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{
+		Threshold:           2,
+		OpenTimeout:         10 * time.Second,
+		HalfOpenMaxRequests: 1,
+		SlowCallDuration:    time.Second,
+		Clock:               clock,
+	})
+	stale := allow(t, cb)
+	cb.Record(allow(t, cb), true, 2*time.Second)
+	clock.Advance(3 * time.Second)
+	cb.RecordFailure(allow(t, cb))
+	cb.RecordSuccess(stale) // counted, but from the closed generation, so the circuit stays open
+	for i := 0; i < 2; i++ {
+		if _, ok := cb.AllowRequest(); ok {
+			t.Fatal("open circuit allowed a request")
+		}
+	}
+	clock.Advance(14 * time.Second)
+
+	// The circuit became half-open 10s after opening, even though nothing has noticed yet.
+	want := Metrics{
+		Successes:   1,
+		Failures:    2,
+		Rejections:  2,
+		SlowCalls:   1,
+		TimeInState: [3]time.Duration{3 * time.Second, 10 * time.Second, 4 * time.Second},
+	}
+	if got := cb.Metrics(); got != want {
+		t.Fatalf("Metrics() = %+v; want %+v", got, want)
+	}
+	generation := allow(t, cb)
+	if _, ok := cb.AllowRequest(); ok {
+		t.Fatal("half-open circuit allowed a second trial")
+	}
+	cb.Abandon(generation)
+	clock.Advance(time.Second)
+	cb.RecordSuccess(allow(t, cb))
+
+	want.Successes++
+	want.Rejections++
+	want.TimeInState[StateHalfOpen] += time.Second
+	if got := cb.Metrics(); got != want {
+		t.Fatalf("Metrics() = %+v; want %+v", got, want)
+	}
+}
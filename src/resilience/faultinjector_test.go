@@ -0,0 +1,233 @@
+package resilience
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var okService = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("hello, world")),
+		Request:    req,
+	}, nil
+})
+
+func newFaultInjector(t *testing.T, s Scenario, clock Clock) *FaultInjector {
+	t.Helper()
+	f, err := NewFaultInjector(s, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// TestFaultInjectorDrivesBreaker replays an outage on a fake clock against a breaker-guarded client and checks the
+// exact sequence of states the breaker goes through.
+func TestFaultInjectorDrivesBreaker(t *testing.T) {
+	clock := newFakeClock()
+	injector := newFaultInjector(t, Scenario{Seed: 1, Phases: []Phase{
+		{Name: "healthy", Requests: 5},
+		{Name: "outage", Duration: Duration(30 * time.Second), Fault: Fault{ErrorRate: 1}},
+		{Name: "recovered"},
+	}}, clock)
+	var tr transitions
+	transport := NewTransport(injector.RoundTripper(okService), func(string) *CircuitBreaker {
+		return NewCircuitBreaker(Settings{
+			Threshold:     3,
+			OpenTimeout:   10 * time.Second,
+			Clock:         clock,
+			OnStateChange: tr.record,
+		})
+	})
+	client := &http.Client{Transport: transport}
+
+	// One request a second: the outage starts with the sixth request at t=5s and ends at t=35s. The circuit opens at
+	// 7s, its trials at 17s and 27s fail, and the trial at 37s succeeds.
+	for i := 0; i < 45; i++ {
+		resp, err := client.Get("http://dependency/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		clock.Advance(time.Second)
+	}
+
+	want := []State{
+		StateClosed, StateOpen,
+		StateHalfOpen, StateOpen,
+		StateHalfOpen, StateOpen,
+		StateHalfOpen, StateClosed,
+	}
+	if got := tr.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("transitions = %v; want %v", got, want)
+	}
+	if phase := injector.Phase(); phase != "recovered" {
+		t.Fatalf("Phase() = %q; want recovered", phase)
+	}
+	m := transport.Breaker("dependency").Metrics()
+	if m.Failures != 5 || m.Rejections != 27 {
+		t.Fatalf("Failures, Rejections = %d, %d; want 5, 27", m.Failures, m.Rejections)
+	}
+}
+
+func TestFaultInjectorPhases(t *testing.T) {
+	clock := newFakeClock()
+	injector := newFaultInjector(t, Scenario{Seed: 1, Loop: true, Phases: []Phase{
+		{Name: "a", Requests: 2},
+		{Name: "b", Duration: Duration(time.Minute)},
+		{Name: "c", Duration: Duration(time.Minute), Requests: 1},
+	}}, clock)
+	rt := injector.RoundTripper(okService)
+	get := func() {
+		resp, err := rt.RoundTrip(httptest.NewRequest("GET", "http://dependency/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	expect := func(want string) {
+		t.Helper()
+		if got := injector.Phase(); got != want {
+			t.Fatalf("Phase() = %q; want %q", got, want)
+		}
+	}
+
+	expect("a")
+	get()
+	get()
+	expect("b")
+	get()
+	clock.Advance(59 * time.Second)
+	expect("b")
+	clock.Advance(time.Second)
+	expect("c")
+	// c ends after one request, well before its minute is up, and the scenario loops.
+	get()
+	expect("a")
+}
+
+func TestFaultInjectorRoundTripper(t *testing.T) {
+	inject := func(f Fault) http.RoundTripper {
+		return newFaultInjector(t, Scenario{Seed: 1, Phases: []Phase{{Fault: f}}}, newFakeClock()).RoundTripper(okService)
+	}
+	req := httptest.NewRequest("GET", "http://dependency/", nil)
+
+	// Faults that answer without sending the request still close its body.
+	for _, f := range []Fault{{ErrorRate: 1}, {ResetRate: 1}} {
+		body := &closeTracker{Reader: strings.NewReader("payload")}
+		resp, err := inject(f).RoundTrip(httptest.NewRequest("POST", "http://dependency/", body))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !body.closed {
+			t.Fatalf("%+v: request body was not closed", f)
+		}
+	}
+
+	resp, err := inject(Fault{ErrorRate: 1, Status: http.StatusServiceUnavailable}).RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("error fault: %v, %v; want a 503", resp, err)
+	}
+	resp.Body.Close()
+
+	if _, err := inject(Fault{ResetRate: 1}).RoundTrip(req); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("reset fault: %v; want ECONNRESET", err)
+	}
+
+	resp, err = inject(Fault{PartialRate: 1}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if string(body) != "hello," || err != io.ErrUnexpectedEOF {
+		t.Fatalf("partial fault: read %q, %v; want %q, %v", body, err, "hello,", io.ErrUnexpectedEOF)
+	}
+}
+
+func TestFaultInjectorHandler(t *testing.T) {
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello, world")
+	})
+	serve := func(f Fault) (*http.Response, error) {
+		injector := newFaultInjector(t, Scenario{Seed: 1, Phases: []Phase{{Fault: f}}}, newFakeClock())
+		srv := httptest.NewServer(injector.Handler(hello))
+		t.Cleanup(srv.Close)
+		return srv.Client().Get(srv.URL)
+	}
+
+	resp, err := serve(Fault{ErrorRate: 1})
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("error fault: %v, %v; want a 500", resp, err)
+	}
+	resp.Body.Close()
+
+	if resp, err := serve(Fault{ResetRate: 1}); err == nil {
+		resp.Body.Close()
+		t.Fatal("reset fault: got a response")
+	}
+
+	resp, err = serve(Fault{PartialRate: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello," || err != io.ErrUnexpectedEOF {
+		t.Fatalf("partial fault: read %q, %v; want %q, %v", body, err, "hello,", io.ErrUnexpectedEOF)
+	}
+
+	start := time.Now()
+	resp, err = serve(Fault{Latency: Latency{Dist: "fixed", Mean: Duration(50 * time.Millisecond)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("fixed latency: answered in %v; want at least 50ms", elapsed)
+	}
+}
+
+// closeTracker is a request body that remembers being closed.
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestScenarioValidate(t *testing.T) {
+	bad := map[string]Scenario{
+		"no phases":       {},
+		"endless phase":   {Phases: []Phase{{Name: "a"}, {Name: "b"}}},
+		"endless loop":    {Loop: true, Phases: []Phase{{Name: "a"}}},
+		"rate above 1":    {Phases: []Phase{{Fault: Fault{ErrorRate: 1.5}}}},
+		"rates above 1":   {Phases: []Phase{{Fault: Fault{ErrorRate: 0.6, ResetRate: 0.6}}}},
+		"bad status":      {Phases: []Phase{{Fault: Fault{ErrorRate: 1, Status: 42}}}},
+		"no mean":         {Phases: []Phase{{Fault: Fault{Latency: Latency{Dist: "fixed"}}}}},
+		"min above max":   {Phases: []Phase{{Fault: Fault{Latency: Latency{Dist: "uniform", Min: 2, Max: 1}}}}},
+		"unknown latency": {Phases: []Phase{{Fault: Fault{Latency: Latency{Dist: "pareto"}}}}},
+	}
+	for name, s := range bad {
+		if err := s.Validate(); err == nil {
+			t.Errorf("%s: Validate() = nil", name)
+		}
+		if f, err := NewFaultInjector(s, nil); err == nil || f != nil {
+			t.Errorf("%s: NewFaultInjector accepted an invalid scenario", name)
+		}
+	}
+	good := Scenario{Phases: []Phase{{Requests: 1}, {Fault: Fault{ErrorRate: 0.5, ResetRate: 0.5}}}}
+	if err := good.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
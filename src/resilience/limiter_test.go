@@ -0,0 +1,175 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLimiterAccounting checks that the limiter counts calls in and out, hands the algorithm the number in flight
+// including the finishing call, and gates on the limit as it moves.
+func TestLimiterAccounting(t *testing.T) {
+	l := NewLimiter(NewAIMD(LimitSettings{Initial: 2, Min: 1, Max: 3}, 0.5, 0))
+	allowN := func(want int) {
+		t.Helper()
+		n := 0
+		for l.AllowRequest() {
+			n++
+		}
+		if n != want {
+			t.Fatalf("AllowRequest let %d calls through; want %d", n, want)
+		}
+	}
+
+	allowN(2)
+	// Both slots were in use, so the success grows the limit.
+	l.Record(false, time.Millisecond)
+	if l.Limit() != 3 || l.InFlight() != 1 {
+		t.Fatalf("Limit, InFlight = %d, %d; want 3, 1", l.Limit(), l.InFlight())
+	}
+	allowN(2)
+	l.Record(true, time.Millisecond)
+	if l.Limit() != 1 || l.InFlight() != 2 {
+		t.Fatalf("Limit, InFlight = %d, %d; want 1, 2", l.Limit(), l.InFlight())
+	}
+	// More calls are in flight than the new limit allows; none may start until they drain below it.
+	allowN(0)
+	// The limiter was over its limit of 1.5, so the success grows it to 2.5.
+	l.Record(false, time.Millisecond)
+	if l.Limit() != 2 || l.InFlight() != 1 {
+		t.Fatalf("Limit, InFlight = %d, %d; want 2, 1", l.Limit(), l.InFlight())
+	}
+	allowN(1)
+	for l.InFlight() > 0 {
+		l.Record(false, time.Millisecond)
+	}
+	allowN(l.Limit())
+}
+
+func TestLimitSettingsDefaults(t *testing.T) {
+	tests := []struct {
+		in, want LimitSettings
+	}{
+		{LimitSettings{}, LimitSettings{Initial: 20, Min: 1, Max: 1000}},
+		{LimitSettings{Initial: 1, Min: 5, Max: 10}, LimitSettings{Initial: 5, Min: 5, Max: 10}},
+		{LimitSettings{Initial: 50, Min: 5, Max: 10}, LimitSettings{Initial: 10, Min: 5, Max: 10}},
+	}
+	for _, tt := range tests {
+		if got := tt.in.withDefaults(); got != tt.want {
+			t.Errorf("%+v.withDefaults() = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// limitStep feeds one call to an algorithm and says what its limit should be afterwards. full reports whether the
+// limiter was at its limit when the call finished; otherwise it was nearly idle.
+type limitStep struct {
+	rtt     time.Duration
+	full    bool
+	dropped bool
+	want    int
+}
+
+func runLimitSteps(t *testing.T, a LimitAlgorithm, steps []limitStep) {
+	t.Helper()
+	for i, s := range steps {
+		inFlight := 1
+		if s.full {
+			inFlight = a.Limit()
+		}
+		a.Update(s.rtt, inFlight, s.dropped)
+		if got := a.Limit(); got != s.want {
+			t.Fatalf("step %d (%+v): Limit() = %d; want %d", i, s, got, s.want)
+		}
+	}
+}
+
+func TestAIMD(t *testing.T) {
+	const ms = time.Millisecond
+	a := NewAIMD(LimitSettings{Initial: 10, Min: 2, Max: 12}, 0.5, 100*ms)
+	runLimitSteps(t, a, []limitStep{
+		{rtt: 10 * ms, full: true, want: 11},
+		{rtt: 10 * ms, want: 11}, // an underused limit does not grow
+		{rtt: 10 * ms, full: true, want: 12},
+		{rtt: 10 * ms, full: true, want: 12}, // clamped to Max
+		{rtt: 200 * ms, want: 6},             // slower than the timeout counts as a drop
+		{rtt: 10 * ms, dropped: true, want: 3},
+		{rtt: 10 * ms, dropped: true, want: 2}, // clamped to Min
+		{rtt: 10 * ms, dropped: true, want: 2},
+		{rtt: 10 * ms, full: true, want: 3},
+	})
+}
+
+func TestGradient(t *testing.T) {
+	const ms = time.Millisecond
+	g := NewGradient(LimitSettings{Initial: 20, Min: 5, Max: 40})
+	feed := func(n int, rtt time.Duration, dropped bool) (min, max int) {
+		min, max = g.Limit(), g.Limit()
+		for i := 0; i < n; i++ {
+			g.Update(rtt, g.Limit(), dropped)
+			if l := g.Limit(); l < min {
+				min = l
+			} else if l > max {
+				max = l
+			}
+		}
+		return min, max
+	}
+
+	// At the unloaded latency the limit only grows, up to Max.
+	if min, _ := feed(100, 10*ms, false); min != 20 || g.Limit() != 40 {
+		t.Fatalf("steady latency: limit went down to %d and ended at %d; want it to grow from 20 to 40", min, g.Limit())
+	}
+	g.Update(10*ms, 1, true)
+	if l := g.Limit(); l >= 40 {
+		t.Fatalf("a dropped call left the limit at %d", l)
+	}
+	g.Update(100*ms, 1, false)
+	before := g.Limit()
+	g.Update(100*ms, 1, false)
+	if g.Limit() != before {
+		t.Fatal("a call made with the limiter nearly idle moved the limit")
+	}
+	// Ten times the unloaded latency drives the limit down to Min.
+	if _, max := feed(200, 100*ms, false); max > before || g.Limit() != 5 {
+		t.Fatalf("high latency: limit rose to %d and ended at %d; want it to fall from %d to 5", max, g.Limit(), before)
+	}
+
+	// Once a whole window has passed at a new baseline of 30ms, that is the unloaded latency and the limit recovers.
+	feed(gradientWindow, 30*ms, false)
+	if g.Limit() != 5 {
+		t.Fatalf("limit = %d while the old 10ms minimum is still in the window; want 5", g.Limit())
+	}
+	feed(gradientWindow, 30*ms, false)
+	if _, max := feed(1, 30*ms, false); max <= 5 {
+		t.Fatal("limit did not grow once the new baseline was established")
+	}
+}
+
+func TestVegas(t *testing.T) {
+	const ms = time.Millisecond
+	v := NewVegas(LimitSettings{Initial: 10, Min: 2, Max: 14})
+	runLimitSteps(t, v, []limitStep{
+		// No queueing: grow by max(1, log10(limit)).
+		{rtt: 10 * ms, full: true, want: 11},
+		{rtt: 10 * ms, want: 11},
+		{rtt: 10 * ms, full: true, want: 12},
+		{rtt: 10 * ms, full: true, want: 13},
+		{rtt: 10 * ms, full: true, want: 14},
+		{rtt: 10 * ms, full: true, want: 14}, // clamped to Max
+		// At ten times the minimum nearly the whole limit is queued: shrink until the queue estimate of 0.9·limit
+		// falls below 6 steps.
+		{rtt: 100 * ms, full: true, want: 12},
+		{rtt: 100 * ms, full: true, want: 11},
+		{rtt: 100 * ms, full: true, want: 10},
+		{rtt: 100 * ms, full: true, want: 9},
+		{rtt: 100 * ms, full: true, want: 8},
+		{rtt: 100 * ms, full: true, want: 7},
+		{rtt: 100 * ms, full: true, want: 6},
+		{rtt: 100 * ms, full: true, want: 6}, // between 3 and 6 steps queued: hold
+		{rtt: 10 * ms, dropped: true, want: 5},
+		{rtt: 10 * ms, dropped: true, want: 4},
+		{rtt: 10 * ms, dropped: true, want: 3},
+		{rtt: 10 * ms, dropped: true, want: 2},
+		{rtt: 10 * ms, dropped: true, want: 2}, // clamped to Min
+	})
+}
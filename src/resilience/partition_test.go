@@ -0,0 +1,166 @@
+package resilience
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// named is a handler that answers with its name, so tests can tell which partition served a request.
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	})
+}
+
+func TestNewPartitionRouterValidates(t *testing.T) {
+	a := NewBulkhead(BulkheadSettings{}, named("a"))
+	bad := map[string]Partitioning{
+		"no partitions":   {},
+		"nil bulkhead":    {Partitions: map[string]*Bulkhead{"a": nil}},
+		"no handler":      {Partitions: map[string]*Bulkhead{"a": NewBulkhead(BulkheadSettings{}, nil)}},
+		"missing default": {Partitions: map[string]*Bulkhead{"a": a}, Default: "b"},
+	}
+	for name, p := range bad {
+		if l, err := NewPartitionRouter(p); err == nil {
+			t.Errorf("%s: NewPartitionRouter() = %v, nil; want an error", name, l)
+		}
+	}
+}
+
+func TestPartitionRouterRoutes(t *testing.T) {
+	partitions := map[string]*Bulkhead{}
+	for _, name := range []string{"admin", "a", "b", "c"} {
+		partitions[name] = NewBulkhead(BulkheadSettings{}, named(name))
+	}
+	routes := []Route{
+		PathPrefix("/admin/", "admin"),
+		HeaderValue("X-Partition"),
+		ConsistentHash(HeaderKey("X-Tenant-ID"), []string{"a", "b", "c"}, 0),
+	}
+	l, err := NewPartitionRouter(Partitioning{Partitions: partitions, Routes: routes, Default: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(path string, header ...string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if got := serve("/admin/users", "X-Partition", "b"); got != "admin" {
+		t.Errorf("admin path went to %q; want admin", got)
+	}
+	if got := serve("/", "X-Partition", "b"); got != "b" {
+		t.Errorf("X-Partition: b went to %q; want b", got)
+	}
+	// A route naming a partition that does not exist leaves the request to the next one.
+	if got := serve("/", "X-Partition", "z"); got != "c" {
+		t.Errorf("X-Partition: z went to %q; want the default, c", got)
+	}
+	if got := serve("/"); got != "c" {
+		t.Errorf("unrouted request went to %q; want the default, c", got)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		tenant := "tenant-" + strconv.Itoa(i)
+		first := serve("/", "X-Tenant-ID", tenant)
+		if again := serve("/", "X-Tenant-ID", tenant); again != first {
+			t.Fatalf("%s went to %q and then %q", tenant, first, again)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("100 tenants were hashed onto %v; want all of a, b and c", seen)
+	}
+
+	// Without a default, requests no route claims are rejected.
+	l, err = NewPartitionRouter(Partitioning{Partitions: partitions, Routes: routes[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unrouted request answered %d; want 503", w.Code)
+	}
+}
+
+// TestPartitionIsolation checks that a full partition spills into the overflow pool and then rejects requests, while
+// another partition keeps serving.
+func TestPartitionIsolation(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	noisy := NewBulkhead(BulkheadSettings{Capacity: 1, Pooled: true}, blockingHandler(started, release))
+	defer noisy.Close(context.Background())
+	l, err := NewPartitionRouter(Partitioning{
+		Partitions: map[string]*Bulkhead{
+			"noisy": noisy,
+			"quiet": NewBulkhead(BulkheadSettings{Capacity: 1}, named("quiet")),
+		},
+		Routes:   []Route{HeaderValue("X-Partition")},
+		Overflow: NewBulkhead(BulkheadSettings{Capacity: 1}, nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(partition string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Partition", partition)
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, r)
+		return w
+	}
+
+	// One request fills the noisy partition and the next takes the overflow pool's only slot.
+	done := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- serve("noisy") }()
+		<-started
+	}
+	if w := serve("noisy"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("noisy partition with a full overflow pool answered %d; want 503", w.Code)
+	}
+	if w := serve("quiet"); w.Code != http.StatusOK || w.Body.String() != "quiet" {
+		t.Errorf("quiet partition answered %d %q while the noisy one was full", w.Code, w.Body)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if w := <-done; w.Code != http.StatusOK {
+			t.Errorf("admitted noisy request answered %d", w.Code)
+		}
+	}
+}
+
+// TestConsistentHashMovesFewKeys checks that removing a partition from the ring only moves the keys it owned, and that
+// the keys are spread evenly.
+func TestConsistentHashMovesFewKeys(t *testing.T) {
+	const keys = 10000
+	four := ConsistentHash(HeaderKey("X-Key"), []string{"a", "b", "c", "d"}, 0)
+	three := ConsistentHash(HeaderKey("X-Key"), []string{"a", "b", "c"}, 0)
+	counts := map[string]int{}
+	for i := 0; i < keys; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Key", "key-"+strconv.Itoa(i))
+		before, _ := four(r)
+		after, _ := three(r)
+		counts[before]++
+		if before != "d" && after != before {
+			t.Fatalf("key-%d moved from %s to %s when d was removed", i, before, after)
+		}
+	}
+	for _, p := range []string{"a", "b", "c", "d"} {
+		if share := float64(counts[p]) / keys; share < 0.15 || share > 0.35 {
+			t.Errorf("partition %s got %.0f%% of the keys; want about 25%%", p, 100*share)
+		}
+	}
+	if _, ok := four(httptest.NewRequest("GET", "/", nil)); ok {
+		t.Error("a request without a key was routed")
+	}
+}
@@ -0,0 +1,204 @@
+package resilience
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pickers are the strategies under test, each built fresh for every run since pickers keep per-bulkhead state
+var pickers = []struct {
+	name string
+	new  func() Picker
+}{
+	{"RoundRobin", NewRoundRobin},
+	{"WeightedRoundRobin", func() Picker { return NewWeightedRoundRobin(nil) }},
+	{"PowerOfTwoChoices", NewPowerOfTwoChoices},
+	{"LeastOutstanding", NewLeastOutstanding},
+	{"EWMA", func() Picker { return NewEWMA(0) }},
+	{"RingHash", func() Picker { return NewRingHash(HeaderKey("X-Key"), 0) }},
+	{"Maglev", func() Picker { return NewMaglev(HeaderKey("X-Key")) }},
+}
+
+func newBulkheads(n int) []*Bulkhead {
+	bulkheads := make([]*Bulkhead, n)
+	for i := range bulkheads {
+		bulkheads[i] = NewBulkhead(BulkheadSettings{Capacity: 1000}, nil)
+	}
+	return bulkheads
+}
+
+// simulation is the outcome of sending requests through a picker
+type simulation struct {
+	counts []int // requests each bulkhead got
+	spread int   // the largest difference in load between two bulkheads seen by a pick after the first tenth
+}
+
+// simulate sends n requests through p, each with its own key, keeping inFlight of them outstanding: a request holds a
+// slot of its bulkhead until inFlight later requests have been picked, and then reports latency(i) for bulkhead i.
+func simulate(t testing.TB, p Picker, bulkheads []*Bulkhead, n, inFlight int,
+	latency func(i int) time.Duration) simulation {
+	s := simulation{counts: make([]int, len(bulkheads))}
+	var held []int
+	r := httptest.NewRequest("GET", "/", nil)
+	for k := 0; k < n; k++ {
+		lo, hi := math.MaxInt, 0
+		for _, b := range bulkheads {
+			l := load(b)
+			if l < lo {
+				lo = l
+			}
+			if l > hi {
+				hi = l
+			}
+		}
+		// Leave the pickers that learn from Done a while to warm up
+		if k >= n/10 && hi-lo > s.spread {
+			s.spread = hi - lo
+		}
+
+		r.Header.Set("X-Key", "key-"+strconv.Itoa(k))
+		i := p.Pick(r, bulkheads)
+		if !bulkheads[i].sem.tryAcquire() {
+			t.Fatalf("bulkhead %d is full", i)
+		}
+		s.counts[i]++
+		held = append(held, i)
+		if len(held) > inFlight {
+			j := held[0]
+			held = held[1:]
+			bulkheads[j].sem.release()
+			p.Done(j, latency(j))
+		}
+	}
+	for _, j := range held {
+		bulkheads[j].sem.release()
+	}
+	return s
+}
+
+func sameLatency(int) time.Duration { return time.Millisecond }
+
+// TestPickerFairness checks how evenly each picker spreads requests over equal bulkheads: the largest share any
+// bulkhead gets may exceed the fair one by at most maxSkew, and pickers that look at load must keep the loads of the
+// bulkheads within maxSpread of each other.
+func TestPickerFairness(t *testing.T) {
+	const bulkheads, requests, inFlight = 8, 80000, 40
+	limits := map[string]struct {
+		maxSkew   float64
+		maxSpread int
+	}{
+		"RoundRobin":         {0, inFlight},
+		"WeightedRoundRobin": {0, inFlight},
+		// Sampling two bulkheads keeps the loads within 12 of each other here, closer than hashing does
+		"PowerOfTwoChoices": {0.02, 12},
+		"LeastOutstanding":  {0.01, 1},
+		"EWMA":              {0.02, 12},
+		"RingHash":          {0.25, inFlight},
+		"Maglev":            {0.05, inFlight},
+	}
+	for _, p := range pickers {
+		t.Run(p.name, func(t *testing.T) {
+			limit := limits[p.name]
+			pickerRand.Lock()
+			pickerRand.Seed(1)
+			pickerRand.Unlock()
+			s := simulate(t, p.new(), newBulkheads(bulkheads), requests, inFlight, sameLatency)
+			fair := float64(requests) / bulkheads
+			worst := 0.0
+			for _, c := range s.counts {
+				worst = math.Max(worst, math.Abs(float64(c)-fair)/fair)
+			}
+			if worst > limit.maxSkew {
+				t.Errorf("counts = %v: a share is %.1f%% off the fair one; want at most %.1f%%",
+					s.counts, 100*worst, 100*limit.maxSkew)
+			}
+			if s.spread > limit.maxSpread {
+				t.Errorf("bulkhead loads differed by up to %d; want at most %d", s.spread, limit.maxSpread)
+			}
+		})
+	}
+}
+
+func TestWeightedRoundRobinIsSmooth(t *testing.T) {
+	weights := []int{5, 1, 1}
+	p := NewWeightedRoundRobin(weights)
+	bulkheads := newBulkheads(len(weights))
+	var got []int
+	for k := 0; k < 14; k++ {
+		got = append(got, p.Pick(nil, bulkheads))
+	}
+	// nginx's example: the heavy bulkhead's turns are interleaved with the others', not sent in a burst
+	want := []int{0, 0, 1, 0, 2, 0, 0, 0, 0, 1, 0, 2, 0, 0}
+	for k := range want {
+		if got[k] != want[k] {
+			t.Fatalf("picks = %v; want %v", got, want)
+		}
+	}
+}
+
+// TestEWMAAvoidsSlowBulkhead checks that a bulkhead ten times slower than the others gets well under its fair share.
+func TestEWMAAvoidsSlowBulkhead(t *testing.T) {
+	const bulkheads, requests = 4, 20000
+	s := simulate(t, NewEWMA(0), newBulkheads(bulkheads), requests, 20, func(i int) time.Duration {
+		if i == 0 {
+			return 10 * time.Millisecond
+		}
+		return time.Millisecond
+	})
+	if share := float64(s.counts[0]) / requests; share > 0.5/bulkheads {
+		t.Fatalf("counts = %v: the slow bulkhead got %.1f%% of the requests; want under %.1f%%",
+			s.counts, 100*share, 50.0/bulkheads)
+	}
+}
+
+// TestHashPickersAreSticky checks that the hashing pickers send a key to the same bulkhead every time, and that keyless
+// requests are still spread over all of them.
+func TestHashPickersAreSticky(t *testing.T) {
+	for _, p := range pickers {
+		if p.name != "RingHash" && p.name != "Maglev" {
+			continue
+		}
+		t.Run(p.name, func(t *testing.T) {
+			picker, bulkheads := p.new(), newBulkheads(5)
+			r := httptest.NewRequest("GET", "/", nil)
+			for k := 0; k < 1000; k++ {
+				r.Header.Set("X-Key", "session-"+strconv.Itoa(k))
+				first := picker.Pick(r, bulkheads)
+				if again := picker.Pick(r, bulkheads); again != first {
+					t.Fatalf("session-%d went to %d and then %d", k, first, again)
+				}
+			}
+			r.Header.Del("X-Key")
+			seen := map[int]bool{}
+			for k := 0; k < len(bulkheads); k++ {
+				seen[picker.Pick(r, bulkheads)] = true
+			}
+			if len(seen) != len(bulkheads) {
+				t.Fatalf("keyless requests went to %v; want every bulkhead", seen)
+			}
+		})
+	}
+}
+
+func BenchmarkPickers(b *testing.B) {
+	for _, p := range pickers {
+		b.Run(p.name, func(b *testing.B) {
+			picker, bulkheads := p.new(), newBulkheads(16)
+			b.RunParallel(func(pb *testing.PB) {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header = http.Header{}
+				k := 0
+				for pb.Next() {
+					r.Header.Set("X-Key", "key-"+strconv.Itoa(k))
+					k++
+					i := picker.Pick(r, bulkheads)
+					picker.Done(i, time.Millisecond)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePolicyFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string // substrings the error must contain
+	}{
+		{"syntax", "{\n  \"dependencies\": {\n    \"a\": {,}\n  }\n}", []string{"line 3, column"}},
+		{"type", `{"dependencies": {"a": {"timeout": 5}}}`, []string{"line 1, column", "duration must be a string"}},
+		{"wrong type", `{"dependencies": {"a": {"bulkhead": {"max_concurrent": "ten"}}}}`,
+			[]string{"line 1, column", "max_concurrent", "expected int"}},
+		{"unknown field", `{"dependencies": {"a": {"bulkhead": {"max_concurent": 10}}}}`,
+			[]string{"line 1, column", "max_concurent"}},
+		{"trailing object", `{"dependencies": {}} {"dependencies": {}}`, []string{"line 1, column 22", "after the policy"}},
+		{"trailing brace", "{\"dependencies\": {}}\n}", []string{"line 2, column 1", "after the policy"}},
+		{"trailing text", `{"dependencies": {}} yaml: true`, []string{"after the policy"}},
+		{"empty name", `{"dependencies": {"": {}}}`, []string{"dependency name must not be empty"}},
+		{"negative timeout", `{"dependencies": {"a": {"timeout": "-1s"}}}`,
+			[]string{"dependencies.a.timeout: must not be negative"}},
+		{"breaker", `{"dependencies": {"a": {"breaker": {"threshold": -1, "open_timeout": "-1s",
+			"half_open_max_requests": -1, "slow_call_duration": "-1s"}}}}`,
+			[]string{
+				"dependencies.a.breaker.threshold: must not be negative",
+				"dependencies.a.breaker.open_timeout: must not be negative",
+				"dependencies.a.breaker.half_open_max_requests: must not be negative",
+				"dependencies.a.breaker.slow_call_duration: must not be negative",
+			}},
+		{"count window", `{"dependencies": {"a": {"breaker": {"window": {"type": "count", "min_calls": -1,
+			"failure_rate": 101}}}}}`,
+			[]string{
+				"window.size: must be positive for a count window",
+				"window.min_calls: must not be negative",
+				"window.failure_rate: must be a percentage",
+			}},
+		{"time window", `{"dependencies": {"a": {"breaker": {"window": {"type": "time", "duration": "5ns",
+			"buckets": 10, "slow_call_rate": 50}}}}}`,
+			[]string{
+				"window.buckets: 10 buckets are more than 5ns can be split into",
+				"window.slow_call_rate: needs breaker.slow_call_duration",
+			}},
+		{"window type", `{"dependencies": {"a": {"breaker": {"window": {"type": "sliding", "failure_rate": 50}}}}}`,
+			[]string{`window.type: must be "count" or "time", got "sliding"`}},
+		{"window never trips", `{"dependencies": {"a": {"breaker": {"window": {"type": "count", "size": 10}}}}}`,
+			[]string{"window: needs a failure_rate or a slow_call_rate"}},
+		{"bulkhead", `{"dependencies": {"a": {"bulkhead": {"queue_size": -1, "max_wait": "-1s"}}}}`,
+			[]string{
+				"bulkhead.max_concurrent: must be positive",
+				"bulkhead.queue_size: must not be negative",
+				"bulkhead.max_wait: must not be negative",
+			}},
+		{"bulkhead wait without queue", `{"dependencies": {"a": {"bulkhead": {"max_concurrent": 1, "max_wait": "1s"}}}}`,
+			[]string{"bulkhead.max_wait: has no effect without a queue_size"}},
+		{"retry", `{"dependencies": {"a": {"retry": {"max_attempts": -1, "base_delay": "2s", "max_delay": "1s",
+			"jitter": "none", "budget_ratio": -1, "budget_capacity": -1}}}}`,
+			[]string{
+				"retry.max_attempts: must not be negative",
+				"retry.max_delay: 1s is less than base_delay 2s",
+				`retry.jitter: must be "full" or "decorrelated", got "none"`,
+				"retry.budget_ratio: must not be negative",
+				"retry.budget_capacity: must not be negative",
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicyFile([]byte(tt.data))
+			if err == nil {
+				t.Fatal("ParsePolicyFile() = nil")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestPolicyErrorListsEveryProblem checks that problems in several dependencies are all reported, in name order.
+func TestPolicyErrorListsEveryProblem(t *testing.T) {
+	_, err := ParsePolicyFile([]byte(`{"dependencies": {
+		"b": {"timeout": "-1s"},
+		"a": {"bulkhead": {"max_concurrent": 0}}
+	}}`))
+	var perr PolicyError
+	if !errors.As(err, &perr) {
+		t.Fatalf("error %v is not a PolicyError", err)
+	}
+	want := PolicyError{
+		"dependencies.a.bulkhead.max_concurrent: must be positive",
+		"dependencies.b.timeout: must not be negative",
+	}
+	if strings.Join(perr, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("PolicyError = %q; want %q", perr, want)
+	}
+}
+
+func writePolicy(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"dependencies": {
+		"payments": {"breaker": {"threshold": 2}, "bulkhead": {"max_concurrent": 1}},
+		"search": {"timeout": "1s"}
+	}}`)
+	p, err := LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, ok := p.Get("payments")
+	if !ok || payments.Breaker() == nil || payments.bulkhead == nil {
+		t.Fatalf("Get(payments) = %+v, %v; want a breaker and a bulkhead", payments, ok)
+	}
+	if _, ok := p.Get("search"); !ok {
+		t.Fatal("Get(search) reported false")
+	}
+	payments.Breaker().RecordFailure(allow(t, payments.Breaker()))
+
+	// Changing only the bulkhead keeps the breaker and its recorded failure.
+	writePolicy(t, path, `{"dependencies": {
+		"payments": {"breaker": {"threshold": 2}, "bulkhead": {"max_concurrent": 2}}
+	}}`)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := p.Get("payments")
+	if reloaded.Breaker() != payments.Breaker() {
+		t.Error("an unchanged breaker was replaced")
+	}
+	if reloaded.bulkhead == payments.bulkhead || cap(reloaded.bulkhead.slots) != 2 {
+		t.Error("a resized bulkhead was kept")
+	}
+	if _, ok := p.Get("search"); ok {
+		t.Error("a removed dependency is still there")
+	}
+	reloaded.Breaker().RecordFailure(allow(t, reloaded.Breaker()))
+	if reloaded.Breaker().State() != StateOpen {
+		t.Error("the failure recorded before the reload was lost")
+	}
+
+	// An invalid file leaves the current policies in place.
+	writePolicy(t, path, `{"dependencies": {"payments": {"bulkhead": {"max_concurrent": -1}}}}`)
+	err = p.Reload()
+	if err == nil || !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), "max_concurrent") {
+		t.Fatalf("Reload() = %v; want an error naming the file and the field", err)
+	}
+	if d, _ := p.Get("payments"); d != reloaded {
+		t.Error("a failed reload replaced the policies")
+	}
+}
+
+func TestPoliciesWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, path, `{"dependencies": {"payments": {"timeout": "1s"}}}`)
+	p, err := LoadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		reloads []error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Watch(ctx, 5*time.Millisecond, func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reloads = append(reloads, err)
+		})
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(reloads)
+	}
+
+	// Size changes are enough to notice a rewrite even within the file system's timestamp resolution.
+	writePolicy(t, path, `{"dependencies": {"payments": {"timeout": "1s"}, "search": {}}}`)
+	eventually(t, "the change to be picked up", func() bool { _, ok := p.Get("search"); return ok })
+
+	writePolicy(t, path, `{"dependencies": {"payments": {"timeout": "-1s"}, "search": {}}}`)
+	eventually(t, "the broken file to be reported", func() bool { return count() == 2 })
+	// The broken file is reported once, not on every tick.
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(reloads) != 2 || reloads[0] != nil || reloads[1] == nil {
+		t.Errorf("reloads = %v; want [nil, error]", reloads)
+	}
+	mu.Unlock()
+
+	cancel()
+	<-done
+}
+
+func TestCallBulkheadFull(t *testing.T) {
+	f, err := ParsePolicyFile([]byte(`{"dependencies": {"payments": {"bulkhead": {"max_concurrent": 1}}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDependency("payments", f.Dependencies["payments"], nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	go Call(context.Background(), d, true, func(context.Context) (int, error) {
+		close(started)
+		<-release
+		return 0, nil
+	})
+	<-started
+	one := func(context.Context) (int, error) { return 1, nil }
+	if _, err := Call(context.Background(), d, true, one); err != ErrBulkheadFull {
+		t.Fatalf("Call on a full bulkhead = %v; want ErrBulkheadFull", err)
+	}
+	close(release)
+	eventually(t, "the slot to be freed", func() bool { return d.InFlight() == 0 })
+	if v, err := Call(context.Background(), d, true, one); v != 1 || err != nil {
+		t.Fatalf("Call = %d, %v; want 1, nil", v, err)
+	}
+}
+
+func TestParsePolicyFileTrailingSpace(t *testing.T) {
+	if _, err := ParsePolicyFile([]byte("{\"dependencies\": {}}\n\n")); err != nil {
+		t.Fatalf("ParsePolicyFile with trailing newlines = %v", err)
+	}
+}
+
+// TestCallBulkheadQueue checks that a call queues for a slot, gives up after max_wait, and that only queue_size calls
+// may wait at once.
+func TestCallBulkheadQueue(t *testing.T) {
+	f, err := ParsePolicyFile([]byte(`{"dependencies": {"payments": {
+		"bulkhead": {"max_concurrent": 1, "queue_size": 1, "max_wait": "200ms"}
+	}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDependency("payments", f.Dependencies["payments"], nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	go Call(context.Background(), d, false, func(context.Context) (int, error) {
+		close(started)
+		<-release
+		return 0, nil
+	})
+	<-started
+	one := func(context.Context) (int, error) { return 1, nil }
+	if _, err := Call(context.Background(), d, false, one); err != ErrBulkheadFull {
+		t.Fatalf("Call that waited past max_wait = %v; want ErrBulkheadFull", err)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := Call(context.Background(), d, false, one)
+		queued <- err
+	}()
+	eventually(t, "the call to queue", func() bool { return len(d.bulkhead.queue) == 1 })
+	if _, err := Call(context.Background(), d, false, one); err != ErrBulkheadFull {
+		t.Fatalf("Call with the queue full = %v; want ErrBulkheadFull", err)
+	}
+	close(release)
+	if err := <-queued; err != nil {
+		t.Fatalf("queued Call = %v; want it to get the freed slot", err)
+	}
+}
@@ -0,0 +1,290 @@
+package resilience
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts a Proxy over upstreams behind a local server, and stops both when the test ends.
+func newTestProxy(t *testing.T, s ProxySettings) (*Proxy, *httptest.Server) {
+	t.Helper()
+	p, err := NewProxy(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(func() {
+		srv.Close()
+		p.Close(context.Background())
+	})
+	return p, srv
+}
+
+// get requests url and returns the status and body of the response
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestNewProxyValidates(t *testing.T) {
+	for _, upstreams := range [][]string{nil, {"://bad"}, {"/relative"}, {"ftp://host/"}} {
+		if p, err := NewProxy(ProxySettings{Upstreams: upstreams}); err == nil {
+			p.Close(context.Background())
+			t.Errorf("NewProxy(%q) succeeded; want an error", upstreams)
+		}
+	}
+}
+
+func TestProxyForwards(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range []string{"X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-For"} {
+			w.Header().Set("Got-"+h, r.Header.Get(h))
+		}
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+	_, srv := newTestProxy(t, ProxySettings{Upstreams: []string{backend.URL + "/base"}})
+
+	req, err := http.NewRequest("GET", srv.URL+"/items?id=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "shop.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "/base/items?id=1" {
+		t.Fatalf("proxied response = %d %q; want 200 /base/items?id=1", resp.StatusCode, body)
+	}
+	want := map[string]string{
+		"X-Forwarded-Host":  "shop.example.com",
+		"X-Forwarded-Proto": "http",
+		"X-Forwarded-For":   "127.0.0.1",
+	}
+	for h, v := range want {
+		if got := resp.Header.Get("Got-" + h); got != v {
+			t.Errorf("upstream got %s %q; want %q", h, got, v)
+		}
+	}
+}
+
+// TestProxyStreams checks that the start of a response reaches the client before the upstream has finished it.
+func TestProxyStreams(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+	_, srv := newTestProxy(t, ProxySettings{Upstreams: []string{backend.URL}})
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	select {
+	case line := <-lines:
+		if line != "first\n" {
+			t.Fatalf("first line = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first line did not arrive before the upstream finished the response")
+	}
+	release <- struct{}{}
+	if line := <-lines; line != "second\n" {
+		t.Fatalf("second line = %q", line)
+	}
+}
+
+// namedBackend answers with its name, and its health check with whatever healthy says.
+func namedBackend(t *testing.T, name string, healthy *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && atomic.LoadInt32(healthy) == 0 {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProxyHealthChecks(t *testing.T) {
+	healthyA, healthyB := int32(1), int32(1)
+	a, b := namedBackend(t, "a", &healthyA), namedBackend(t, "b", &healthyB)
+	_, srv := newTestProxy(t, ProxySettings{
+		Upstreams:           []string{a.URL, b.URL},
+		Picker:              NewRoundRobin(),
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+	// served reports which upstreams answered a handful of requests
+	served := func() map[string]bool {
+		seen := map[string]bool{}
+		for i := 0; i < 4; i++ {
+			if code, body := get(t, srv.URL); code == http.StatusOK {
+				seen[body] = true
+			}
+		}
+		return seen
+	}
+
+	eventually(t, "both upstreams to get traffic", func() bool { return len(served()) == 2 })
+	atomic.StoreInt32(&healthyB, 0)
+	eventually(t, "the unhealthy upstream to be removed", func() bool {
+		seen := served()
+		return len(seen) == 1 && seen["a"]
+	})
+	atomic.StoreInt32(&healthyB, 1)
+	eventually(t, "the recovered upstream to be restored", func() bool { return served()["b"] })
+}
+
+// TestProxyEjectsAfterConsecutiveFailures checks that an upstream is ejected on its EjectAfter-th 5xx in a row, not
+// before, and gets traffic again once EjectionTime is up by the proxy's clock.
+func TestProxyEjectsAfterConsecutiveFailures(t *testing.T) {
+	var healthy int32 = 1
+	a := namedBackend(t, "a", &healthy)
+	var (
+		mu       sync.Mutex
+		statuses = []int{500, 500, 200, 404, 500, 500, 500} // what b answers, in turn; 200 once they run out
+		hits     int
+	)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		code := http.StatusOK
+		if hits < len(statuses) {
+			code = statuses[hits]
+		}
+		hits++
+		mu.Unlock()
+		w.WriteHeader(code)
+		io.WriteString(w, "b")
+	}))
+	defer b.Close()
+	bHits := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits
+	}
+	const ejectionTime = 30 * time.Second
+	clock := newFakeClock()
+	_, srv := newTestProxy(t, ProxySettings{
+		Upstreams:    []string{a.URL, b.URL},
+		Picker:       NewRoundRobin(),
+		EjectAfter:   3,
+		EjectionTime: ejectionTime,
+		Clock:        clock,
+	})
+
+	// Round-robin alternates a and b. The success and the 404 break up b's first failures, so only the last three in a
+	// row eject it.
+	for i := 0; i < 2*len(statuses); i++ {
+		get(t, srv.URL)
+	}
+	if n := bHits(); n != len(statuses) {
+		t.Fatalf("b got %d requests before it should be ejected; want %d", n, len(statuses))
+	}
+	clock.Advance(ejectionTime - time.Nanosecond)
+	for i := 0; i < 4; i++ {
+		if code, body := get(t, srv.URL); code != http.StatusOK || body != "a" {
+			t.Fatalf("request during the ejection got %d %q; want 200 from a", code, body)
+		}
+	}
+
+	clock.Advance(time.Nanosecond)
+	for i := 0; i < 2; i++ {
+		get(t, srv.URL)
+	}
+	if n := bHits(); n != len(statuses)+1 {
+		t.Fatalf("b got %d of 2 requests after EjectionTime was up; want 1", n-len(statuses))
+	}
+}
+
+// firstPicker always picks the first upstream.
+type firstPicker struct{}
+
+func (firstPicker) Pick(*http.Request, []*Bulkhead) int { return 0 }
+func (firstPicker) Done(int, time.Duration)             {}
+
+// TestProxySpreadsUnavailableTraffic checks that requests the picker sends to an unhealthy upstream are shared by the
+// available ones rather than all going to the next upstream in the list.
+func TestProxySpreadsUnavailableTraffic(t *testing.T) {
+	healthyA, healthyB, healthyC := int32(0), int32(1), int32(1)
+	_, srv := newTestProxy(t, ProxySettings{
+		Upstreams: []string{
+			namedBackend(t, "a", &healthyA).URL,
+			namedBackend(t, "b", &healthyB).URL,
+			namedBackend(t, "c", &healthyC).URL,
+		},
+		Picker:              firstPicker{},
+		HealthCheckPath:     "/healthz",
+		HealthCheckInterval: 10 * time.Millisecond,
+	})
+
+	eventually(t, "a's traffic to be spread over b and c", func() bool {
+		counts := map[string]int{}
+		for i := 0; i < 6; i++ {
+			_, body := get(t, srv.URL)
+			counts[body]++
+		}
+		return counts["b"] == 3 && counts["c"] == 3
+	})
+}
+
+func TestProxyCloseClosesBulkheads(t *testing.T) {
+	var healthy int32 = 1
+	a := namedBackend(t, "a", &healthy)
+	p, err := NewProxy(ProxySettings{Upstreams: []string{a.URL}, Bulkhead: BulkheadSettings{Pooled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Fatalf("proxied response = %d %q; want 200 a", w.Code, w.Body)
+	}
+
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("closed proxy answered %d; want 503 from the closed bulkhead", w.Code)
+	}
+}
@@ -0,0 +1,91 @@
+package resilience
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const wantExposition = `# HELP circuit_breaker_state Current state of the circuit: 0 closed, 1 open, 2 half-open.
+# TYPE circuit_breaker_state gauge
+circuit_breaker_state{name="api"} 2
+circuit_breaker_state{name="we\"ird\\name"} 0
+# HELP circuit_breaker_calls_total Calls recorded by the breaker, by result.
+# TYPE circuit_breaker_calls_total counter
+circuit_breaker_calls_total{name="api",result="success"} 1
+circuit_breaker_calls_total{name="api",result="failure"} 1
+circuit_breaker_calls_total{name="we\"ird\\name",result="success"} 0
+circuit_breaker_calls_total{name="we\"ird\\name",result="failure"} 0
+# HELP circuit_breaker_rejections_total Requests rejected because the circuit was not closed.
+# TYPE circuit_breaker_rejections_total counter
+circuit_breaker_rejections_total{name="api"} 1
+circuit_breaker_rejections_total{name="we\"ird\\name"} 0
+# HELP circuit_breaker_slow_calls_total Calls that took longer than the slow call duration.
+# TYPE circuit_breaker_slow_calls_total counter
+circuit_breaker_slow_calls_total{name="api"} 1
+circuit_breaker_slow_calls_total{name="we\"ird\\name"} 0
+# HELP circuit_breaker_shared_state_errors_total Failed reads and writes of the shared state.
+# TYPE circuit_breaker_shared_state_errors_total counter
+circuit_breaker_shared_state_errors_total{name="api"} 0
+circuit_breaker_shared_state_errors_total{name="we\"ird\\name"} 0
+# HELP circuit_breaker_state_seconds_total Time spent in each state.
+# TYPE circuit_breaker_state_seconds_total counter
+circuit_breaker_state_seconds_total{name="api",state="closed"} 2.5
+circuit_breaker_state_seconds_total{name="api",state="open"} 10
+circuit_breaker_state_seconds_total{name="api",state="half-open"} 5
+circuit_breaker_state_seconds_total{name="we\"ird\\name",state="closed"} 17.5
+circuit_breaker_state_seconds_total{name="we\"ird\\name",state="open"} 0
+circuit_breaker_state_seconds_total{name="we\"ird\\name",state="half-open"} 0
+`
+
+// TestRegistryExposition scrapes two breakers, one of them lazily half-open, and compares the result with the expected
+// exposition text.
+func TestRegistryExposition(t *testing.T) {
+	clock := newFakeClock()
+	api := NewCircuitBreaker(Settings{
+		Threshold:        1,
+		OpenTimeout:      10 * time.Second,
+		SlowCallDuration: time.Second,
+		Clock:            clock,
+	})
+	idle := NewCircuitBreaker(Settings{Clock: clock})
+	r := NewRegistry()
+	if err := r.Register("api", api); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(`we"ird\name`, idle); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("api", idle); err == nil {
+		t.Fatal("registering a name twice succeeded")
+	}
+
+	api.Record(allow(t, api), false, 2*time.Second)
+	clock.Advance(2500 * time.Millisecond)
+	api.RecordFailure(allow(t, api))
+	clock.Advance(5 * time.Second)
+	if _, ok := api.AllowRequest(); ok {
+		t.Fatal("open circuit allowed a request")
+	}
+	clock.Advance(10 * time.Second)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if got := w.Body.String(); got != wantExposition {
+			t.Fatalf("scrape %d:\n%s\nwant:\n%s", i, got, wantExposition)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+	}
+	if api.state != StateOpen {
+		t.Fatalf("scraping moved the circuit to %v", api.state)
+	}
+
+	r.Unregister("api")
+	if _, ok := r.Get("api"); ok {
+		t.Fatal("Get found an unregistered breaker")
+	}
+}
@@ -0,0 +1,195 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// failing returns a call that fails with err the first n times and then succeeds, counting its attempts in calls.
+func failing(n int, err error, calls *int) func(context.Context) (int, error) {
+	return func(context.Context) (int, error) {
+		*calls++
+		if *calls <= n {
+			return 0, err
+		}
+		return *calls, nil
+	}
+}
+
+func TestRetry(t *testing.T) {
+	errBoom := errors.New("boom")
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	quick := RetryPolicy{BaseDelay: time.Microsecond, MaxDelay: time.Microsecond}
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		idempotent bool
+		failures   int
+		err        error
+		wantCalls  int
+		wantErr    error
+	}{
+		{"succeeds after retries", quick, true, 2, errBoom, 3, nil},
+		{"runs out of attempts", quick, true, 5, errBoom, 3, errBoom},
+		{"more attempts", RetryPolicy{MaxAttempts: 6, BaseDelay: time.Microsecond}, true, 5, errBoom, 6, nil},
+		{"non-idempotent call is not repeated", quick, false, 1, errBoom, 1, errBoom},
+		{"non-idempotent call is repeated after a failed dial", quick, false, 1, dialErr, 2, nil},
+		{"custom classifier", RetryPolicy{
+			BaseDelay: time.Microsecond,
+			Retryable: func(err error, _ bool) bool { return !errors.Is(err, errBoom) },
+		}, true, 1, errBoom, 1, errBoom},
+		{"budget", RetryPolicy{
+			MaxAttempts: 10,
+			BaseDelay:   time.Microsecond,
+			Budget:      NewRetryBudget(0, 2),
+		}, true, 10, errBoom, 3, errBoom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			_, err := Retry(context.Background(), tt.policy, tt.idempotent, failing(tt.failures, tt.err, &calls))
+			if !errors.Is(err, tt.wantErr) || calls != tt.wantCalls {
+				t.Fatalf("Retry = %v after %d calls; want %v after %d", err, calls, tt.wantErr, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	// The backoff is far longer than the test; only the cancellation can end the wait.
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour, Jitter: DecorrelatedJitter}
+	_, err := Retry(ctx, p, true, failing(10, errors.New("boom"), &calls))
+	if err == nil || calls != 1 {
+		t.Fatalf("Retry = %v after %d calls; want the first error", err, calls)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Retry waited %v after the context was cancelled", d)
+	}
+}
+
+// TestRetryStopsWhenBreakerOpens checks that retrying stops once the attempts have tripped the breaker, even with a
+// classifier that would retry anything.
+func TestRetryStopsWhenBreakerOpens(t *testing.T) {
+	errBoom := errors.New("boom")
+	cb := NewCircuitBreaker(Settings{Threshold: 2, Clock: newFakeClock()})
+	calls := 0
+	_, err := Retry(context.Background(), RetryPolicy{
+		MaxAttempts: 10,
+		BaseDelay:   time.Microsecond,
+		Retryable:   func(error, bool) bool { return true },
+		Breaker:     cb,
+	}, true, failing(10, errBoom, &calls))
+	if !errors.Is(err, errBoom) || calls != 2 {
+		t.Fatalf("Retry = %v after %d calls; want %v after 2", err, calls, errBoom)
+	}
+
+	// With the circuit already open nothing is attempted.
+	calls = 0
+	_, err = Retry(context.Background(), RetryPolicy{BaseDelay: time.Microsecond, Breaker: cb}, true,
+		failing(0, nil, &calls))
+	if !errors.Is(err, ErrCircuitOpen) || calls != 0 {
+		t.Fatalf("Retry on an open circuit = %v after %d calls; want ErrCircuitOpen and no calls", err, calls)
+	}
+}
+
+func TestDefaultRetryable(t *testing.T) {
+	tests := []struct {
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{errors.New("boom"), true, true},
+		{errors.New("boom"), false, false},
+		{&net.OpError{Op: "dial", Err: errors.New("refused")}, false, true},
+		{fmt.Errorf("get: %w", &net.OpError{Op: "dial", Err: errors.New("refused")}), false, true},
+		{&net.OpError{Op: "read", Err: errors.New("reset")}, false, false},
+		{ErrCircuitOpen, true, false},
+		{fmt.Errorf("call: %w", ErrCircuitOpen), true, false},
+	}
+	for _, tt := range tests {
+		if got := DefaultRetryable(tt.err, tt.idempotent); got != tt.want {
+			t.Errorf("DefaultRetryable(%v, %v) = %v; want %v", tt.err, tt.idempotent, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelays(t *testing.T) {
+	full := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, limit := range map[int]time.Duration{
+		1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second,
+		40: time.Second, 1000: time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			if d := full.nextDelay(retry, 0); d < 0 || d >= limit {
+				t.Fatalf("full jitter delay before retry %d = %v; want within [0, %v)", retry, d, limit)
+			}
+		}
+	}
+
+	// Shifting a large BaseDelay used to overflow into a negative backoff.
+	huge := RetryPolicy{BaseDelay: time.Hour, MaxDelay: 24 * time.Hour}
+	for _, retry := range []int{10, 20, 33, 40, 62, 63, 64} {
+		if d := huge.nextDelay(retry, 0); d < 0 || d >= 24*time.Hour {
+			t.Fatalf("full jitter delay before retry %d = %v; want within [0, 24h)", retry, d)
+		}
+	}
+
+	decorrelated := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, Jitter: DecorrelatedJitter}
+	prev := decorrelated.BaseDelay
+	for i := 0; i < 1000; i++ {
+		hi := 3 * prev
+		if hi > decorrelated.MaxDelay {
+			hi = decorrelated.MaxDelay
+		}
+		d := decorrelated.nextDelay(i+1, prev)
+		if d < decorrelated.BaseDelay || d > hi {
+			t.Fatalf("decorrelated delay after %v = %v; want within [100ms, %v]", prev, d, hi)
+		}
+		prev = d
+	}
+	if d := (RetryPolicy{BaseDelay: time.Second, MaxDelay: 1<<63 - 1, Jitter: DecorrelatedJitter}).nextDelay(2,
+		1<<62); d < time.Second {
+		t.Fatalf("decorrelated delay with a huge previous delay = %v; want at least BaseDelay", d)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := NewRetryBudget(0.5, 2)
+	for i := 0; i < 2; i++ {
+		if !b.withdraw() {
+			t.Fatalf("a new budget refused retry %d", i)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("an empty budget allowed a retry")
+	}
+	b.deposit()
+	if b.withdraw() {
+		t.Fatal("half a token allowed a retry")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Fatal("two calls at ratio 0.5 did not pay for a retry")
+	}
+	for i := 0; i < 10; i++ {
+		b.deposit()
+	}
+	n := 0
+	for b.withdraw() {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("budget saved up %d retries; want its capacity of 2", n)
+	}
+}
@@ -0,0 +1,174 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventually polls cond until it holds, for the shared state reads and writes that breakers make in the background.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// idle reports whether cb has no read or write of the shared state in flight.
+func idle(cb *CircuitBreaker) bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return !cb.syncing && !cb.publishing
+}
+
+// TestMemoryStateSingleProber checks that a trip on one replica opens the circuit on all of them, that only one
+// replica sends trial requests once it is half-open, and that its success closes the circuit everywhere.
+func TestMemoryStateSingleProber(t *testing.T) {
+	clock := newFakeClock()
+	shared := NewMemoryState(clock)
+	replicas := make([]*CircuitBreaker, 5)
+	for i := range replicas {
+		replicas[i] = NewCircuitBreaker(Settings{
+			Threshold:    1,
+			OpenTimeout:  10 * time.Second,
+			SyncInterval: time.Second,
+			Clock:        clock,
+			Shared:       shared,
+			Name:         "payments",
+		})
+	}
+	// syncAll makes every replica read the shared state and waits until they have.
+	syncAll := func() {
+		t.Helper()
+		clock.Advance(time.Second)
+		for _, cb := range replicas {
+			cb.AllowRequest()
+		}
+		eventually(t, "replicas to sync", func() bool {
+			for _, cb := range replicas {
+				if !idle(cb) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	states := func(want State) func() bool {
+		return func() bool {
+			for _, cb := range replicas {
+				if cb.State() != want {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	replicas[0].RecordFailure(allow(t, replicas[0]))
+	eventually(t, "the trip to be published", func() bool {
+		_, tripped, _ := shared.Status(context.Background(), "payments")
+		return tripped
+	})
+	syncAll()
+	if !states(StateOpen)() {
+		t.Fatal("a trip on one replica did not open the circuit on the others")
+	}
+
+	clock.Advance(10 * time.Second)
+	syncAll()
+	if !states(StateHalfOpen)() {
+		t.Fatal("replicas did not move to half-open")
+	}
+	var probers []*CircuitBreaker
+	var generation uint64
+	for _, cb := range replicas {
+		if g, ok := cb.AllowRequest(); ok {
+			probers, generation = append(probers, cb), g
+		}
+	}
+	if len(probers) != 1 {
+		t.Fatalf("%d replicas sent a trial request; want exactly 1", len(probers))
+	}
+	probers[0].RecordSuccess(generation)
+	eventually(t, "the reset to be published", func() bool {
+		_, tripped, _ := shared.Status(context.Background(), "payments")
+		return !tripped
+	})
+	syncAll()
+	if !states(StateClosed)() {
+		t.Fatal("a successful probe did not close the circuit on every replica")
+	}
+	for i, cb := range replicas {
+		if n := cb.Metrics().SharedStateErrors; n != 0 {
+			t.Errorf("replica %d: SharedStateErrors = %d", i, n)
+		}
+	}
+}
+
+// blockingState is a SharedState whose writes wait for release and then fail.
+type blockingState struct {
+	*MemoryState
+	release chan struct{}
+}
+
+var errBackend = errors.New("backend unavailable")
+
+func (b blockingState) Trip(context.Context, string, time.Time) error {
+	<-b.release
+	return errBackend
+}
+
+func (b blockingState) Reset(context.Context, string) error {
+	<-b.release
+	return errBackend
+}
+
+// TestPublishIsAsynchronous checks that a slow backend does not hold up the calls that change the state, and that
+// failed writes are reported.
+func TestPublishIsAsynchronous(t *testing.T) {
+	clock := newFakeClock()
+	shared := blockingState{NewMemoryState(clock), make(chan struct{})}
+	var mu sync.Mutex
+	var errs []error
+	cb := NewCircuitBreaker(Settings{
+		Threshold:   1,
+		OpenTimeout: time.Second,
+		Clock:       clock,
+		Shared:      shared,
+		Name:        "payments",
+		OnSharedStateError: func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	})
+
+	generation := allow(t, cb)
+	done := make(chan struct{})
+	go func() {
+		cb.RecordFailure(generation)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RecordFailure waited for the shared state")
+	}
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v; want open", cb.State())
+	}
+
+	close(shared.release)
+	eventually(t, "the failed write to be reported", func() bool { return cb.Metrics().SharedStateErrors == 1 })
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || errs[0] != errBackend {
+		t.Fatalf("OnSharedStateError got %v; want [%v]", errs, errBackend)
+	}
+}
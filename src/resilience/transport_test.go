@@ -0,0 +1,116 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func statusResponse(req *http.Request, code int) *http.Response {
+	return &http.Response{StatusCode: code, Header: http.Header{}, Body: http.NoBody, Request: req}
+}
+
+func TestTransport(t *testing.T) {
+	clock := newFakeClock()
+	status := map[string]int{"bad.example": 500, "good.example": 200}
+	calls := map[string]int{}
+	tr := NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls[req.URL.Host]++
+		return statusResponse(req, status[req.URL.Host]), nil
+	}), func(string) *CircuitBreaker {
+		return NewCircuitBreaker(Settings{Threshold: 2, OpenTimeout: 1500 * time.Millisecond, Clock: clock})
+	})
+	get := func(host string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		get("bad.example")
+		get("good.example")
+	}
+	if calls["bad.example"] != 2 || calls["good.example"] != 3 {
+		t.Fatalf("calls = %v; want the bad host cut off after two 5xx and the good one untouched", calls)
+	}
+	resp := get("bad.example")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("open circuit answered %d with Retry-After %q; want 503 with 2", resp.StatusCode,
+			resp.Header.Get("Retry-After"))
+	}
+	if tr.Breaker("good.example").State() != StateClosed {
+		t.Fatal("the good host's circuit opened")
+	}
+}
+
+// TestTransportCancelledProbe checks that a half-open probe the caller cancelled is not counted and gives its trial
+// slot back, so the next request can probe the host.
+func TestTransportCancelledProbe(t *testing.T) {
+	clock := newFakeClock()
+	status := 500
+	tr := NewTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := req.Context().Err(); err != nil {
+			return nil, errors.New("net/http: request canceled")
+		}
+		return statusResponse(req, status), nil
+	}), func(string) *CircuitBreaker {
+		return NewCircuitBreaker(Settings{Threshold: 1, OpenTimeout: time.Second, Clock: clock})
+	})
+	cb := tr.Breaker("svc.example")
+
+	tr.RoundTrip(httptest.NewRequest(http.MethodGet, "http://svc.example/", nil))
+	if cb.State() != StateOpen {
+		t.Fatalf("State() = %v after a 500; want open", cb.State())
+	}
+	clock.Advance(time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://svc.example/", nil).WithContext(ctx)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("cancelled request succeeded")
+	}
+	if cb.State() != StateHalfOpen {
+		t.Fatalf("State() = %v after a cancelled probe; want half-open", cb.State())
+	}
+
+	status = 200
+	resp, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, "http://svc.example/", nil))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("probe after a cancelled one = %v, %v; want it sent to the host", resp.StatusCode, err)
+	}
+	if cb.State() != StateClosed {
+		t.Fatalf("State() = %v after a successful probe; want closed", cb.State())
+	}
+}
+
+func TestShedLoad(t *testing.T) {
+	clock := newFakeClock()
+	cb := NewCircuitBreaker(Settings{Threshold: 1, OpenTimeout: time.Second, Clock: clock})
+	h := ShedLoad(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cb)
+	serve := func() int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("closed circuit: got %d; want 200", code)
+	}
+	cb.RecordFailure(allow(t, cb))
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Fatalf("open circuit: got %d; want 503", code)
+	}
+	clock.Advance(time.Second)
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("half-open circuit: got %d; want 200", code)
+	}
+	// ShedLoad only looked at the state, so the trial request is still available.
+	allow(t, cb)
+}
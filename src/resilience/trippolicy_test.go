@@ -0,0 +1,82 @@
+package resilience
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountWindow(t *testing.T) {
+	p := CountWindow(4, RateThresholds{MinCalls: 4, FailureRate: 50})
+	now := time.Now()
+	for _, failed := range []bool{true, false, true} {
+		p.Record(now, failed, false)
+	}
+	if p.ShouldTrip(now) {
+		t.Fatal("tripped below MinCalls")
+	}
+	p.Record(now, false, false)
+	if !p.ShouldTrip(now) {
+		t.Fatal("2 failures in 4 calls did not trip at 50%")
+	}
+	// The oldest failure drops out of the window.
+	p.Record(now, false, false)
+	if p.ShouldTrip(now) {
+		t.Fatal("1 failure in the last 4 calls tripped at 50%")
+	}
+	p.Reset()
+	if p.ShouldTrip(now) {
+		t.Fatal("tripped after Reset")
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	p := TimeWindow(10*time.Second, 10, RateThresholds{MinCalls: 2, FailureRate: 50, SlowCallRate: 100})
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.Record(now, true, false)
+	p.Record(now.Add(time.Second), true, false)
+	if !p.ShouldTrip(now.Add(time.Second)) {
+		t.Fatal("2 failures in 2 calls did not trip")
+	}
+	// Ten seconds on, the first bucket has expired but the second has not.
+	p.Record(now.Add(10*time.Second), false, false)
+	if !p.ShouldTrip(now.Add(10 * time.Second)) {
+		t.Fatal("1 failure in 2 calls did not trip at 50%")
+	}
+	if p.ShouldTrip(now.Add(11 * time.Second)) {
+		t.Fatal("expired failures still counted")
+	}
+
+	p.Reset()
+	for i := 0; i < 2; i++ {
+		p.Record(now, false, true)
+	}
+	if !p.ShouldTrip(now) {
+		t.Fatal("all calls slow did not trip at a 100% slow call rate")
+	}
+}
+
+// TestWindowDefaults checks that out-of-range sizes are clamped instead of panicking.
+func TestWindowDefaults(t *testing.T) {
+	rates := RateThresholds{MinCalls: 1, FailureRate: 100}
+	now := time.Now()
+	before1970 := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	policies := map[string]TripPolicy{
+		"CountWindow(0)":          CountWindow(0, rates),
+		"CountWindow(-1)":         CountWindow(-1, rates),
+		"TimeWindow(0, 0)":        TimeWindow(0, 0, rates),
+		"TimeWindow(1s, 0)":       TimeWindow(time.Second, 0, rates),
+		"TimeWindow(1s, -1)":      TimeWindow(time.Second, -1, rates),
+		"TimeWindow(5ns, 100)":    TimeWindow(5, 100, rates),
+		"TimeWindow(-1s, 10)":     TimeWindow(-time.Second, 10, rates),
+		"TimeWindow(1s, 1000000)": TimeWindow(time.Second, 1000000, rates),
+	}
+	for name, p := range policies {
+		for _, at := range []time.Time{now, before1970} {
+			p.Reset()
+			p.Record(at, true, false)
+			if !p.ShouldTrip(at) {
+				t.Errorf("%s: a failure did not trip at %v", name, at)
+			}
+		}
+	}
+}
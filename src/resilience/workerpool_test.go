@@ -0,0 +1,134 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewWorkerPoolDefaults(t *testing.T) {
+	p := NewWorkerPool[int](0, -1)
+	defer p.Shutdown(context.Background())
+	if len(p.running) != 10 || cap(p.tasks) != 0 {
+		t.Fatalf("NewWorkerPool(0, -1) has %d workers and room for %d tasks; want 10 and 0", len(p.running), cap(p.tasks))
+	}
+	// With no queue a task is only taken once a worker is waiting for one.
+	eventually(t, "a task to be taken", func() bool {
+		result, err := p.Submit(context.Background(), func(context.Context) (int, error) { return 1, nil })
+		return err == nil && (<-result).Value == 1
+	})
+}
+
+// TestWorkerPoolBoundsGoroutines checks that however many tasks are queued, no more than workers run at once and the
+// pool starts no goroutines of its own for them.
+func TestWorkerPoolBoundsGoroutines(t *testing.T) {
+	const workers, queue = 3, 20
+	p := NewWorkerPool[int](workers, queue)
+	base := runtime.NumGoroutine()
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	release := make(chan struct{})
+	task := func(context.Context) (int, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 1, nil
+	}
+	var results []<-chan Result[int]
+	eventually(t, "the pool to fill up", func() bool {
+		result, err := p.Submit(context.Background(), task)
+		if err == ErrPoolFull {
+			return true
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+		return false
+	})
+	if len(results) < queue {
+		t.Fatalf("the pool took %d tasks before it was full; want at least %d", len(results), queue)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		t.Errorf("%d goroutines with the pool full; want no more than the %d before", n, base)
+	}
+
+	close(release)
+	for _, result := range results {
+		if res := <-result; res.Value != 1 || res.Err != nil {
+			t.Fatalf("result = %+v; want 1", res)
+		}
+	}
+	if peak != workers {
+		t.Errorf("%d tasks ran at once; want %d", peak, workers)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Submit(context.Background(), task); err != ErrPoolClosed {
+		t.Fatalf("Submit after Shutdown = %v; want ErrPoolClosed", err)
+	}
+}
+
+func TestWorkerPoolShutdownTimeout(t *testing.T) {
+	p := NewWorkerPool[int](1, 1)
+	started := make(chan struct{})
+	running, err := p.Submit(context.Background(), func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	ran := false
+	queued, err := p.Submit(context.Background(), func(context.Context) (int, error) {
+		ran = true
+		return 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v; want context.DeadlineExceeded", err)
+	}
+	if res := <-running; res.Err != context.Canceled {
+		t.Errorf("running task reported %v; want context.Canceled", res.Err)
+	}
+	if res := <-queued; res.Err != context.Canceled || ran {
+		t.Errorf("queued task reported %v and ran = %v; want context.Canceled without running", res.Err, ran)
+	}
+}
+
+func TestWorkerPoolPanic(t *testing.T) {
+	p := NewWorkerPool[int](1, 1)
+	defer p.Shutdown(context.Background())
+	result, err := p.Submit(context.Background(), func(context.Context) (int, error) { panic("boom") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perr *PanicError
+	if res := <-result; !errors.As(res.Err, &perr) || perr.Value != "boom" {
+		t.Fatalf("result error = %v; want a PanicError with boom", res.Err)
+	}
+	// The worker survives the panic.
+	eventually(t, "the worker to take another task", func() bool {
+		result, err := p.Submit(context.Background(), func(context.Context) (int, error) { return 1, nil })
+		return err == nil && (<-result).Value == 1
+	})
+}